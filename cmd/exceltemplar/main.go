@@ -0,0 +1,255 @@
+// Command exceltemplar рендерит, проверяет и разбирает шаблоны Excel без написания кода на Go.
+//
+//	exceltemplar render -o report.xlsx template.xlsx data.json [more.yaml ...]
+//	exceltemplar lint template.xlsx [other.xlsx ...]
+//	exceltemplar inspect template.xlsx
+//
+// Данные render читаются из файлов JSON и YAML (по расширению .yaml/.yml) или, без
+// файлов либо с аргументом "-" (не больше одного), из stdin. Каждый файл — отдельный
+// корень данных; нестроковые ключи YAML (2023: ...) становятся строками.
+// Код выхода: 0 — успех, 1 — ошибки рендера или замечания lint, 2 — неверный вызов.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	exceltemplar "github.com/nikitaxru/exceltemplar"
+)
+
+const usage = `Usage:
+  exceltemplar render -o out.xlsx [-strict] [-collect [-comments]] [-images dir] template.xlsx [data.json|data.yaml|- ...]
+  exceltemplar lint template.xlsx [...]
+  exceltemplar inspect template.xlsx
+`
+
+// errUsage — неверный вызов: печатается справка, код выхода 2
+var errUsage = errors.New("invalid usage")
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// run выполняет команду и возвращает код выхода
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, usage)
+		return 2
+	}
+	var code int
+	var err error
+	switch args[0] {
+	case "render":
+		code, err = cmdRender(args[1:], stdin, stderr)
+	case "lint":
+		code, err = cmdLint(args[1:], stdout, stderr)
+	case "inspect":
+		code, err = cmdInspect(args[1:], stdout, stderr)
+	case "help", "-h", "-help", "--help":
+		fmt.Fprint(stdout, usage)
+		return 0
+	default:
+		err = fmt.Errorf("%w: unknown command %q", errUsage, args[0])
+	}
+	if errors.Is(err, errUsage) {
+		fmt.Fprintf(stderr, "exceltemplar: %v\n%s", err, usage)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "exceltemplar: %v\n", err)
+		return 1
+	}
+	return code
+}
+
+// newFlagSet создаёт набор флагов подкоманды; ошибки разбора возвращаются как errUsage
+func newFlagSet(name string, stderr io.Writer) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	return fs
+}
+
+// -----------------------------
+// render
+// -----------------------------
+
+func cmdRender(args []string, stdin io.Reader, stderr io.Writer) (int, error) {
+	fs := newFlagSet("render", stderr)
+	out := fs.String("o", "", "output .xlsx file (required)")
+	strict := fs.Bool("strict", false, "fail on missing paths and unknown variables (mark optional values with ?)")
+	collect := fs.Bool("collect", false, "keep rendering after errors: failing cells get #ERR, all errors are listed")
+	comments := fs.Bool("comments", false, "with -collect, attach the error text as a comment to #ERR cells")
+	images := fs.String("images", "", "directory image() may read picture files from (by default only base64 and data URIs)")
+	if err := fs.Parse(args); err != nil {
+		return 0, fmt.Errorf("%w: %v", errUsage, err)
+	}
+	if *out == "" || fs.NArg() == 0 {
+		return 0, fmt.Errorf("%w: render needs -o and a template", errUsage)
+	}
+	tmpl, err := exceltemplar.LoadTemplate(fs.Arg(0))
+	if err != nil {
+		return 0, err
+	}
+	tmpl.Strict(*strict)
+	tmpl.CollectErrors(*collect)
+	tmpl.ErrorComments(*comments)
+	if *images != "" {
+		tmpl.ImageFS(os.DirFS(*images))
+	}
+
+	inputs := fs.Args()[1:]
+	if len(inputs) == 0 {
+		inputs = []string{"-"}
+	}
+	stdinUsed := false
+	for _, name := range inputs {
+		if name == "-" {
+			if stdinUsed {
+				return 0, fmt.Errorf("%w: stdin (-) can be read only once", errUsage)
+			}
+			stdinUsed = true
+		}
+	}
+	data := make([]interface{}, 0, len(inputs))
+	for _, name := range inputs {
+		v, err := readData(name, stdin)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %w", name, err)
+		}
+		data = append(data, v)
+	}
+
+	doc, err := tmpl.ExecuteData(data...)
+	if doc == nil {
+		return 0, err
+	}
+	defer doc.Close()
+	if serr := doc.Save(*out); serr != nil {
+		return 0, serr
+	}
+	var rep *exceltemplar.RenderReport
+	if errors.As(err, &rep) {
+		for _, te := range rep.Errors {
+			fmt.Fprintln(stderr, te)
+		}
+		fmt.Fprintf(stderr, "exceltemplar: %s written with %d error(s)\n", *out, len(rep.Errors))
+		return 1, nil
+	}
+	return 0, err
+}
+
+// readData читает один корень данных: файл .yaml/.yml как YAML, остальные как JSON;
+// "-" — stdin, формат определяется по первому символу
+func readData(name string, stdin io.Reader) (interface{}, error) {
+	var raw []byte
+	var err error
+	if name == "-" {
+		raw, err = io.ReadAll(stdin)
+	} else {
+		raw, err = os.ReadFile(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	isYAML := false
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".yaml", ".yml":
+		isYAML = true
+	case ".json":
+	default:
+		t := bytes.TrimSpace(raw)
+		isYAML = len(t) > 0 && t[0] != '{' && t[0] != '['
+	}
+	var v interface{}
+	if isYAML {
+		err = yaml.Unmarshal(raw, &v)
+	} else {
+		err = json.Unmarshal(raw, &v)
+	}
+	return v, err
+}
+
+// -----------------------------
+// lint
+// -----------------------------
+
+func cmdLint(args []string, stdout, stderr io.Writer) (int, error) {
+	fs := newFlagSet("lint", stderr)
+	if err := fs.Parse(args); err != nil {
+		return 0, fmt.Errorf("%w: %v", errUsage, err)
+	}
+	if fs.NArg() == 0 {
+		return 0, fmt.Errorf("%w: lint needs at least one template", errUsage)
+	}
+	code := 0
+	for _, path := range fs.Args() {
+		for _, is := range exceltemplar.Validate(path) {
+			line := fmt.Sprintf("%s: %s", path, is.Severity)
+			if is.Code != "" {
+				line += " [" + string(is.Code) + "]"
+			}
+			fmt.Fprintf(stdout, "%s %s\n", line, is)
+			code = 1
+		}
+	}
+	return code, nil
+}
+
+// -----------------------------
+// inspect
+// -----------------------------
+
+func cmdInspect(args []string, stdout, stderr io.Writer) (int, error) {
+	fs := newFlagSet("inspect", stderr)
+	if err := fs.Parse(args); err != nil {
+		return 0, fmt.Errorf("%w: %v", errUsage, err)
+	}
+	if fs.NArg() != 1 {
+		return 0, fmt.Errorf("%w: inspect needs one template", errUsage)
+	}
+	tmpl, err := exceltemplar.LoadTemplate(fs.Arg(0))
+	if err != nil {
+		return 0, err
+	}
+	for i, so := range tmpl.Outline() {
+		if i > 0 {
+			fmt.Fprintln(stdout)
+		}
+		fmt.Fprintf(stdout, "sheet %s\n", so.Name)
+		printBlocks(stdout, so.Blocks, "  ")
+		if len(so.Paths) > 0 {
+			fmt.Fprintln(stdout, "  paths:")
+			for _, p := range so.Paths {
+				fmt.Fprintf(stdout, "    %s\n", p)
+			}
+		}
+	}
+	return 0, nil
+}
+
+// printBlocks печатает дерево блоков с отступом indent на уровень
+func printBlocks(w io.Writer, nodes []*exceltemplar.OutlineNode, indent string) {
+	for _, n := range nodes {
+		line := n.Kind
+		if n.Cell != "" {
+			line += " " + n.Cell
+		}
+		if n.Expr != "" {
+			line += ": " + strings.ReplaceAll(n.Expr, "\n", `\n`)
+		}
+		if len(n.Vars) > 0 {
+			line += " as " + strings.Join(n.Vars, " ")
+		}
+		fmt.Fprintf(w, "%s%s\n", indent, line)
+		printBlocks(w, n.Children, indent+"  ")
+	}
+}
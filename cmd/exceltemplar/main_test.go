@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xuri/excelize/v2"
+)
+
+func saveTemplate(t *testing.T, dir string, cells map[string]string) string {
+	t.Helper()
+	f := excelize.NewFile()
+	for addr, v := range cells {
+		require.NoError(t, f.SetCellValue("Sheet1", addr, v))
+	}
+	path := filepath.Join(dir, "template.xlsx")
+	require.NoError(t, f.SaveAs(path))
+	return path
+}
+
+func TestRun(t *testing.T) {
+	dir := t.TempDir()
+	tpl := saveTemplate(t, dir, map[string]string{
+		"A1": "{{= $.title}}",
+		"A2": "{{#each $.items as $it}}",
+		"A3": "{{= $it.name}}",
+		"B3": "{{= $it.qty}}",
+		"A4": "{{/each}}",
+	})
+	exec := func(stdin string, args ...string) (int, string, string) {
+		var out, errOut bytes.Buffer
+		code := run(args, strings.NewReader(stdin), &out, &errOut)
+		return code, out.String(), errOut.String()
+	}
+	rows := func(path string) [][]string {
+		f, err := excelize.OpenFile(path)
+		require.NoError(t, err)
+		defer f.Close()
+		rows, err := f.GetRows("Sheet1")
+		require.NoError(t, err)
+		return rows
+	}
+
+	// render: JSON-файл и YAML из stdin — отдельные корни данных
+	jsonPath := filepath.Join(dir, "items.json")
+	require.NoError(t, os.WriteFile(jsonPath, []byte(`{"items": [{"name": "a", "qty": 1}, {"name": "b", "qty": 2}]}`), 0o644))
+	out := filepath.Join(dir, "out.xlsx")
+	code, _, stderr := exec("title: Отчёт\n", "render", "-o", out, tpl, jsonPath, "-")
+	require.Equal(t, 0, code, stderr)
+	assert.Equal(t, [][]string{{"Отчёт"}, {"a", "1"}, {"b", "2"}}, rows(out))
+
+	// YAML с числовыми ключами: ключи становятся строками
+	yamlPath := filepath.Join(dir, "years.yaml")
+	require.NoError(t, os.WriteFile(yamlPath, []byte("title: Годы\nyears:\n  2023: 10\n  2024: 12\n"), 0o644))
+	years := saveTemplate(t, t.TempDir(), map[string]string{
+		"A1": "{{= $.title}}",
+		"A2": "{{#each-obj $.years as $y $v}}",
+		"A3": "{{= $y}}",
+		"B3": "{{= $v}}",
+		"A4": "{{/each-obj}}",
+	})
+	code, _, stderr = exec("", "render", "-o", out, years, yamlPath)
+	require.Equal(t, 0, code, stderr)
+	assert.Equal(t, [][]string{{"Годы"}, {"2023", "10"}, {"2024", "12"}}, rows(out))
+
+	// render -strict -collect: файл пишется, ошибки перечисляются, код 1
+	code, _, stderr = exec(`{"items": [{"name": "a"}]}`, "render", "-strict", "-collect", "-o", out, tpl)
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stderr, "ячейка A1")
+	assert.Contains(t, stderr, "ячейка B3, элемент $.items[0]")
+	assert.Equal(t, [][]string{{"#ERR"}, {"a", "#ERR"}}, rows(out))
+
+	// lint: чистый шаблон — код 0, с замечаниями — 1
+	code, stdout, _ := exec("", "lint", tpl)
+	assert.Equal(t, 0, code)
+	assert.Empty(t, stdout)
+	bad := saveTemplate(t, t.TempDir(), map[string]string{"A1": "{{#each $.items as $it}}", "A2": "{{= $x}}", "A3": "{{/each}}"})
+	code, stdout, _ = exec("", "lint", bad)
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stdout, "warning [unknown_var] лист Sheet1, ячейка A2")
+
+	// inspect: дерево блоков и пути от корня
+	code, stdout, _ = exec("", "inspect", tpl)
+	assert.Equal(t, 0, code)
+	assert.Equal(t, `sheet Sheet1
+  cell A1: {{= $.title}}
+  each A2: $.items as $it
+    cell A3: {{= $it.name}}
+    cell B3: {{= $it.qty}}
+  paths:
+    $.items
+    $.items[].name
+    $.items[].qty
+    $.title
+`, stdout)
+
+	// неверный вызов
+	code, _, stderr = exec("", "render", tpl)
+	assert.Equal(t, 2, code)
+	assert.Contains(t, stderr, "Usage:")
+	code, _, stderr = exec("{}", "render", "-o", out, tpl, "-", "-")
+	assert.Equal(t, 2, code)
+	assert.Contains(t, stderr, "stdin (-) can be read only once")
+}
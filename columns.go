@@ -0,0 +1,452 @@
+package exceltemplar
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// -----------------------------
+// Горизонтальные циклы (each-col)
+// -----------------------------
+
+var (
+	rxCtrlEachCol     = regexp.MustCompile(`^\{\{#each-col\s+(.+?)\}\}$`)
+	rxCtrlEndEachCol  = regexp.MustCompile(`^\{\{\/each-col\}\}$`)
+	rxCtrlEachColCell = regexp.MustCompile(`^\{\{#each-col\s+(.+?)\}\}\s*\{\{\/each-col\}\}$`)
+)
+
+// colLoop — цикл по колонкам: колонки startCol..endCol (тело) повторяются для каждого
+// элемента массива. Маркеры стоят в отдельной строке над таблицей и задают границы тела.
+type colLoop struct {
+	path     string
+	itemVar  string
+	indexVar string
+	row      int // строка с маркерами
+	startCol int
+	endCol   int
+	optional bool
+}
+
+// colBinding — значения переменных цикла each-col для одной итоговой колонки
+type colBinding struct {
+	loop  *colLoop
+	item  interface{}
+	index int
+}
+
+func (b colBinding) bind(ctx *evalContext) *evalContext {
+	nctx := &evalContext{current: ctx.current, parent: ctx.parent, root: ctx.root, exprs: ctx.exprs, strict: ctx.strict, images: ctx.images, vars: make(map[string]interface{}, len(ctx.vars)+2),
+		iter: ctx.iter, iterVar: ctx.iterVar}
+	for k, v := range ctx.vars {
+		nctx.vars[k] = v
+	}
+	if b.loop.itemVar != "" {
+		nctx.vars[b.loop.itemVar] = b.item
+	}
+	if b.loop.indexVar != "" {
+		nctx.vars[b.loop.indexVar] = float64(b.index)
+	}
+	return nctx
+}
+
+// parseColLoops ищет в строке маркеры {{#each-col ...}} и {{/each-col}}.
+// Оба маркера можно записать в одну ячейку, тогда тело цикла — одна колонка.
+func parseColLoops(row []string, rowNum int) ([]*colLoop, error) {
+	var loops []*colLoop
+	var open *colLoop
+	for cIdx, cell := range row {
+		col := cIdx + 1
+		s := strings.TrimSpace(cell)
+		if m := rxCtrlEachColCell.FindStringSubmatch(s); len(m) == 2 {
+			if open != nil {
+				return nil, colSyntaxError(col, rowNum, cell, "вложенный each-col на строке %d", rowNum)
+			}
+			path, itemVar, indexVar := parseEachHeader(m[1])
+			path, optional := splitOptional(path)
+			loops = append(loops, &colLoop{path: path, itemVar: itemVar, indexVar: indexVar, row: rowNum, startCol: col, endCol: col, optional: optional})
+			continue
+		}
+		if m := rxCtrlEachCol.FindStringSubmatch(s); len(m) == 2 {
+			if open != nil {
+				return nil, colSyntaxError(col, rowNum, cell, "вложенный each-col на строке %d", rowNum)
+			}
+			path, itemVar, indexVar := parseEachHeader(m[1])
+			path, optional := splitOptional(path)
+			open = &colLoop{path: path, itemVar: itemVar, indexVar: indexVar, row: rowNum, startCol: col, optional: optional}
+			continue
+		}
+		if rxCtrlEndEachCol.MatchString(s) {
+			if open == nil {
+				return nil, colSyntaxError(col, rowNum, cell, "некорректный /each-col на строке %d", rowNum)
+			}
+			open.endCol = col
+			loops = append(loops, open)
+			open = nil
+		}
+	}
+	if open != nil {
+		return nil, colSyntaxError(open.startCol, rowNum, row[open.startCol-1], "не закрыт each-col на строке %d", rowNum)
+	}
+	return loops, nil
+}
+
+func colSyntaxError(col, row int, raw, format string, args ...interface{}) error {
+	return &TemplateError{Code: CodeSyntax, Cell: cellName(col, row), Raw: raw, Err: fmt.Errorf(format, args...)}
+}
+
+// checkColLoops упорядочивает циклы по колонкам и проверяет, что их тела не пересекаются
+func checkColLoops(loops []*colLoop) error {
+	sort.Slice(loops, func(i, j int) bool { return loops[i].startCol < loops[j].startCol })
+	for i := 1; i < len(loops); i++ {
+		if loops[i].startCol <= loops[i-1].endCol {
+			return colSyntaxError(loops[i].startCol, loops[i].row, "", "циклы each-col на строках %d и %d пересекаются по колонкам", loops[i-1].row, loops[i].row)
+		}
+	}
+	return nil
+}
+
+// expandColumns размножает колонки циклов each-col на листе и заново разбирает лист.
+// Циклы обрабатываются справа налево, чтобы вставки не сдвигали ещё не обработанные тела.
+// Возвращённый шаблон знает, какие переменные цикла связаны с каждой итоговой колонкой.
+func expandColumns(f *excelize.File, st *sheetTemplate, ctx *evalContext, rep *RenderReport) (*sheetTemplate, error) {
+	sheet := st.name
+	bind := make(map[int]colBinding)
+	for i := len(st.colLoops) - 1; i >= 0; i-- {
+		lp := st.colLoops[i]
+		items, err := loopItems(ctx, "each-col", lp.path, lp.optional)
+		if err != nil {
+			// в режиме сбора ошибок колонки цикла удаляются, как для пустого массива
+			if err := rep.add(errorAt(err, CodeEval, TemplateError{Sheet: sheet, Cell: cellName(lp.startCol, lp.row), Expr: lp.path, Path: ctx.iter})); err != nil {
+				return nil, err
+			}
+		}
+		delta, err := repeatColumns(f, sheet, lp, len(items), rep)
+		if err != nil {
+			return nil, err
+		}
+		shifted := make(map[int]colBinding, len(bind))
+		for col, b := range bind {
+			if col > lp.endCol {
+				col += delta
+			}
+			shifted[col] = b
+		}
+		bind = shifted
+		w := lp.endCol - lp.startCol + 1
+		for k, item := range items {
+			for c := lp.startCol; c <= lp.endCol; c++ {
+				bind[c+k*w] = colBinding{loop: lp, item: item, index: k}
+			}
+		}
+	}
+	// Строки с маркерами each-col удаляем снизу вверх
+	markerRows := make([]int, 0, len(st.colLoops))
+	seen := make(map[int]bool)
+	for _, lp := range st.colLoops {
+		if !seen[lp.row] {
+			seen[lp.row] = true
+			markerRows = append(markerRows, lp.row)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(markerRows)))
+	for _, r := range markerRows {
+		if err := f.RemoveRow(sheet, r); err != nil {
+			return nil, err
+		}
+	}
+	nst, err := parseSheet(f, sheet)
+	if err != nil {
+		return nil, err
+	}
+	nst.colBind = bind
+	return nst, nil
+}
+
+// bodyCell — содержимое ячейки тела цикла, которое копируется в каждую копию
+type bodyCell struct {
+	style int
+	value interface{}
+}
+
+// repeatColumns превращает тело цикла в n копий: вставляет колонки справа от тела,
+// переносит ширины, стили, значения, объединения и формулы. Возвращает, на сколько
+// сдвинулись колонки правее тела.
+func repeatColumns(f *excelize.File, sheet string, lp *colLoop, n int, rep *RenderReport) (int, error) {
+	w := lp.endCol - lp.startCol + 1
+	delta := (n - 1) * w
+	if n == 1 {
+		return 0, nil
+	}
+	lastRow, err := sheetRowCount(f, sheet)
+	if err != nil {
+		return 0, err
+	}
+	lastCol, err := sheetColCount(f, sheet)
+	if err != nil {
+		return 0, err
+	}
+
+	// Формулы всего листа переписываются от исходного текста, а не после
+	// автоматической правки excelize при вставке колонок
+	type cellFormula struct {
+		row, col int
+		formula  string
+	}
+	var formulas []cellFormula
+	body := make(map[[2]int]bodyCell)
+	for r := 1; r <= lastRow; r++ {
+		for c := 1; c <= lastCol; c++ {
+			addr, _ := excelize.CoordinatesToCellName(c, r)
+			fm, _ := f.GetCellFormula(sheet, addr)
+			if fm != "" {
+				formulas = append(formulas, cellFormula{row: r, col: c, formula: fm})
+			}
+			if c < lp.startCol || c > lp.endCol || n == 0 {
+				continue
+			}
+			var bc bodyCell
+			if sid, err := f.GetCellStyle(sheet, addr); err == nil {
+				bc.style = sid
+			}
+			if fm == "" {
+				bc.value = rawCellValue(f, sheet, addr)
+			}
+			if bc.style != 0 || bc.value != nil {
+				body[[2]int{r, c}] = bc
+			}
+		}
+	}
+	merges, err := f.GetMergeCells(sheet)
+	if err != nil {
+		return 0, err
+	}
+
+	startName, _ := excelize.ColumnNumberToName(lp.startCol)
+	if n == 0 {
+		for i := 0; i < w; i++ {
+			if err := f.RemoveCol(sheet, startName); err != nil {
+				return 0, err
+			}
+		}
+	} else {
+		nextName, _ := excelize.ColumnNumberToName(lp.endCol + 1)
+		if err := f.InsertCols(sheet, nextName, delta); err != nil {
+			return 0, err
+		}
+		// Свойства колонок ставим до стилей ячеек: SetColStyle перекрашивает всю колонку
+		for c := lp.startCol; c <= lp.endCol; c++ {
+			name, _ := excelize.ColumnNumberToName(c)
+			width, err := f.GetColWidth(sheet, name)
+			if err != nil {
+				return 0, err
+			}
+			style, _ := f.GetColStyle(sheet, name)
+			visible, _ := f.GetColVisible(sheet, name)
+			level, _ := f.GetColOutlineLevel(sheet, name)
+			for k := 1; k < n; k++ {
+				dst, _ := excelize.ColumnNumberToName(c + k*w)
+				if err := f.SetColWidth(sheet, dst, dst, width); err != nil {
+					return 0, err
+				}
+				if style != 0 {
+					if err := f.SetColStyle(sheet, dst, style); err != nil {
+						return 0, err
+					}
+				}
+				if !visible {
+					if err := f.SetColVisible(sheet, dst, false); err != nil {
+						return 0, err
+					}
+				}
+				if level > 0 {
+					if err := f.SetColOutlineLevel(sheet, dst, level); err != nil {
+						return 0, err
+					}
+				}
+			}
+		}
+		for pos, bc := range body {
+			for k := 1; k < n; k++ {
+				addr, _ := excelize.CoordinatesToCellName(pos[1]+k*w, pos[0])
+				if bc.style != 0 {
+					if err := f.SetCellStyle(sheet, addr, addr, bc.style); err != nil {
+						return 0, err
+					}
+				}
+				if bc.value != nil {
+					if err := f.SetCellValue(sheet, addr, bc.value); err != nil {
+						return 0, err
+					}
+				}
+			}
+		}
+		// Объединения внутри тела повторяем в каждой копии
+		for _, m := range merges {
+			sc, sr, _ := excelize.CellNameToCoordinates(m.GetStartAxis())
+			ec, er, _ := excelize.CellNameToCoordinates(m.GetEndAxis())
+			if sc < lp.startCol || ec > lp.endCol {
+				continue
+			}
+			for k := 1; k < n; k++ {
+				c1, _ := excelize.CoordinatesToCellName(sc+k*w, sr)
+				c2, _ := excelize.CoordinatesToCellName(ec+k*w, er)
+				_ = f.MergeCell(sheet, c1, c2)
+			}
+		}
+	}
+
+	// setFormula записывает перенесённую формулу; ошибка переноса в режиме сбора
+	// ошибок оставляет в ячейке #ERR
+	setFormula := func(cf cellFormula, col, copyIdx int) error {
+		addr, _ := excelize.CoordinatesToCellName(col, cf.row)
+		fm, err := mapFormulaCols(cf.formula, sheet, lp, n, copyIdx)
+		if err != nil {
+			if err := rep.add(errorAt(err, CodeFormula, TemplateError{Sheet: sheet, Cell: cellName(cf.col, cf.row), Raw: "=" + cf.formula})); err != nil {
+				return err
+			}
+			return f.SetCellValue(sheet, addr, errMarker)
+		}
+		return f.SetCellFormula(sheet, addr, fm)
+	}
+	for _, cf := range formulas {
+		if cf.col >= lp.startCol && cf.col <= lp.endCol {
+			for k := 0; k < n; k++ {
+				if err := setFormula(cf, cf.col+k*w, k); err != nil {
+					return 0, err
+				}
+			}
+			continue
+		}
+		col := cf.col
+		if col > lp.endCol {
+			col += delta
+		}
+		if err := setFormula(cf, col, -1); err != nil {
+			return 0, err
+		}
+	}
+	return delta, nil
+}
+
+// rawCellValue читает значение ячейки с сохранением типа (число, логическое, строка)
+func rawCellValue(f *excelize.File, sheet, addr string) interface{} {
+	raw, err := f.GetCellValue(sheet, addr, excelize.Options{RawCellValue: true})
+	if err != nil || raw == "" {
+		return nil
+	}
+	typ, _ := f.GetCellType(sheet, addr)
+	switch typ {
+	case excelize.CellTypeBool:
+		return raw == "1" || strings.EqualFold(raw, "true")
+	case excelize.CellTypeUnset, excelize.CellTypeNumber, excelize.CellTypeDate:
+		if fl, err := strconv.ParseFloat(raw, 64); err == nil {
+			return fl
+		}
+	}
+	return raw
+}
+
+// sheetColCount возвращает ширину заполненной области листа (не меньше maxCols)
+func sheetColCount(f *excelize.File, sheet string) (int, error) {
+	rows, err := f.GetRows(sheet)
+	if err != nil {
+		return 0, err
+	}
+	n := maxCols
+	for _, row := range rows {
+		if len(row) > n {
+			n = len(row)
+		}
+	}
+	return n, nil
+}
+
+// mapFormulaCols переписывает ссылки формулы на колонки при размножении тела цикла lp в n копий.
+// copyIdx < 0 — ячейка вне тела: ссылки на тело растягиваются на все копии (для пустого
+// цикла переносятся на пустой последний столбец листа), ссылки правее тела сдвигаются.
+// copyIdx >= 0 — копия ячейки тела: ссылки на тело остаются внутри копии, а относительные
+// ссылки сдвигаются на copyIdx ширин тела, как при копировании ячейки вправо.
+func mapFormulaCols(formula, sheet string, lp *colLoop, n, copyIdx int) (string, error) {
+	w := lp.endCol - lp.startCol + 1
+	delta := (n - 1) * w
+	inBody := func(c int) bool { return c >= lp.startCol && c <= lp.endCol }
+	outside := func(c int) int {
+		if c > lp.endCol {
+			return c + delta
+		}
+		return c
+	}
+	var err error
+	out := rewriteFormulaRefs(formula, func(ref formulaRef) string {
+		if !ref.sameSheet(sheet) || ref.from.col == 0 || ref.to.col == 0 {
+			return ref.String()
+		}
+		if copyIdx >= 0 {
+			shift := func(p refPart) refPart {
+				if !inBody(p.col) {
+					p.col = outside(p.col)
+				}
+				if !p.absCol {
+					p.col += copyIdx * w
+				}
+				return p
+			}
+			ref.from, ref.to = shift(ref.from), shift(ref.to)
+			return ref.String()
+		}
+		// Ссылка внутри тела превращается в отрезки по всем копиям
+		if inBody(ref.from.col) && inBody(ref.to.col) {
+			if n == 0 {
+				return ref.emptyCols()
+			}
+			var runs [][2]int
+			for k := 0; k < n; k++ {
+				a, b := ref.from.col+k*w, ref.to.col+k*w
+				if last := len(runs) - 1; last >= 0 && runs[last][1]+1 >= a {
+					runs[last][1] = b
+					continue
+				}
+				runs = append(runs, [2]int{a, b})
+			}
+			parts := make([]string, len(runs))
+			for i, run := range runs {
+				r := ref
+				r.from.col, r.to.col = run[0], run[1]
+				r.isRange = ref.isRange || run[0] != run[1]
+				parts[i] = r.String()
+			}
+			if len(parts) == 1 {
+				return parts[0]
+			}
+			union, uerr := unionRefs(ref, parts)
+			if uerr != nil {
+				err = uerr
+				return ref.String()
+			}
+			return union
+		}
+		from, to := ref.from, ref.to
+		// начало диапазона в теле остаётся в первой копии (для пустого цикла — на месте тела)
+		if !inBody(from.col) {
+			from.col = outside(from.col)
+		} else if n == 0 {
+			from.col = lp.startCol
+		}
+		if inBody(to.col) {
+			to.col += delta
+		} else {
+			to.col = outside(to.col)
+		}
+		if from.col > to.col {
+			return ref.emptyCols()
+		}
+		ref.from, ref.to = from, to
+		return ref.String()
+	})
+	return out, err
+}
@@ -0,0 +1,229 @@
+package exceltemplar
+
+import (
+	"encoding"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// -----------------------------
+// Данные из значений Go (RenderData)
+// -----------------------------
+
+var (
+	timeType          = reflect.TypeOf(time.Time{})
+	jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+// maxDataDepth ограничивает вложенность данных (защита от циклических указателей)
+const maxDataDepth = 64
+
+// goDataToRoot приводит значение Go к форме, с которой работает движок (как после
+// json.Unmarshal в interface{}): map[string]interface{}, []interface{}, float64,
+// string, bool и nil. time.Time сохраняется как есть, чтобы даты попадали в Excel датами.
+func goDataToRoot(v interface{}) (interface{}, error) {
+	return toData(reflect.ValueOf(v), 0)
+}
+
+func toData(v reflect.Value, depth int) (interface{}, error) {
+	if depth > maxDataDepth {
+		return nil, fmt.Errorf("данные вложены глубже %d уровней (циклическая ссылка?)", maxDataDepth)
+	}
+	if !v.IsValid() {
+		return nil, nil
+	}
+	for v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return nil, nil
+		}
+		// *time.Time тоже json.Marshaler, но дата должна остаться датой. Значение
+		// в интерфейсе разбирается по своему динамическому типу после Elem.
+		if v.Kind() == reflect.Pointer && v.Type().Implements(jsonMarshalerType) && v.Type().Elem() != timeType {
+			return fromJSONMarshaler(v)
+		}
+		v = v.Elem()
+	}
+	t := v.Type()
+	if t == timeType {
+		return v.Interface().(time.Time), nil
+	}
+	if t.Implements(jsonMarshalerType) {
+		return fromJSONMarshaler(v)
+	}
+	if t.Kind() != reflect.String && t.Implements(textMarshalerType) {
+		b, err := v.Interface().(encoding.TextMarshaler).MarshalText()
+		if err != nil {
+			return nil, err
+		}
+		return string(b), nil
+	}
+	switch v.Kind() {
+	case reflect.Bool:
+		return v.Bool(), nil
+	case reflect.String:
+		return v.String(), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return float64(v.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), nil
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return nil, nil
+		}
+		// []byte, как и в encoding/json, — строка base64 (подходит для image())
+		if t.Elem().Kind() == reflect.Uint8 && v.Kind() == reflect.Slice {
+			return base64.StdEncoding.EncodeToString(v.Bytes()), nil
+		}
+		out := make([]interface{}, v.Len())
+		for i := range out {
+			item, err := toData(v.Index(i), depth+1)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = item
+		}
+		return out, nil
+	case reflect.Map:
+		if v.IsNil() {
+			return nil, nil
+		}
+		out := make(map[string]interface{}, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			key, err := mapKeyString(iter.Key())
+			if err != nil {
+				return nil, err
+			}
+			val, err := toData(iter.Value(), depth+1)
+			if err != nil {
+				return nil, err
+			}
+			out[key] = val
+		}
+		return out, nil
+	case reflect.Struct:
+		out := make(map[string]interface{})
+		if err := structFields(v, out, depth); err != nil {
+			return nil, err
+		}
+		return out, nil
+	default:
+		// chan, func и т.п. в данные не попадают
+		return nil, nil
+	}
+}
+
+// structFields раскладывает экспортируемые поля структуры в out. Имя поля берётся
+// из тега excel, затем из тега json; "-" исключает поле, omitempty пропускает
+// пустые значения. Встроенные структуры без имени в теге раскрываются, как в encoding/json.
+func structFields(v reflect.Value, out map[string]interface{}, depth int) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		name, omitEmpty, skip := fieldName(sf)
+		if skip {
+			continue
+		}
+		fv := v.Field(i)
+		if sf.Anonymous && name == "" {
+			ft := sf.Type
+			if ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+				if fv.IsNil() {
+					continue
+				}
+				fv = fv.Elem()
+			}
+			if ft.Kind() == reflect.Struct && ft != timeType && !ft.Implements(jsonMarshalerType) {
+				if err := structFields(fv, out, depth); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		if !sf.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = sf.Name
+		}
+		if omitEmpty && fv.IsZero() {
+			continue
+		}
+		val, err := toData(fv, depth+1)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		out[name] = val
+	}
+	return nil
+}
+
+// fieldName разбирает теги excel/json поля
+func fieldName(sf reflect.StructField) (name string, omitEmpty, skip bool) {
+	tag, ok := sf.Tag.Lookup("excel")
+	if !ok {
+		tag, ok = sf.Tag.Lookup("json")
+	}
+	if !ok {
+		return "", false, false
+	}
+	if tag == "-" {
+		return "", false, true
+	}
+	parts := strings.Split(tag, ",")
+	for _, opt := range parts[1:] {
+		if opt == "omitempty" {
+			omitEmpty = true
+		}
+	}
+	return parts[0], omitEmpty, false
+}
+
+// mapKeyString приводит ключ map к строке по правилам encoding/json; кроме того,
+// принимаются дробные и булевы ключи, которые встречаются в YAML (2023.5: ..., true: ...)
+func mapKeyString(k reflect.Value) (string, error) {
+	// map[interface{}]interface{} (yaml.v3 при нестроковых ключах): ключ — скаляр в интерфейсе
+	if k.Kind() == reflect.Interface && !k.IsNil() {
+		k = k.Elem()
+	}
+	if k.Kind() == reflect.String {
+		return k.String(), nil
+	}
+	if tm, ok := k.Interface().(encoding.TextMarshaler); ok {
+		b, err := tm.MarshalText()
+		return string(b), err
+	}
+	switch k.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return fmt.Sprint(k.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return fmt.Sprint(k.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return strconv.FormatFloat(k.Float(), 'f', -1, k.Type().Bits()), nil
+	case reflect.Bool:
+		return strconv.FormatBool(k.Bool()), nil
+	}
+	return "", fmt.Errorf("неподдерживаемый тип ключа map: %s", k.Type())
+}
+
+// fromJSONMarshaler разворачивает значение с собственным MarshalJSON через его JSON-представление
+func fromJSONMarshaler(v reflect.Value) (interface{}, error) {
+	b, err := v.Interface().(json.Marshaler).MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	var out interface{}
+	if err := json.Unmarshal(b, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
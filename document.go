@@ -0,0 +1,44 @@
+package exceltemplar
+
+import (
+	"io"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// Document — результат одного рендера шаблона: собственная копия книги,
+// в которую записаны данные. Document не предназначен для конкурентного использования.
+type Document struct {
+	f *excelize.File
+	// linkStyle — стиль гиперссылок для ячеек без собственного стиля (создаётся по требованию)
+	linkStyle int
+	// styles — именованные стили шаблона для {{style}} (только чтение)
+	styles map[string]*excelize.Style
+	// cellStyles — стили, созданные для :fmt и {{style}} (см. cellStyle)
+	cellStyles map[cellStyleKey]int
+	// report — ошибки режима CollectErrors (nil — режим выключен, первая ошибка прерывает рендер)
+	report *RenderReport
+	// errComments — добавлять к ячейкам #ERR примечания с текстом ошибки (см. ErrorComments)
+	errComments bool
+}
+
+// Save сохраняет книгу в файл destPath
+func (d *Document) Save(destPath string) error { return d.f.SaveAs(destPath) }
+
+// WriteTo записывает книгу в w (например, в тело HTTP-ответа)
+func (d *Document) WriteTo(w io.Writer) (int64, error) { return d.f.WriteTo(w) }
+
+// Bytes возвращает содержимое книги в формате .xlsx
+func (d *Document) Bytes() ([]byte, error) {
+	buf, err := d.f.WriteToBuffer()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// File возвращает книгу excelize для дополнительной обработки перед сохранением
+func (d *Document) File() *excelize.File { return d.f }
+
+// Close освобождает ресурсы книги
+func (d *Document) Close() error { return d.f.Close() }
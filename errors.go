@@ -0,0 +1,166 @@
+package exceltemplar
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// -----------------------------
+// Ошибки шаблона с координатами
+// -----------------------------
+
+// ErrorCode — машиночитаемый код ошибки шаблона
+type ErrorCode string
+
+const (
+	// CodeSyntax — ошибка разбора шаблона: несбалансированные блоки, маркер не на своём месте
+	CodeSyntax ErrorCode = "syntax"
+	// CodeExpr — выражение не компилируется: синтаксис, неизвестная функция, несовместимые типы
+	CodeExpr ErrorCode = "expr"
+	// CodeEval — ошибка вычисления выражения, в том числе ошибка пользовательской функции
+	CodeEval ErrorCode = "eval"
+	// CodeArgument — неверный аргумент встроенной функции или фильтра (join, image, number, ...)
+	CodeArgument ErrorCode = "argument"
+	// CodeCollection — вставка {{= }} получила массив или объект
+	CodeCollection ErrorCode = "collection"
+	// CodeMissingPath — строгий режим: по пути нет значения
+	CodeMissingPath ErrorCode = "missing_path"
+	// CodeUnknownVar — строгий режим: переменная не объявлена ни одним циклом
+	CodeUnknownVar ErrorCode = "unknown_var"
+	// CodeLoopType — строгий режим: each по не-массиву или each-obj по не-объекту
+	CodeLoopType ErrorCode = "loop_type"
+	// CodeStyle — неизвестный именованный стиль в {{style}}
+	CodeStyle ErrorCode = "style"
+	// CodeData — входные данные не разбираются
+	CodeData ErrorCode = "data"
+	// CodeWrite — ошибка записи результата в книгу
+	CodeWrite ErrorCode = "write"
+	// CodeFormula — ссылку формулы на строки блока нельзя записать: несмежные диапазоны
+	// в функции, которая не принимает их объединение (SUMIF, VLOOKUP, ...)
+	CodeFormula ErrorCode = "formula"
+)
+
+// TemplateError — ошибка разбора или рендера шаблона с указанием места:
+// лист и ячейка шаблона, исходный текст ячейки, выражение и путь к элементу
+// данных, на котором возникла ошибка. Пустые поля означают, что место неизвестно
+// или не относится к ошибке. Ошибки Compile, Funcs и Execute имеют этот тип:
+//
+//	var te *exceltemplar.TemplateError
+//	if errors.As(err, &te) { ... te.Sheet, te.Cell, te.Code ... }
+type TemplateError struct {
+	Code  ErrorCode
+	Sheet string
+	// Cell — адрес ячейки в шаблоне (B5), а не в результате
+	Cell string
+	// Raw — исходный текст ячейки шаблона
+	Raw string
+	// Expr — выражение, вызвавшее ошибку
+	Expr string
+	// Path — путь к текущему элементу данных: $.projects[3].tasks[1]
+	Path string
+	Err  error
+}
+
+func (e *TemplateError) Error() string {
+	var loc []string
+	if e.Sheet != "" {
+		loc = append(loc, "лист "+e.Sheet)
+	}
+	if e.Cell != "" {
+		loc = append(loc, "ячейка "+e.Cell)
+	}
+	if e.Path != "" {
+		loc = append(loc, "элемент "+e.Path)
+	}
+	if len(loc) == 0 {
+		return e.Err.Error()
+	}
+	return strings.Join(loc, ", ") + ": " + e.Err.Error()
+}
+
+func (e *TemplateError) Unwrap() error { return e.Err }
+
+// codeError — ошибка с кодом без места; место добавляет errorAt там, где оно известно
+func codeError(code ErrorCode, format string, args ...interface{}) *TemplateError {
+	return &TemplateError{Code: code, Err: fmt.Errorf(format, args...)}
+}
+
+// argError — ошибка аргумента встроенной функции или фильтра
+func argError(format string, args ...interface{}) error {
+	return codeError(CodeArgument, format, args...)
+}
+
+// errorAt дополняет ошибку местом at. Если в цепочке уже есть TemplateError, его код
+// сохраняется, а заполняются только пустые поля; иначе ошибка получает код code.
+func errorAt(err error, code ErrorCode, at TemplateError) error {
+	if err == nil {
+		return nil
+	}
+	out := at
+	out.Code, out.Err = code, err
+	var te *TemplateError
+	if errors.As(err, &te) {
+		out.Code = te.Code
+		if err == error(te) {
+			out.Err = te.Err
+		}
+		for _, f := range []struct{ dst, src *string }{
+			{&out.Sheet, &te.Sheet}, {&out.Cell, &te.Cell}, {&out.Raw, &te.Raw}, {&out.Expr, &te.Expr}, {&out.Path, &te.Path},
+		} {
+			if *f.src != "" {
+				*f.dst = *f.src
+			}
+		}
+	}
+	return &out
+}
+
+// cellName — адрес ячейки шаблона для сообщений об ошибках
+func cellName(col, row int) string {
+	name, _ := excelize.CoordinatesToCellName(col, row)
+	return name
+}
+
+// iterPath возвращает путь path в данных для сообщений об ошибках: переменные циклов
+// заменяются путями их элементов ($p.tasks → $.projects[3].tasks)
+func iterPath(ctx *evalContext, path string) string {
+	path = strings.TrimSpace(path)
+	switch {
+	case path == "$" || path == "$root":
+		return "$"
+	case strings.HasPrefix(path, "$root"):
+		return "$" + path[len("$root"):]
+	case strings.HasPrefix(path, "$."):
+		return path
+	case strings.HasPrefix(path, "$"):
+		end := strings.IndexAny(path[1:], ".[")
+		name, rest := path, ""
+		if end >= 0 {
+			name, rest = path[:end+1], path[end+1:]
+		}
+		for c := ctx; c != nil; c = c.parent {
+			if c.iterVar == name && c.iter != "" {
+				return c.iter + rest
+			}
+		}
+		return path
+	case strings.HasPrefix(path, "."):
+		if ctx.iter == "" {
+			return path
+		}
+		return ctx.iter + strings.TrimSuffix(path, ".")
+	}
+	return "$." + path
+}
+
+// keySegment — сегмент пути для ключа объекта: .name или ["ключ с пробелом"]
+func keySegment(key string) string {
+	if rxFuncName.MatchString(key) {
+		return "." + key
+	}
+	return "[" + strconv.Quote(key) + "]"
+}
@@ -3,6 +3,7 @@ package exceltemplar
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"regexp"
 	"strings"
@@ -53,20 +54,14 @@ func valToCell(v interface{}) interface{} {
 	}
 }
 
-// WriteResultsWithTemplate оставляем без изменений
+// WriteResultsWithTemplate рендерит outputs в шаблон templatePath и сохраняет результат в destPath
 func WriteResultsWithTemplate(templatePath, destPath string, outputs []string) error {
 	log.Printf("📊 Начинаем запись результатов в Excel...")
 	log.Printf("📁 Шаблон: %s", templatePath)
 	log.Printf("📄 Выходной файл: %s", destPath)
-	log.Printf("📝 Количество этапов для записи: %d", len(outputs))
 
 	startTime := time.Now()
 
-	// Логируем размеры данных каждого этапа
-	for i, output := range outputs {
-		log.Printf("📊 Этап %d: %d символов", i+1, len(output))
-	}
-
 	log.Printf("🔄 Загрузка Excel шаблона...")
 	tmpl, err := LoadTemplate(templatePath)
 	if err != nil {
@@ -75,18 +70,14 @@ func WriteResultsWithTemplate(templatePath, destPath string, outputs []string) e
 	}
 	log.Printf("✅ Шаблон загружен успешно")
 
-	// Нормализуем JSON перед рендером для устойчивости
-	normalized := NormalizeForExcel(outputs)
-
-	log.Printf("🔄 Рендеринг данных в шаблон...")
-	if err := tmpl.Render(normalized); err != nil {
-		log.Printf("❌ Ошибка рендеринга: %v", err)
+	doc, err := renderResults(tmpl, outputs)
+	if err != nil {
 		return err
 	}
-	log.Printf("✅ Рендеринг завершен")
+	defer doc.Close()
 
 	log.Printf("💾 Сохранение файла...")
-	if err := tmpl.Save(destPath); err != nil {
+	if err := doc.Save(destPath); err != nil {
 		log.Printf("❌ Ошибка сохранения: %v", err)
 		return err
 	}
@@ -97,3 +88,58 @@ func WriteResultsWithTemplate(templatePath, destPath string, outputs []string) e
 
 	return nil
 }
+
+// WriteResultsWithTemplateIO — вариант WriteResultsWithTemplate без временных файлов:
+// шаблон читается из template, результат пишется в dest (например, в HTTP-ответ)
+func WriteResultsWithTemplateIO(template io.Reader, dest io.Writer, outputs []string) error {
+	log.Printf("📊 Начинаем запись результатов в Excel (поток)...")
+
+	startTime := time.Now()
+
+	log.Printf("🔄 Загрузка Excel шаблона...")
+	tmpl, err := LoadTemplateFromReader(template)
+	if err != nil {
+		log.Printf("❌ Ошибка загрузки шаблона: %v", err)
+		return err
+	}
+	log.Printf("✅ Шаблон загружен успешно")
+
+	doc, err := renderResults(tmpl, outputs)
+	if err != nil {
+		return err
+	}
+	defer doc.Close()
+
+	log.Printf("💾 Запись результата...")
+	n, err := doc.WriteTo(dest)
+	if err != nil {
+		log.Printf("❌ Ошибка записи: %v", err)
+		return err
+	}
+
+	duration := time.Since(startTime)
+	log.Printf("✅ Excel файл создан за %v (%d байт)", duration, n)
+
+	return nil
+}
+
+// renderResults нормализует outputs и рендерит их в шаблон
+func renderResults(tmpl *Template, outputs []string) (*Document, error) {
+	log.Printf("📝 Количество этапов для записи: %d", len(outputs))
+	// Логируем размеры данных каждого этапа
+	for i, output := range outputs {
+		log.Printf("📊 Этап %d: %d символов", i+1, len(output))
+	}
+
+	// Нормализуем JSON перед рендером для устойчивости
+	normalized := NormalizeForExcel(outputs)
+
+	log.Printf("🔄 Рендеринг данных в шаблон...")
+	doc, err := tmpl.Execute(normalized)
+	if err != nil {
+		log.Printf("❌ Ошибка рендеринга: %v", err)
+		return nil, err
+	}
+	log.Printf("✅ Рендеринг завершен")
+	return doc, nil
+}
@@ -0,0 +1,582 @@
+package exceltemplar
+
+import (
+	"fmt"
+	"io/fs"
+	"math"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	expro "github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/ast"
+	"github.com/expr-lang/expr/builtin"
+	"github.com/expr-lang/expr/vm"
+	"github.com/expr-lang/expr/vm/runtime"
+)
+
+// -----------------------------
+// Выражения: {{= expr}} и условия {{#if expr}} на expr-lang
+// -----------------------------
+
+// Выражения шаблона исполняет expr-lang: арифметика с приоритетами, сравнения,
+// and/or/not, тернарный оператор, конкатенация строк, вложенные вызовы функций и
+// встроенные функции expr-lang (split, replace, abs, ...), а также фильтры
+// `expr | name:arg` (см. filters.go). Пути данных ($.a.b,
+// $item.x[$i], .field, field) до компиляции заменяются вызовами path("...").
+
+// FuncMap — пользовательские функции выражений: имя → функция Go. Функция может
+// возвращать одно значение или пару (значение, error); типы аргументов и результата
+// проверяются при компиляции выражений (см. Template.Funcs).
+type FuncMap map[string]interface{}
+
+// exprSet — компилятор выражений шаблона: пользовательские функции и кэш
+// скомпилированных программ по исходному тексту. Программы неизменяемы и
+// исполняются с окружением конкретного рендера. У каждого шаблона свой exprSet,
+// поэтому кэш ограничен выражениями этого шаблона и освобождается вместе с ним.
+type exprSet struct {
+	funcs FuncMap
+	cache sync.Map // string → *vm.Program
+}
+
+// reservedFuncs — имена окружения выражений, которые нельзя переопределить
+var reservedFuncs = map[string]bool{
+	"path": true, "$": true, "named": true, "truthy": true, "arith": true,
+	"len": true, "exists": true, "join": true, "iif": true, "link": true, "image": true,
+}
+
+var rxFuncName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// withFuncs возвращает набор выражений, дополненный функциями funcs
+func (s *exprSet) withFuncs(funcs FuncMap) (*exprSet, error) {
+	merged := make(FuncMap, len(s.funcs)+len(funcs))
+	for name, fn := range s.funcs {
+		merged[name] = fn
+	}
+	for name, fn := range funcs {
+		if !rxFuncName.MatchString(name) {
+			return nil, fmt.Errorf("функция %q: недопустимое имя", name)
+		}
+		if reservedFuncs[name] || exprKeywords[name] {
+			return nil, fmt.Errorf("функция %q: имя зарезервировано шаблоном", name)
+		}
+		if fn == nil || reflect.TypeOf(fn).Kind() != reflect.Func {
+			return nil, fmt.Errorf("функция %q: ожидается функция Go, получено %T", name, fn)
+		}
+		merged[name] = fn
+	}
+	return &exprSet{funcs: merged}, nil
+}
+
+// exprKeywords — слова expr-lang, которые не являются путями данных
+var exprKeywords = map[string]bool{
+	"true": true, "false": true, "nil": true,
+	"and": true, "or": true, "not": true, "in": true,
+	"matches": true, "contains": true, "startsWith": true, "endsWith": true,
+	"let": true, "if": true, "else": true,
+}
+
+// evalExpr вычисляет выражение шаблона в контексте ctx
+func evalExpr(ctx *evalContext, src string) (interface{}, error) {
+	s := ctx.exprs
+	if s == nil {
+		s = &exprSet{}
+	}
+	program, err := s.compile(src)
+	if err != nil {
+		return nil, err
+	}
+	return expro.Run(program, s.env(ctx))
+}
+
+func (s *exprSet) compile(src string) (*vm.Program, error) {
+	if p, ok := s.cache.Load(src); ok {
+		return p.(*vm.Program), nil
+	}
+	opts := []expro.Option{
+		expro.Env(s.env(nil)),
+		// одноимённые встроенные функции expr-lang заменяются функциями шаблона;
+		// стандартные фильтры (date, trim, round, upper, lower) принимают и аргументы
+		// встроенных функций с прежним смыслом
+		expro.DisableBuiltin("len"),
+		expro.DisableBuiltin("join"),
+		expro.Patch(exprPatcher{}),
+	}
+	for _, names := range []map[string]interface{}{stdFilters, s.funcs} {
+		for name := range names {
+			if _, ok := builtin.Index[name]; ok {
+				opts = append(opts, expro.DisableBuiltin(name))
+			}
+		}
+	}
+	piped, err := expandPipes(src)
+	if err != nil {
+		return nil, &TemplateError{Code: CodeExpr, Err: err}
+	}
+	program, err := expro.Compile(transformExprPaths(piped), opts...)
+	if err != nil {
+		return nil, &TemplateError{Code: CodeExpr, Err: err}
+	}
+	s.cache.Store(src, program)
+	return program, nil
+}
+
+// env — окружение выражений со стандартными фильтрами и пользовательскими функциями;
+// пользовательская функция переопределяет одноимённый фильтр
+func (s *exprSet) env(ctx *evalContext) map[string]interface{} {
+	env := exprEnv(ctx)
+	for name, fn := range stdFilters {
+		env[name] = fn
+	}
+	for name, fn := range s.funcs {
+		env[name] = fn
+	}
+	return env
+}
+
+// evalScalar вычисляет выражение вставки {{= expr}}. Результат-коллекция — ошибка:
+// массивы выводятся через each/join.
+func evalScalar(ctx *evalContext, expr string) (interface{}, error) {
+	v, err := evalExpr(ctx, expr)
+	if err != nil {
+		return nil, err
+	}
+	switch v.(type) {
+	case []interface{}, map[string]interface{}:
+		return nil, codeError(CodeCollection, "скалярная вставка получила коллекцию; используйте each/join")
+	}
+	return v, nil
+}
+
+// evalBool вычисляет условие {{#if expr}}; небулев результат приводится по truthy
+func evalBool(ctx *evalContext, expr string) (bool, error) {
+	out, err := evalExpr(ctx, expr)
+	if err != nil {
+		return false, err
+	}
+	if b, ok := out.(bool); ok {
+		return b, nil
+	}
+	return truthy(out), nil
+}
+
+// exprEnv — окружение выражений. При компиляции (ctx == nil) используются только типы функций.
+func exprEnv(ctx *evalContext) map[string]interface{} {
+	lookup := func(p string) (interface{}, error) {
+		if v, ok := resolvePath(ctx, p); ok {
+			return v, nil
+		}
+		if ctx != nil && ctx.strict {
+			return nil, missingPathError(ctx, p)
+		}
+		return nil, nil
+	}
+	return map[string]interface{}{
+		// Доступ к значениям по пути
+		"path": lookup,
+		// Сокращение: $(".a.b") / $("$.x")
+		"$":      lookup,
+		"len":    fnLen,
+		"truthy": truthy,
+		// exists получает путь строкой (см. exprPatcher) либо уже вычисленное значение
+		"exists": func(x interface{}) bool {
+			if p, ok := x.(string); ok {
+				_, found := resolvePath(ctx, p)
+				return found
+			}
+			return truthy(x)
+		},
+		"join": fnJoin,
+		// iif с верным числом аргументов заменяется ленивым тернарным оператором (см. exprPatcher)
+		"iif": func(args ...interface{}) (interface{}, error) {
+			return nil, argError("iif: ожидается 2 или 3 аргумента (cond, then[, else])")
+		},
+		"link": fnLink,
+		"image": func(src interface{}, opts ...interface{}) (interface{}, error) {
+			var fsys fs.FS
+			if ctx != nil {
+				fsys = ctx.images
+			}
+			return fnImage(fsys, src, opts...)
+		},
+		"named": func(name string, value interface{}) namedArg { return namedArg{name: name, value: value} },
+		// арифметика над значениями неизвестного типа (см. exprPatcher)
+		"arith": func(op string, a, b interface{}) (interface{}, error) { return arith(ctx, op, a, b) },
+	}
+}
+
+// arithOps — операторы, которые exprPatcher переводит в arith
+var arithOps = map[string]bool{"+": true, "-": true, "*": true, "/": true, "%": true, "**": true, "^": true}
+
+// arith выполняет арифметику над путями данных и результатами функций, тип которых
+// известен только при рендере. Вне строгого режима отсутствующее значение (nil)
+// считается нулём или пустой строкой по типу другого операнда: {{= $.missing + 1}} → 1.
+// Для % целые float64 (числа из JSON) приводятся к int.
+func arith(ctx *evalContext, op string, a, b interface{}) (v interface{}, err error) {
+	if ctx == nil || !ctx.strict {
+		if a == nil && b == nil {
+			return nil, nil
+		}
+		if a == nil {
+			a = zeroLike(b)
+		} else if b == nil {
+			b = zeroLike(a)
+		}
+	}
+	// функции runtime expr-lang сообщают о несовместимых типах паникой
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	switch op {
+	case "+":
+		return runtime.Add(a, b), nil
+	case "-":
+		return runtime.Subtract(a, b), nil
+	case "*":
+		return runtime.Multiply(a, b), nil
+	case "/":
+		return runtime.Divide(a, b), nil
+	case "%":
+		return runtime.Modulo(wholeInt(a), wholeInt(b)), nil
+	default:
+		return runtime.Exponent(a, b), nil
+	}
+}
+
+// zeroLike — нулевое значение того же рода, что x: "" для строки, 0 для числа
+func zeroLike(x interface{}) interface{} {
+	switch x.(type) {
+	case string:
+		return ""
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		return 0
+	}
+	return nil
+}
+
+// wholeInt приводит целое float64 к int; остальные значения возвращает как есть
+func wholeInt(x interface{}) interface{} {
+	if f, ok := x.(float64); ok && f == math.Trunc(f) && math.Abs(f) < 1<<53 {
+		return int(f)
+	}
+	return x
+}
+
+// namedArg — именованный аргумент функции вида fit='cell'
+type namedArg struct {
+	name  string
+	value interface{}
+}
+
+// exprPatcher переписывает дерево выражения после разбора:
+//   - iif(cond, a[, b]) → truthy(cond) ? a : b — ветки вычисляются лениво;
+//   - exists(path("x")) → exists("x") — проверяется наличие пути, а не значение;
+//   - a + b, a % b, ... с операндом неизвестного типа → arith("+", a, b) (см. arith).
+type exprPatcher struct{}
+
+func (exprPatcher) Visit(node *ast.Node) {
+	if bin, ok := (*node).(*ast.BinaryNode); ok {
+		if arithOps[bin.Operator] && (untyped(bin.Left) || untyped(bin.Right)) {
+			ast.Patch(node, &ast.CallNode{
+				Callee:    &ast.IdentifierNode{Value: "arith"},
+				Arguments: []ast.Node{&ast.StringNode{Value: bin.Operator}, bin.Left, bin.Right},
+			})
+		}
+		return
+	}
+	call, ok := (*node).(*ast.CallNode)
+	if !ok {
+		return
+	}
+	callee, ok := call.Callee.(*ast.IdentifierNode)
+	if !ok {
+		return
+	}
+	switch callee.Value {
+	case "iif":
+		if len(call.Arguments) < 2 || len(call.Arguments) > 3 {
+			return
+		}
+		var otherwise ast.Node = &ast.StringNode{Value: ""}
+		if len(call.Arguments) == 3 {
+			otherwise = call.Arguments[2]
+		}
+		ast.Patch(node, &ast.ConditionalNode{
+			Cond: &ast.CallNode{Callee: &ast.IdentifierNode{Value: "truthy"}, Arguments: call.Arguments[:1]},
+			Exp1: call.Arguments[1],
+			Exp2: otherwise,
+		})
+	case "exists":
+		if len(call.Arguments) != 1 {
+			return
+		}
+		if inner, ok := call.Arguments[0].(*ast.CallNode); ok {
+			if id, ok := inner.Callee.(*ast.IdentifierNode); ok && id.Value == "path" && len(inner.Arguments) == 1 {
+				call.Arguments[0] = inner.Arguments[0]
+			}
+		}
+	}
+}
+
+// untyped сообщает, что тип узла выражения известен только при исполнении
+func untyped(n ast.Node) bool {
+	t := n.Type()
+	return t == nil || t.Kind() == reflect.Interface
+}
+
+// transformExprPaths заменяет пути данных вызовами path("..."):
+//   - $.a.b, $root.a, $var.c[$i] — абсолютные пути и переменные;
+//   - .a.b — путь от текущего элемента;
+//   - a.b — путь от корня (если это не функция и не ключевое слово).
+//
+// Именованные аргументы name=value превращаются в named("name", value).
+func transformExprPaths(src string) string {
+	var out strings.Builder
+	// prev — последний значащий символ результата: по нему отличаем начало операнда
+	// (.field) от обращения к полю (foo().bar) и части числа (1.5)
+	prev := byte(0)
+	prevKeyword := false
+	write := func(s string) {
+		out.WriteString(s)
+		if t := strings.TrimRightFunc(s, unicode.IsSpace); t != "" {
+			prev = t[len(t)-1]
+			prevKeyword = false
+		}
+	}
+	operandStart := func() bool {
+		return prev == 0 || prevKeyword || strings.IndexByte("([{,?:!=<>+-*/%&|^~", prev) >= 0
+	}
+	for i := 0; i < len(src); {
+		ch := src[i]
+		switch {
+		case ch == '\'' || ch == '"' || ch == '`':
+			j := scanQuoted(src, i)
+			lit := src[i:j]
+			if ch != '`' {
+				// Перевод строки, набранный в ячейке Excel прямо внутри кавычек (Alt+Enter)
+				lit = literalEscaper.Replace(lit)
+			}
+			write(lit)
+			i = j
+		case ch == '$' && i+1 < len(src) && (src[i+1] == '.' || isIdentStart(src[i+1:])):
+			j := scanPath(src, i+1)
+			write(pathCall(src[i:j]))
+			i = j
+		case ch == '.' && i+1 < len(src) && isIdentStart(src[i+1:]) && operandStart():
+			j := scanPath(src, i+1)
+			write(pathCall(src[i:j]))
+			i = j
+		case isIdentStart(src[i:]) && (i == 0 || !isPathRune(lastRune(src[:i]))):
+			j := scanIdent(src, i)
+			word := src[i:j]
+			next := skipSpaces(src, j)
+			switch {
+			case next < len(src) && src[next] == '(':
+				write(word)
+				i = j
+			case exprKeywords[word]:
+				write(word)
+				prevKeyword = true
+				i = j
+			case next < len(src) && src[next] == '=' && (next+1 >= len(src) || src[next+1] != '=') && (prev == '(' || prev == ','):
+				end := scanArg(src, next+1)
+				write(`named(` + strconv.Quote(word) + `, ` + transformExprPaths(src[next+1:end]) + `)`)
+				i = end
+			default:
+				j = scanPath(src, i)
+				write(pathCall(src[i:j]))
+				i = j
+			}
+		default:
+			_, size := utf8.DecodeRuneInString(src[i:])
+			write(src[i : i+size])
+			i += size
+		}
+	}
+	return out.String()
+}
+
+var literalEscaper = strings.NewReplacer("\n", `\n`, "\r", `\r`, "\t", `\t`)
+
+func pathCall(p string) string {
+	return "path(" + strconv.Quote(p) + ")"
+}
+
+func isIdentStart(s string) bool {
+	r, _ := utf8.DecodeRuneInString(s)
+	return r == '_' || unicode.IsLetter(r)
+}
+
+func isPathRune(r rune) bool {
+	return r == '_' || r == '.' || r == '#' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+func isWordRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+func lastRune(s string) rune {
+	r, _ := utf8.DecodeLastRuneInString(s)
+	return r
+}
+
+func skipSpaces(s string, i int) int {
+	for i < len(s) && (s[i] == ' ' || s[i] == '\t' || s[i] == '\n' || s[i] == '\r') {
+		i++
+	}
+	return i
+}
+
+// scanIdent возвращает конец идентификатора, начинающегося в i
+func scanIdent(s string, i int) int {
+	for i < len(s) {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r != '_' && !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			break
+		}
+		i += size
+	}
+	return i
+}
+
+// scanPath возвращает конец пути: имена, точки и индексы в квадратных скобках
+func scanPath(s string, i int) int {
+	for i < len(s) {
+		switch {
+		case s[i] == '[':
+			depth := 0
+			j := i
+			for ; j < len(s); j++ {
+				if s[j] == '[' {
+					depth++
+				} else if s[j] == ']' {
+					depth--
+					if depth == 0 {
+						break
+					}
+				}
+			}
+			if j >= len(s) {
+				return len(s)
+			}
+			i = j + 1
+		case s[i] == '.' && i+1 < len(s) && (s[i+1] == '[' || isIdentStart(s[i+1:])):
+			i++
+		// дефис между буквами — часть ключа ($.first-name); вычитание пишется с пробелами
+		case s[i] == '-' && i > 0 && isWordRune(lastRune(s[:i])) && isIdentStart(s[i+1:]):
+			i++
+		case s[i] == '$' || isIdentStart(s[i:]) || (s[i] >= '0' && s[i] <= '9'):
+			_, size := utf8.DecodeRuneInString(s[i:])
+			i += size
+		default:
+			return i
+		}
+	}
+	return i
+}
+
+// scanQuoted возвращает позицию за закрывающей кавычкой строкового литерала
+func scanQuoted(s string, i int) int {
+	q := s[i]
+	for j := i + 1; j < len(s); j++ {
+		if s[j] == '\\' && q != '`' {
+			j++
+			continue
+		}
+		if s[j] == q {
+			return j + 1
+		}
+	}
+	return len(s)
+}
+
+// scanArg возвращает конец аргумента вызова: запятую или закрывающую скобку верхнего уровня
+func scanArg(s string, i int) int {
+	depth := 0
+	for i < len(s) {
+		switch s[i] {
+		case '\'', '"', '`':
+			i = scanQuoted(s, i)
+			continue
+		case '(', '[', '{':
+			depth++
+		case ')', ']', '}':
+			if depth == 0 {
+				return i
+			}
+			depth--
+		case ',':
+			if depth == 0 {
+				return i
+			}
+		}
+		i++
+	}
+	return i
+}
+
+func truthy(v interface{}) bool {
+	switch vv := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return vv
+	case string:
+		return vv != ""
+	case []interface{}:
+		return len(vv) > 0
+	case map[string]interface{}:
+		return len(vv) > 0
+	case float64:
+		return vv != 0
+	case int:
+		return vv != 0
+	default:
+		return true
+	}
+}
+
+// fnLen — длина массива, строки (в символах) или объекта; для остальных значений 0
+func fnLen(x interface{}) float64 {
+	switch v := x.(type) {
+	case []interface{}:
+		return float64(len(v))
+	case string:
+		return float64(utf8.RuneCountInString(v))
+	case map[string]interface{}:
+		return float64(len(v))
+	default:
+		return 0
+	}
+}
+
+// fnJoin склеивает элементы массива через sep, опционально беря поле field каждого элемента
+func fnJoin(arr interface{}, sep string, field ...string) (string, error) {
+	if arr == nil {
+		return "", nil
+	}
+	items, ok := arr.([]interface{})
+	if !ok {
+		return "", argError("join: не массив")
+	}
+	vals := make([]string, 0, len(items))
+	for _, it := range items {
+		val := it
+		if len(field) > 0 && field[0] != "" {
+			val = nil
+			if m, ok := it.(map[string]interface{}); ok {
+				if f, ok := drill(m, field[0]); ok {
+					val = f
+				}
+			}
+		}
+		vals = append(vals, toString(val))
+	}
+	return strings.Join(vals, sep), nil
+}
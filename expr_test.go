@@ -0,0 +1,104 @@
+package exceltemplar
+
+import "testing"
+
+func TestTransformExprPaths(t *testing.T) {
+	cases := []struct {
+		in   string
+		want string
+	}{
+		{"$.qty * $.price", `path("$.qty") * path("$.price")`},
+		{"$i+1", `path("$i")+1`},
+		{"$.list[$i].name", `path("$.list[$i].name")`},
+		{".status == 'ok'", `path(".status") == 'ok'`},
+		{"not .done and total > 1.5", `not path(".done") and path("total") > 1.5`},
+		{"upper($.name).x", `upper(path("$.name")).x`},
+		{"image($c.photo, fit='cell')", `image(path("$c.photo"), named("fit", 'cell'))`},
+		{"$.отдел.название + '$.x'", `path("$.отдел.название") + '$.x'`},
+		{"join($.a, '\n')", `join(path("$.a"), '\n')`},
+		{"$.first-name + $.a - 1", `path("$.first-name") + path("$.a") - 1`},
+		{"$.a-1 - $x-y", `path("$.a")-1 - path("$x-y")`},
+	}
+	for _, tc := range cases {
+		if got := transformExprPaths(tc.in); got != tc.want {
+			t.Fatalf("transformExprPaths(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestEvalScalarExpressions(t *testing.T) {
+	root := map[string]interface{}{
+		"qty":        3.0,
+		"price":      2.5,
+		"a":          10.0,
+		"first":      "Иван",
+		"first-name": "Анна",
+		"n":          7.0,
+		"last":       "Петров",
+		"tags":       []interface{}{"x", "y"},
+		"title":      "Отчёт",
+		"отдел":      map[string]interface{}{"название": "Продажи"},
+	}
+	item := map[string]interface{}{"name": "строка", "status": "ok"}
+	ctx := &evalContext{current: item, root: []interface{}{root}, vars: map[string]interface{}{"$i": 1.0, "$j": 2.0}}
+
+	cases := []struct {
+		expr string
+		want interface{}
+	}{
+		{"$.qty * $.price", 7.5},
+		{"$i + $j", 3.0},
+		{"$.a - 1", 9.0},
+		{"1 + 2 * 3", 7},
+		{"($.a + 2) * 3", 36.0},
+		{`$.first + " " + $.last`, "Иван Петров"},
+		{"$.qty > 2", true},
+		{`upper(iif(len($.tags) > 1, join($.tags, "/"), "none"))`, "X/Y"},
+		{"iif(exists($.missing), join($.missing, ','), 'нет')", "нет"},
+		{"iif($.missing, 'да')", ""},
+		{".name", "строка"},
+		{"title", "Отчёт"},
+		{"$.отдел.название", "Продажи"},
+		{`.status == "ok" ? "готово" : "в работе"`, "готово"},
+		{"len($.first)", 4.0},
+		{"$.missing", nil},
+		// ключ с дефисом — часть пути, а не вычитание
+		{"$.first-name", "Анна"},
+		{"$.a-1", 9.0},
+		// вне строгого режима отсутствующее значение в арифметике — ноль или пустая строка
+		{"$.missing + 1", 1},
+		{"2 * $.missing", 0},
+		{`"№" + $.missing`, "№"},
+		{"$.missing + $.nothing", nil},
+		// числа из JSON — float64; для % целые приводятся к int
+		{"$.n % 2", 1},
+		{"$.n % $.qty", 1},
+	}
+	for _, tc := range cases {
+		got, err := evalScalar(ctx, tc.expr)
+		if err != nil {
+			t.Fatalf("evalScalar(%q): %v", tc.expr, err)
+		}
+		if got != tc.want {
+			t.Fatalf("evalScalar(%q) = %#v, want %#v", tc.expr, got, tc.want)
+		}
+	}
+
+	if _, err := evalScalar(ctx, "$.tags"); err == nil {
+		t.Fatalf("collection in scalar insert must fail")
+	}
+	if _, err := evalScalar(ctx, "iif($.qty)"); err == nil {
+		t.Fatalf("iif with one argument must fail")
+	}
+	if _, err := evalScalar(ctx, "$.price % 2"); err == nil {
+		t.Fatalf("%% with a fractional operand must fail")
+	}
+	if _, err := evalScalar(ctx, "$.n % 0"); err == nil {
+		t.Fatalf("%% by zero must fail")
+	}
+	strict := *ctx
+	strict.strict = true
+	if _, err := evalScalar(&strict, "$.missing + 1"); err == nil {
+		t.Fatalf("missing path in strict mode must fail")
+	}
+}
@@ -0,0 +1,509 @@
+package exceltemplar
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/expr-lang/expr/builtin"
+)
+
+// -----------------------------
+// Фильтры: {{= expr | name:arg1:arg2 | ...}}
+// -----------------------------
+
+// Фильтр — обычная функция выражений: `x | f:a:b` вычисляется как f(x, a, b).
+// Стандартные фильтры собраны в stdFilters; пользовательские регистрируются
+// через Template.Funcs и могут переопределять стандартные.
+
+// stdFilters — стандартная библиотека фильтров
+var stdFilters = map[string]interface{}{
+	"upper":     filterUpper,
+	"lower":     filterLower,
+	"title":     filterTitle,
+	"trim":      filterTrim,
+	"truncate":  filterTruncate,
+	"padLeft":   filterPadLeft,
+	"padRight":  filterPadRight,
+	"default":   filterDefault,
+	"round":     filterRound,
+	"number":    filterNumber,
+	"percent":   filterPercent,
+	"date":      filterDate,
+	"parseDate": filterParseDate,
+}
+
+// expandPipes переписывает конвейер `expr | f:a:b | g` в вызовы g(f(expr, a, b)).
+// Разделителем служит одиночный | вне строк и скобок (|| остаётся логическим «или»).
+// Фильтр можно записать и вызовом: `expr | f(a, b)`.
+func expandPipes(src string) (string, error) {
+	src, err := expandNestedPipes(src)
+	if err != nil {
+		return "", err
+	}
+	parts := splitTopLevel(src, '|')
+	if len(parts) == 1 {
+		return src, nil
+	}
+	out := strings.TrimSpace(parts[0])
+	if out == "" {
+		return "", fmt.Errorf("фильтр без значения: %q", src)
+	}
+	for _, p := range parts[1:] {
+		p = strings.TrimSpace(p)
+		if open := strings.IndexByte(p, '('); open > 0 && strings.HasSuffix(p, ")") && rxFuncName.MatchString(p[:open]) {
+			args := strings.TrimSpace(p[open+1 : len(p)-1])
+			if args == "" {
+				out = p[:open] + "(" + out + ")"
+			} else {
+				out = p[:open] + "(" + out + ", " + args + ")"
+			}
+			continue
+		}
+		spec := splitTopLevel(p, ':')
+		name := strings.TrimSpace(spec[0])
+		if !rxFuncName.MatchString(name) {
+			return "", fmt.Errorf("недопустимый фильтр %q", p)
+		}
+		args := []string{out}
+		for _, a := range spec[1:] {
+			if a = strings.TrimSpace(a); a == "" {
+				return "", fmt.Errorf("фильтр %s: пустой аргумент", name)
+			}
+			args = append(args, a)
+		}
+		out = name + "(" + strings.Join(args, ", ") + ")"
+	}
+	return out, nil
+}
+
+// expandNestedPipes раскрывает конвейеры внутри скобок и аргументов вызовов:
+// upper($.a) + ($.b | number:"0.00")
+func expandNestedPipes(src string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(src); i++ {
+		c := src[i]
+		switch c {
+		case '\'', '"', '`':
+			end := scanQuoted(src, i)
+			b.WriteString(src[i:end])
+			i = end - 1
+			continue
+		case '(', '[':
+			end := matchingBracket(src, i)
+			if end < 0 {
+				b.WriteString(src[i:])
+				return b.String(), nil
+			}
+			args := splitTopLevel(src[i+1:end], ',')
+			for k, a := range args {
+				out, err := expandPipes(a)
+				if err != nil {
+					return "", err
+				}
+				args[k] = out
+			}
+			b.WriteByte(c)
+			b.WriteString(strings.Join(args, ","))
+			b.WriteByte(src[end])
+			i = end
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String(), nil
+}
+
+// matchingBracket возвращает позицию скобки, закрывающей s[open], или -1
+func matchingBracket(s string, open int) int {
+	depth := 0
+	for i := open; i < len(s); i++ {
+		switch s[i] {
+		case '\'', '"', '`':
+			i = scanQuoted(s, i) - 1
+		case '(', '[', '{':
+			depth++
+		case ')', ']', '}':
+			if depth--; depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// splitTopLevel делит s по символу sep вне строковых литералов и скобок.
+// Для sep == '|' пара || разделителем не считается.
+func splitTopLevel(s string, sep byte) []string {
+	var parts []string
+	depth, start := 0, 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '\'', '"', '`':
+			i = scanQuoted(s, i) - 1
+		case '(', '[', '{':
+			depth++
+		case ')', ']', '}':
+			depth--
+		case sep:
+			if depth != 0 {
+				continue
+			}
+			if sep == '|' && ((i+1 < len(s) && s[i+1] == '|') || (i > 0 && s[i-1] == '|')) {
+				continue
+			}
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// filterArgs проверяет число дополнительных аргументов фильтра
+func filterArgs(name string, args []interface{}, max int) error {
+	if len(args) > max {
+		return argError("%s: слишком много аргументов (%d, максимум %d)", name, len(args), max)
+	}
+	return nil
+}
+
+func filterUpper(v interface{}) string { return strings.ToUpper(toString(v)) }
+
+func filterLower(v interface{}) string { return strings.ToLower(toString(v)) }
+
+// filterTitle делает заглавной первую букву каждого слова
+func filterTitle(v interface{}) string {
+	prev := ' '
+	return strings.Map(func(r rune) rune {
+		defer func() { prev = r }()
+		if unicode.IsSpace(prev) || prev == '-' {
+			return unicode.ToUpper(r)
+		}
+		return r
+	}, toString(v))
+}
+
+func filterTrim(v interface{}, chars ...interface{}) (string, error) {
+	if err := filterArgs("trim", chars, 1); err != nil {
+		return "", err
+	}
+	// trim(s, "символы") — как встроенная функция expr-lang, которую заменяет фильтр
+	if len(chars) == 1 {
+		return strings.Trim(toString(v), toString(chars[0])), nil
+	}
+	return strings.TrimSpace(toString(v)), nil
+}
+
+// filterTruncate обрезает строку до n символов и добавляет суффикс (по умолчанию «…»)
+func filterTruncate(v, n interface{}, suffix ...interface{}) (string, error) {
+	if err := filterArgs("truncate", suffix, 1); err != nil {
+		return "", err
+	}
+	limit, err := filterNumberArg("truncate", n)
+	if err != nil {
+		return "", err
+	}
+	s := toString(v)
+	if limit < 0 || utf8.RuneCountInString(s) <= int(limit) {
+		return s, nil
+	}
+	tail := "…"
+	if len(suffix) == 1 {
+		tail = toString(suffix[0])
+	}
+	return string([]rune(s)[:int(limit)]) + tail, nil
+}
+
+// filterPadLeft дополняет строку слева символом pad (по умолчанию пробел) до ширины n
+func filterPadLeft(v, n interface{}, pad ...interface{}) (string, error) {
+	width, fill, err := padArgs("padLeft", n, pad)
+	if err != nil {
+		return "", err
+	}
+	s := toString(v)
+	if k := width - utf8.RuneCountInString(s); k > 0 {
+		return strings.Repeat(fill, k) + s, nil
+	}
+	return s, nil
+}
+
+// filterPadRight дополняет строку справа символом pad (по умолчанию пробел) до ширины n
+func filterPadRight(v, n interface{}, pad ...interface{}) (string, error) {
+	width, fill, err := padArgs("padRight", n, pad)
+	if err != nil {
+		return "", err
+	}
+	s := toString(v)
+	if k := width - utf8.RuneCountInString(s); k > 0 {
+		return s + strings.Repeat(fill, k), nil
+	}
+	return s, nil
+}
+
+// padArgs разбирает аргументы padLeft/padRight: ширину и символ заполнения
+func padArgs(name string, n interface{}, pad []interface{}) (int, string, error) {
+	width, err := filterNumberArg(name, n)
+	if err != nil {
+		return 0, "", err
+	}
+	fill := " "
+	if len(pad) == 1 {
+		fill = toString(pad[0])
+	}
+	if len(pad) > 1 || utf8.RuneCountInString(fill) != 1 {
+		return 0, "", argError("%s: ожидается %s:n[:символ]", name, name)
+	}
+	return int(width), fill, nil
+}
+
+// filterDefault подставляет def вместо отсутствующего значения или пустой строки
+func filterDefault(v, def interface{}) interface{} {
+	if v == nil {
+		return def
+	}
+	if s, ok := v.(string); ok && s == "" {
+		return def
+	}
+	return v
+}
+
+// filterRound округляет число до digits знаков после запятой (по умолчанию до целого).
+// Результат остаётся числом.
+func filterRound(v interface{}, digits ...interface{}) (interface{}, error) {
+	if err := filterArgs("round", digits, 1); err != nil {
+		return nil, err
+	}
+	if isBlank(v) {
+		return v, nil
+	}
+	x, err := filterNumberArg("round", v)
+	if err != nil {
+		return nil, err
+	}
+	d := 0.0
+	if len(digits) == 1 {
+		if d, err = filterNumberArg("round", digits[0]); err != nil {
+			return nil, err
+		}
+	}
+	p := math.Pow(10, d)
+	return math.Round(x*p) / p, nil
+}
+
+// filterNumber форматирует число по образцу: "0.00", "#,##0.00", "# ##0,00", "0.## ₽".
+// Символы перед первым и после последнего разряда выводятся как есть.
+func filterNumber(v, pattern interface{}) (string, error) {
+	if isBlank(v) {
+		return "", nil
+	}
+	x, err := filterNumberArg("number", v)
+	if err != nil {
+		return "", err
+	}
+	return formatNumber(x, toString(pattern)), nil
+}
+
+// filterPercent выводит долю как проценты: 0.256 | percent:1 → 25.6%
+func filterPercent(v interface{}, digits ...interface{}) (string, error) {
+	if err := filterArgs("percent", digits, 1); err != nil {
+		return "", err
+	}
+	if isBlank(v) {
+		return "", nil
+	}
+	x, err := filterNumberArg("percent", v)
+	if err != nil {
+		return "", err
+	}
+	pattern := "0"
+	if len(digits) == 1 {
+		d, err := filterNumberArg("percent", digits[0])
+		if err != nil {
+			return "", err
+		}
+		if d > 0 {
+			pattern += "." + strings.Repeat("0", int(d))
+		}
+	}
+	return formatNumber(x*100, pattern) + "%", nil
+}
+
+// filterDate форматирует дату по раскладке Go ("02.01.2006"). Строки разбираются
+// как даты ISO 8601 либо по раскладке inLayout. Без раскладки date(s) — встроенная
+// функция expr-lang: строка разбирается в дату (`{{#if date($.due) < now()}}`).
+func filterDate(v interface{}, args ...interface{}) (interface{}, error) {
+	if len(args) == 0 {
+		s, ok := v.(string)
+		if !ok {
+			return nil, argError("date: ожидается строка, получено %T", v)
+		}
+		return builtin.Builtins[builtin.Index["date"]].Func(s)
+	}
+	layout, inLayout := args[0], args[1:]
+	if err := filterArgs("date", inLayout, 1); err != nil {
+		return nil, err
+	}
+	if isBlank(v) {
+		return "", nil
+	}
+	t, err := toTime(v, inLayout...)
+	if err != nil {
+		return nil, argError("date: %w", err)
+	}
+	return t.Format(toString(layout)), nil
+}
+
+// filterParseDate превращает строку в дату, чтобы ячейка получила тип «дата» Excel
+func filterParseDate(v interface{}, inLayout ...interface{}) (interface{}, error) {
+	if err := filterArgs("parseDate", inLayout, 1); err != nil {
+		return nil, err
+	}
+	if isBlank(v) {
+		return v, nil
+	}
+	t, err := toTime(v, inLayout...)
+	if err != nil {
+		return nil, argError("parseDate: %w", err)
+	}
+	return t, nil
+}
+
+// isoLayouts — форматы дат, которые распознаются без явной раскладки
+var isoLayouts = []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02"}
+
+func toTime(v interface{}, inLayout ...interface{}) (time.Time, error) {
+	switch vv := v.(type) {
+	case time.Time:
+		return vv, nil
+	case string:
+		s := strings.TrimSpace(vv)
+		layouts := isoLayouts
+		if len(inLayout) == 1 {
+			layouts = []string{toString(inLayout[0])}
+		}
+		for _, l := range layouts {
+			if t, err := time.Parse(l, s); err == nil {
+				return t, nil
+			}
+		}
+		return time.Time{}, fmt.Errorf("не удалось разобрать дату %q", s)
+	}
+	return time.Time{}, fmt.Errorf("ожидается дата, получено %T", v)
+}
+
+func isBlank(v interface{}) bool {
+	if v == nil {
+		return true
+	}
+	s, ok := v.(string)
+	return ok && strings.TrimSpace(s) == ""
+}
+
+// filterNumberArg приводит значение к числу; строки допускают десятичную запятую
+func filterNumberArg(name string, v interface{}) (float64, error) {
+	switch vv := v.(type) {
+	case float64:
+		return vv, nil
+	case float32:
+		return float64(vv), nil
+	case int:
+		return float64(vv), nil
+	case int64:
+		return float64(vv), nil
+	case string:
+		s := strings.ReplaceAll(strings.TrimSpace(vv), ",", ".")
+		if x, err := strconv.ParseFloat(s, 64); err == nil {
+			return x, nil
+		}
+	}
+	return 0, argError("%s: %v не число", name, v)
+}
+
+// formatNumber форматирует x по образцу из 0 и # с необязательными разделителями
+// групп и дробной части. Число знаков после запятой — от числа 0 до числа 0 и #.
+func formatNumber(x float64, pattern string) string {
+	first := strings.IndexAny(pattern, "0#")
+	if first < 0 {
+		return pattern
+	}
+	last := strings.LastIndexAny(pattern, "0#")
+	prefix, core, suffix := pattern[:first], pattern[first:last+1], pattern[last+1:]
+
+	decSep, groupSep := numberSeparators(core)
+	intPart, fracPart := core, ""
+	if decSep != "" {
+		i := strings.LastIndex(core, decSep)
+		intPart, fracPart = core[:i], core[i+len(decSep):]
+	}
+	minDec := strings.Count(fracPart, "0")
+	maxDec := minDec + strings.Count(fracPart, "#")
+
+	neg := x < 0
+	digits := strconv.FormatFloat(math.Abs(x), 'f', maxDec, 64)
+	whole, frac := digits, ""
+	if i := strings.IndexByte(digits, '.'); i >= 0 {
+		whole, frac = digits[:i], digits[i+1:]
+	}
+	for len(frac) > minDec && strings.HasSuffix(frac, "0") {
+		frac = frac[:len(frac)-1]
+	}
+	if whole == "0" && !strings.Contains(intPart, "0") {
+		whole = ""
+	}
+	if groupSep != "" {
+		var b strings.Builder
+		for i, c := range whole {
+			if i > 0 && (len(whole)-i)%3 == 0 {
+				b.WriteString(groupSep)
+			}
+			b.WriteRune(c)
+		}
+		whole = b.String()
+	}
+	out := whole
+	if frac != "" {
+		out += decSep + frac
+	}
+	if neg && strings.Trim(out, "0"+decSep+groupSep) != "" {
+		out = "-" + out
+	}
+	return prefix + out + suffix
+}
+
+// numberSeparators определяет десятичный разделитель и разделитель групп образца:
+// при двух разных знаках десятичный — последний; одиночная запятая или точка
+// перед ровно тремя разрядами в конце считается разделителем групп.
+func numberSeparators(core string) (decSep, groupSep string) {
+	var seps []string
+	for _, r := range core {
+		if r != '0' && r != '#' {
+			seps = append(seps, string(r))
+		}
+	}
+	if len(seps) == 0 {
+		return "", ""
+	}
+	lastSep := seps[len(seps)-1]
+	tail := core[strings.LastIndex(core, lastSep)+len(lastSep):]
+	isDecimal := lastSep == "." || lastSep == ","
+	if isDecimal && len(tail) == 3 && strings.Count(core, lastSep) == 1 && len(seps) == 1 && strings.HasPrefix(core, "#") {
+		// "#,##0" — разделитель групп без дробной части
+		isDecimal = false
+	}
+	if len(seps) > 1 && seps[0] == lastSep {
+		// "#,###,##0" — все разделители одинаковые
+		isDecimal = false
+	}
+	if isDecimal {
+		decSep = lastSep
+		if len(seps) > 1 {
+			groupSep = seps[0]
+		}
+		return decSep, groupSep
+	}
+	return "", lastSep
+}
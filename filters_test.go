@@ -0,0 +1,113 @@
+package exceltemplar
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExpandPipes(t *testing.T) {
+	cases := []struct {
+		in   string
+		want string
+	}{
+		{"$.name | upper", "upper($.name)"},
+		{`$.amount | number:"0.00"`, `number($.amount, "0.00")`},
+		{`$.note | trim | truncate:50:"..."`, `truncate(trim($.note), 50, "...")`},
+		{`$.date | date:"15:04 02.01.2006"`, `date($.date, "15:04 02.01.2006")`},
+		{`$.a || $.b`, `$.a || $.b`},
+		{`$.name | default:($.a ? "x" : "y")`, `default($.name, ($.a ? "x" : "y"))`},
+		{`$.name | replace("a", "b")`, `replace($.name, "a", "b")`},
+		{`'a|b' | upper`, `upper('a|b')`},
+	}
+	for _, tc := range cases {
+		got, err := expandPipes(tc.in)
+		if err != nil {
+			t.Fatalf("expandPipes(%q): %v", tc.in, err)
+		}
+		if got != tc.want {
+			t.Fatalf("expandPipes(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+	for _, bad := range []string{"| upper", "$.a | 1x", "$.a | truncate:"} {
+		if _, err := expandPipes(bad); err == nil {
+			t.Fatalf("expandPipes(%q) must fail", bad)
+		}
+	}
+}
+
+func TestFilters(t *testing.T) {
+	root := map[string]interface{}{
+		"amount": 1234567.891,
+		"neg":    -0.004,
+		"share":  0.2567,
+		"name":   "  иван петров ",
+		"note":   "Очень длинное примечание",
+		"code":   "42",
+		"iso":    "2025-03-07",
+		"ru":     "07.03.2025",
+		"when":   time.Date(2025, 3, 7, 14, 30, 0, 0, time.UTC),
+		"empty":  "",
+	}
+	ctx := &evalContext{root: []interface{}{root}}
+
+	cases := []struct {
+		expr string
+		want interface{}
+	}{
+		{`$.name | trim | upper`, "ИВАН ПЕТРОВ"},
+		{`$.name | trim | title`, "Иван Петров"},
+		{`$.name | lower | trim`, "иван петров"},
+		{`$.note | truncate:5`, "Очень…"},
+		{`$.note | truncate:5:"..."`, "Очень..."},
+		{`$.code | padLeft:5:"0"`, "00042"},
+		{`$.code | padRight:4 | len`, 4.0},
+		{`$.missing | default:"—"`, "—"},
+		{`$.empty | default:0`, 0},
+		{`$.amount | round:2`, 1234567.89},
+		{`$.amount | round`, 1234568.0},
+		{`$.amount | number:"0.00"`, "1234567.89"},
+		{`$.amount | number:"#,##0.00"`, "1,234,567.89"},
+		{`$.amount | number:"# ##0,00 ₽"`, "1 234 567,89 ₽"},
+		{`$.amount | number:"#,##0"`, "1,234,568"},
+		{`$.amount | number:"0.##"`, "1234567.89"},
+		{`3 | number:"0.##"`, "3"},
+		{`$.neg | number:"0.00"`, "0.00"},
+		{`$.code | number:"0.0"`, "42.0"},
+		{`$.share | percent`, "26%"},
+		{`$.share | percent:1`, "25.7%"},
+		{`$.when | date:"02.01.2006 15:04"`, "07.03.2025 14:30"},
+		{`$.iso | date:"02.01.2006"`, "07.03.2025"},
+		{`$.ru | date:"2006-01-02":"02.01.2006"`, "2025-03-07"},
+		{`$.iso | parseDate`, time.Date(2025, 3, 7, 0, 0, 0, 0, time.UTC)},
+		{`$.missing | date:"02.01.2006"`, ""},
+		{`upper("x") + ($.code | padLeft:3:"0")`, "X042"},
+		// вызовы в форме встроенных функций expr-lang сохраняют их смысл
+		{`date("2024-01-02")`, time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)},
+		{`date($.iso) > date("2024-01-02")`, true},
+		{`date("2024-01-02") < now()`, true},
+		{`trim("..a.", ".")`, "a"},
+		{`$.code | trim:"4"`, "2"},
+		{`round(2.5)`, 3.0},
+		{`lower(upper("Ab"))`, "ab"},
+	}
+	for _, tc := range cases {
+		got, err := evalScalar(ctx, tc.expr)
+		if err != nil {
+			t.Fatalf("evalScalar(%q): %v", tc.expr, err)
+		}
+		if got != tc.want {
+			t.Fatalf("evalScalar(%q) = %#v, want %#v", tc.expr, got, tc.want)
+		}
+	}
+
+	for _, bad := range []string{`$.name | number:"0.00"`, `$.name | date:"02.01.2006"`, `$.code | padLeft:3:"ab"`, `date("07.03.2025")`, `date($.when)`} {
+		if _, err := evalScalar(ctx, bad); err == nil {
+			t.Fatalf("evalScalar(%q) must fail", bad)
+		}
+	}
+
+	ok, err := evalBool(ctx, `date("2024-01-02") < date($.iso)`)
+	if err != nil || !ok {
+		t.Fatalf(`evalBool(date("2024-01-02") < date($.iso)) = %v, %v`, ok, err)
+	}
+}
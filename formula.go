@@ -0,0 +1,360 @@
+package exceltemplar
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// -----------------------------
+// Формулы: разбор и перенос ссылок
+// -----------------------------
+
+// refPart — одна сторона ссылки (A1, $A$1, столбец A или строка 5)
+type refPart struct {
+	col, row       int
+	absCol, absRow bool
+}
+
+// formulaRef — ссылка на ячейку или диапазон внутри формулы
+type formulaRef struct {
+	sheet    string // имя листа без кавычек (пусто, если не указан)
+	from, to refPart
+	isRange  bool
+	// arg — функция (в верхнем регистре, без _xlfn.), прямым аргументом которой является
+	// ссылка; пусто, если ссылка входит в выражение или стоит вне функций
+	arg string
+}
+
+// unionFuncs — функции, принимающие объединение диапазонов (A1:A3,A7) как аргумент
+var unionFuncs = map[string]bool{
+	"SUM": true, "SUMSQ": true, "PRODUCT": true, "COUNT": true, "COUNTA": true,
+	"AVERAGE": true, "AVERAGEA": true, "MIN": true, "MINA": true, "MAX": true, "MAXA": true,
+	"MEDIAN": true, "STDEV": true, "STDEV.S": true, "STDEV.P": true, "VAR": true, "VAR.S": true, "VAR.P": true,
+	"LARGE": true, "SMALL": true, "RANK": true, "RANK.EQ": true, "RANK.AVG": true,
+	"SUBTOTAL": true, "AGGREGATE": true, "AREAS": true, "INDEX": true,
+}
+
+// unionRefs записывает ссылку, развернувшуюся в несколько диапазонов parts. Excel
+// принимает объединение только прямым аргументом функций из unionFuncs; в остальных
+// местах (SUMIF, VLOOKUP, арифметика) оно даёт #VALUE!, поэтому возвращается ошибка.
+func unionRefs(ref formulaRef, parts []string) (string, error) {
+	union := "(" + strings.Join(parts, ",") + ")"
+	if unionFuncs[ref.arg] {
+		return union, nil
+	}
+	where := "вне аргумента функции"
+	if ref.arg != "" {
+		where = "в аргументе " + ref.arg
+	}
+	return "", codeError(CodeFormula, "ссылка %s разворачивается в несмежные диапазоны %s, а их объединение %s Excel не принимает; используйте SUM, COUNT, AVERAGE, MIN, MAX или сделайте строки блока смежными",
+		ref.String(), union, where)
+}
+
+var rxRefPart = regexp.MustCompile(`^(\$?)([A-Za-z]{1,3})?(\$?)([0-9]+)?$`)
+
+func parseRefPart(s string) (refPart, bool) {
+	m := rxRefPart.FindStringSubmatch(s)
+	if m == nil || (m[2] == "" && m[4] == "") {
+		return refPart{}, false
+	}
+	var p refPart
+	if m[2] != "" {
+		col, err := excelize.ColumnNameToNumber(m[2])
+		if err != nil {
+			return refPart{}, false
+		}
+		p.col = col
+		p.absCol = m[1] == "$"
+		p.absRow = m[3] == "$"
+	} else {
+		// ссылка на целую строку ($5 или 5)
+		p.absRow = m[1] == "$" || m[3] == "$"
+	}
+	if m[4] != "" {
+		row, err := strconv.Atoi(m[4])
+		if err != nil || row <= 0 {
+			return refPart{}, false
+		}
+		p.row = row
+	}
+	return p, true
+}
+
+func (p refPart) String() string {
+	var b strings.Builder
+	if p.col > 0 {
+		if p.absCol {
+			b.WriteByte('$')
+		}
+		name, _ := excelize.ColumnNumberToName(p.col)
+		b.WriteString(name)
+	}
+	if p.row > 0 {
+		if p.absRow {
+			b.WriteByte('$')
+		}
+		b.WriteString(strconv.Itoa(p.row))
+	}
+	return b.String()
+}
+
+// parseFormulaRef разбирает операнд формулы. Именованные диапазоны и структурные
+// ссылки на таблицы не считаются ссылками и возвращают false.
+func parseFormulaRef(operand string) (formulaRef, bool) {
+	var ref formulaRef
+	body := operand
+	if i := strings.LastIndex(operand, "!"); i >= 0 {
+		ref.sheet = strings.Trim(operand[:i], "'")
+		body = operand[i+1:]
+	}
+	if strings.ContainsAny(body, "[]") {
+		return ref, false
+	}
+	parts := strings.Split(body, ":")
+	if len(parts) > 2 {
+		return ref, false
+	}
+	from, ok := parseRefPart(parts[0])
+	if !ok {
+		return ref, false
+	}
+	ref.from, ref.to = from, from
+	if len(parts) == 2 {
+		to, ok := parseRefPart(parts[1])
+		if !ok {
+			return ref, false
+		}
+		ref.to = to
+		ref.isRange = true
+	}
+	// Одиночная часть без строки (например, "A") — скорее имя, а не ссылка
+	if !ref.isRange && (from.row == 0 || from.col == 0) {
+		return ref, false
+	}
+	return ref, true
+}
+
+func (r formulaRef) String() string {
+	var prefix string
+	if r.sheet != "" {
+		prefix = quoteSheetName(r.sheet) + "!"
+	}
+	if r.isRange {
+		return prefix + r.from.String() + ":" + r.to.String()
+	}
+	return prefix + r.from.String()
+}
+
+// emptyRows переносит ссылку на последнюю строку листа — диапазон без данных для
+// пустого блока. В отличие от замены числом, COUNT по нему даёт 0, AVERAGE — #DIV/0!,
+// а ROWS и INDEX остаются корректными формулами. Строка 1048576 при этом должна
+// оставаться в шаблоне пустой — это оговорено в руководстве.
+func (r formulaRef) emptyRows() string {
+	r.from.row, r.to.row = excelize.TotalRows, excelize.TotalRows
+	return r.String()
+}
+
+// emptyCols — emptyRows для столбцов: ссылка переносится на последний столбец листа
+// (XFD), который тоже должен оставаться пустым.
+func (r formulaRef) emptyCols() string {
+	r.from.col, r.to.col = excelize.MaxColumns, excelize.MaxColumns
+	return r.String()
+}
+
+// sameSheet сообщает, указывает ли ссылка на лист sheet (или на текущий лист)
+func (r formulaRef) sameSheet(sheet string) bool {
+	return r.sheet == "" || strings.ReplaceAll(r.sheet, "''", "'") == sheet
+}
+
+var rxPlainSheetName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.]*$`)
+
+// quoteSheetName заключает имя листа в одинарные кавычки, если оно содержит
+// пробелы или другие символы, недопустимые в ссылке без кавычек.
+func quoteSheetName(name string) string {
+	if rxPlainSheetName.MatchString(name) {
+		return name
+	}
+	return "'" + strings.ReplaceAll(strings.ReplaceAll(name, "''", "'"), "'", "''") + "'"
+}
+
+// rewriteFormulaRefs заменяет каждую ссылку формулы результатом fn. Остальной текст
+// (функции, строки, константы массивов {1,2}, пробелы, в том числе оператор
+// пересечения A1:B5 B2:C3, разделители) переносится без изменений. Ссылка, которую
+// fn вернула в исходном виде, сохраняет исходное написание.
+func rewriteFormulaRefs(formula string, fn func(ref formulaRef) string) string {
+	var out strings.Builder
+	// funcs — открытые скобки: имя функции или пусто для группировки
+	var funcs []string
+	pending := ""
+	// ref применяет fn к операнду и отмечает, аргументом какой функции он является
+	ref := func(operand, rest string) string {
+		r, ok := parseFormulaRef(operand)
+		if !ok {
+			return operand
+		}
+		prev := strings.TrimRight(out.String(), " ")
+		next := strings.TrimLeft(rest, " ")
+		if len(funcs) > 0 && prev != "" && strings.ContainsRune("(,;", rune(prev[len(prev)-1])) &&
+			next != "" && strings.ContainsRune("),;", rune(next[0])) {
+			r.arg = funcs[len(funcs)-1]
+		}
+		if repl := fn(r); repl != r.String() {
+			return repl
+		}
+		return operand
+	}
+	i := 0
+	for i < len(formula) {
+		c := formula[i]
+		start := i
+		switch {
+		case c == '"':
+			i = skipQuoted(formula, i, '"')
+		case c == '{':
+			i = skipUntil(formula, i, '}')
+		case c == '[':
+			i = skipUntil(formula, i, ']')
+		case c == '#':
+			// ошибка: #REF!, #N/A, #DIV/0!
+			i++
+			for i < len(formula) && (isRefByte(formula[i]) || formula[i] == '/' || formula[i] == '?') {
+				i++
+			}
+		case c == '\'':
+			// лист в кавычках: 'My Sheet'!A1:B2
+			i = skipQuoted(formula, i, '\'')
+			if i < len(formula) && formula[i] == '!' {
+				i = refRunEnd(formula, i+1)
+				out.WriteString(ref(formula[start:i], formula[i:]))
+				continue
+			}
+		case isRefByte(c) || c >= utf8.RuneSelf:
+			if i = refRunEnd(formula, i); i == start {
+				// прочий символ не из ASCII (≥, неразрывный пробел)
+				_, size := utf8.DecodeRuneInString(formula[i:])
+				i += size
+				break
+			}
+			j := i
+			for j < len(formula) && formula[j] == ' ' {
+				j++
+			}
+			if j < len(formula) && formula[j] == '(' {
+				pending = strings.TrimPrefix(strings.ToUpper(formula[start:i]), "_XLFN.")
+				break
+			}
+			// структурная ссылка на таблицу
+			if i < len(formula) && formula[i] == '[' {
+				break
+			}
+			out.WriteString(ref(formula[start:i], formula[i:]))
+			continue
+		case c == '(':
+			funcs = append(funcs, pending)
+			pending = ""
+			i++
+		case c == ')':
+			if len(funcs) > 0 {
+				funcs = funcs[:len(funcs)-1]
+			}
+			i++
+		default:
+			i++
+		}
+		out.WriteString(formula[start:i])
+	}
+	return out.String()
+}
+
+// isRefByte сообщает, может ли ASCII-символ входить в ссылку или имя без кавычек
+func isRefByte(c byte) bool {
+	return c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' ||
+		c == '_' || c == '.' || c == '$' || c == '\\'
+}
+
+// refRunEnd возвращает конец операнда, начинающегося с i: ссылки (Sheet1!$A$1:B2),
+// имени или числа. Буквы не из ASCII допустимы в именах листов без кавычек.
+func refRunEnd(s string, i int) int {
+	for i < len(s) {
+		c := s[i]
+		switch {
+		case isRefByte(c) || c == ':' || c == '!':
+			i++
+		case c >= utf8.RuneSelf:
+			r, size := utf8.DecodeRuneInString(s[i:])
+			if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+				return i
+			}
+			i += size
+		default:
+			return i
+		}
+	}
+	return i
+}
+
+// skipQuoted пропускает строку в кавычках q, начинающуюся с i (удвоенная кавычка —
+// экранирование), и возвращает позицию после закрывающей кавычки
+func skipQuoted(s string, i int, q byte) int {
+	for i++; i < len(s); i++ {
+		if s[i] != q {
+			continue
+		}
+		if i+1 < len(s) && s[i+1] == q {
+			i++
+			continue
+		}
+		return i + 1
+	}
+	return len(s)
+}
+
+// skipUntil пропускает константу массива или структурную ссылку до закрывающего
+// символа end с учётом строк и вложенных скобок
+func skipUntil(s string, i int, end byte) int {
+	open := s[i]
+	depth := 0
+	for i < len(s) {
+		switch s[i] {
+		case '"':
+			i = skipQuoted(s, i, '"')
+			continue
+		case open:
+			depth++
+		case end:
+			depth--
+			if depth == 0 {
+				return i + 1
+			}
+		}
+		i++
+	}
+	return len(s)
+}
+
+// shiftFormulaRows сдвигает относительные ссылки на строки на delta строк
+// (как при копировании ячейки в Excel). Абсолютные ссылки ($C$5) и ссылки
+// на другие листы не меняются.
+func shiftFormulaRows(formula, sheet string, delta int) string {
+	if delta == 0 {
+		return formula
+	}
+	return rewriteFormulaRefs(formula, func(ref formulaRef) string {
+		if !ref.sameSheet(sheet) {
+			return ref.String()
+		}
+		shift := func(p refPart) refPart {
+			if p.row > 0 && !p.absRow && p.row+delta > 0 {
+				p.row += delta
+			}
+			return p
+		}
+		ref.from, ref.to = shift(ref.from), shift(ref.to)
+		return ref.String()
+	})
+}
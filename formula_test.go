@@ -0,0 +1,82 @@
+package exceltemplar
+
+import "testing"
+
+func TestShiftFormulaRows(t *testing.T) {
+	cases := []struct {
+		in    string
+		delta int
+		want  string
+	}{
+		{"C5*D5", 2, "C7*D7"},
+		{"C5*$C$5", 3, "C8*$C$5"},
+		{"SUM(A$1:A5)", 1, "SUM(A$1:A6)"},
+		{"IF(C5>0,\"C5\",Other!C5)", 1, "IF(C6>0,\"C5\",Other!C5)"},
+		{"'Sheet1'!B5+B5", -2, "Sheet1!B3+B3"},
+		{"'My Sheet'!B5+B5", 1, "'My Sheet'!B5+B6"},
+	}
+	for _, tc := range cases {
+		if got := shiftFormulaRows(tc.in, "Sheet1", tc.delta); got != tc.want {
+			t.Fatalf("shiftFormulaRows(%q, %d) = %q, want %q", tc.in, tc.delta, got, tc.want)
+		}
+	}
+}
+
+func TestRewriteFormulaRefsKeepsText(t *testing.T) {
+	cases := []struct{ in, want string }{
+		{"SUMPRODUCT({1,2},{3,4})*A1", "SUMPRODUCT({1,2},{3,4})*A3"},
+		{`SUM({"A1","B2";1,2})`, `SUM({"A1","B2";1,2})`},
+		{"SUM(A1:B5 B2:C3)", "SUM(A3:B7 B4:C5)"},
+		{"SUM( A1 , B2 )  +  C3", "SUM( A3 , B4 )  +  C5"},
+		{"SUMIF(A1:A5;\">0\";B1:B5)", "SUMIF(A3:A7;\">0\";B3:B7)"},
+		{`IF(A1="x!$A$1",A1,"'B2'!C3")`, `IF(A3="x!$A$1",A3,"'B2'!C3")`},
+		{`CONCAT("say ""A1""",A1)`, `CONCAT("say ""A1""",A3)`},
+		{"'It''s'!A1+A1", "'It''s'!A1+A3"},
+		{"Отчёт!A1+A1", "Отчёт!A1+A3"},
+		{"Table1[[#Totals],[Qty]]+Table1[Qty]+A1", "Table1[[#Totals],[Qty]]+Table1[Qty]+A3"},
+		{"1.5E+3*A1+TaxRate", "1.5E+3*A3+TaxRate"},
+		{"IFERROR(A1,#N/A)+#REF!", "IFERROR(A3,#N/A)+#REF!"},
+		{"LOG10(A1)≥1", "LOG10(A3)≥1"},
+		{"SUM(5:5)+SUM(A:A)", "SUM(7:7)+SUM(A:A)"},
+	}
+	for _, tc := range cases {
+		if got := shiftFormulaRows(tc.in, "Sheet1", 2); got != tc.want {
+			t.Errorf("shiftFormulaRows(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestParseFormulaRef(t *testing.T) {
+	if _, ok := parseFormulaRef("TaxRate"); ok {
+		t.Fatalf("named range must not be parsed as reference")
+	}
+	ref, ok := parseFormulaRef("$A$1:B10")
+	if !ok || !ref.isRange || ref.from.row != 1 || !ref.from.absRow || ref.to.col != 2 || ref.to.row != 10 {
+		t.Fatalf("parseFormulaRef($A$1:B10) => %+v ok=%v", ref, ok)
+	}
+}
+
+func TestFormulaRefArg(t *testing.T) {
+	cases := map[string]string{
+		"SUM(A1)":              "SUM",
+		"SUM( B2 , A1 )":       "SUM",
+		`SUMIF(A1,">0")`:       "SUMIF",
+		"SUM(A1*2)":            "",
+		"(A1)+1":               "",
+		"_xlfn.STDEV.S(C3,A1)": "STDEV.S",
+		"IF(B1>0,SUM(A1),0)":   "SUM",
+		"VLOOKUP(B1,{1,2},A1)": "VLOOKUP",
+	}
+	for formula, want := range cases {
+		got := "?"
+		rewriteFormulaRefs(formula, func(ref formulaRef) string {
+			if ref.from.col == 1 {
+				got = ref.arg
+			}
+			return ref.String()
+		})
+		if got != want {
+			t.Errorf("arg of A1 in %q = %q, want %q", formula, got, want)
+		}
+	}
+}
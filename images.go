@@ -0,0 +1,140 @@
+package exceltemplar
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	// декодеры размеров изображений для AddPictureFromBytes
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// -----------------------------
+// Изображения: image(src, fit='cell')
+// -----------------------------
+
+// Режимы вписывания изображения в ячейку
+const (
+	imageFitNone    = "none"    // исходный размер
+	imageFitCell    = "cell"    // уменьшить до ячейки (или объединённой области) с сохранением пропорций
+	imageFitStretch = "stretch" // растянуть на всю ячейку без сохранения пропорций
+)
+
+// cellImage — результат image(): картинка, привязанная к отрендеренной ячейке.
+// В смешанном тексте ячейки изображение не выводится.
+type cellImage struct {
+	data []byte
+	ext  string
+	fit  string
+}
+
+func (cellImage) String() string {
+	return ""
+}
+
+// ImageFS разрешает image() читать файлы изображений из fsys, например
+// os.DirFS("assets"). Путь в данных отсчитывается от корня fsys; абсолютные пути
+// и выход за корень через .. отклоняются. Без ImageFS image() принимает только
+// строки base64 и data URI: пути из данных не должны открывать файлы сервера.
+// ImageFS вызывается до рендера и не должен выполняться одновременно с Execute.
+func (t *Template) ImageFS(fsys fs.FS) { t.images = fsys }
+
+// fnImage вычисляет image(src[, fit='none'|'cell'|'stretch']); файлы читаются
+// только из fsys (см. ImageFS). Пустой источник даёт пустую ячейку без изображения.
+func fnImage(fsys fs.FS, src interface{}, opts ...interface{}) (interface{}, error) {
+	img := cellImage{fit: imageFitNone}
+	for _, o := range opts {
+		na, ok := o.(namedArg)
+		if !ok || na.name != "fit" {
+			return nil, argError("image: неизвестный параметр %v, ожидается fit='...'", o)
+		}
+		switch fit := toString(na.value); fit {
+		case imageFitNone, imageFitCell, imageFitStretch:
+			img.fit = fit
+		default:
+			return nil, argError("image: fit=%q, ожидается none, cell или stretch", fit)
+		}
+	}
+	s := strings.TrimSpace(toString(src))
+	if s == "" {
+		return "", nil
+	}
+	var err error
+	if img.data, img.ext, err = loadImage(fsys, s); err != nil {
+		return nil, argError("image: %w", err)
+	}
+	return img, nil
+}
+
+// loadImage читает изображение из data URI, файла fsys (nil — файлы недоступны)
+// или строки base64
+func loadImage(fsys fs.FS, src string) ([]byte, string, error) {
+	var data []byte
+	ext := ""
+	if strings.HasPrefix(src, "data:") {
+		i := strings.Index(src, ",")
+		if i < 0 || !strings.HasSuffix(src[:i], ";base64") {
+			return nil, "", fmt.Errorf("ожидается data URI в base64")
+		}
+		src = src[i+1:]
+	} else if name := path.Clean(filepath.ToSlash(src)); fsys != nil && fs.ValidPath(name) {
+		if st, err := fs.Stat(fsys, name); err == nil && !st.IsDir() {
+			b, err := fs.ReadFile(fsys, name)
+			if err != nil {
+				return nil, "", err
+			}
+			data, ext = b, strings.ToLower(path.Ext(name))
+		}
+	}
+	if data == nil {
+		clean := strings.Join(strings.Fields(src), "")
+		b, err := base64.StdEncoding.DecodeString(clean)
+		if err != nil {
+			if b, err = base64.RawStdEncoding.DecodeString(strings.TrimRight(clean, "=")); err != nil {
+				if fsys == nil {
+					return nil, "", fmt.Errorf("источник не является строкой base64 или data URI (файлы читаются только из ImageFS)")
+				}
+				return nil, "", fmt.Errorf("источник не является файлом ImageFS или строкой base64")
+			}
+		}
+		data = b
+	}
+	if sniffed := sniffImageExt(data); sniffed != "" {
+		ext = sniffed
+	}
+	if ext == "" {
+		return nil, "", fmt.Errorf("неподдерживаемый формат изображения")
+	}
+	return data, ext, nil
+}
+
+// sniffImageExt определяет формат растрового изображения по сигнатуре
+func sniffImageExt(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		return ".png"
+	case bytes.HasPrefix(data, []byte("\xff\xd8\xff")):
+		return ".jpg"
+	case bytes.HasPrefix(data, []byte("GIF87a")), bytes.HasPrefix(data, []byte("GIF89a")):
+		return ".gif"
+	}
+	return ""
+}
+
+// addCellImage привязывает изображение к ячейке. Вызывается после восстановления
+// объединений: режимы cell и stretch вписывают картинку в объединённую область.
+func (d *Document) addCellImage(sheet, addr string, img cellImage) error {
+	opts := &excelize.GraphicOptions{
+		AutoFit:             img.fit != imageFitNone,
+		AutoFitIgnoreAspect: img.fit == imageFitStretch,
+		LockAspectRatio:     img.fit != imageFitStretch,
+	}
+	return d.f.AddPictureFromBytes(sheet, addr, &excelize.Picture{Extension: img.ext, File: img.data, Format: opts})
+}
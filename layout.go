@@ -0,0 +1,391 @@
+package exceltemplar
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// -----------------------------
+// Раскладка листа после рендера
+// -----------------------------
+
+// sheetLayout связывает строки шаблона с итоговыми строками листа: статические строки
+// сдвигаются вставками, шаблонные строки размножаются по итерациям циклов,
+// управляющие и исходные шаблонные строки удаляются.
+type sheetLayout struct {
+	st       *sheetTemplate
+	rows     []renderRow
+	final    []int       // итоговая строка для rows[i]
+	pos      map[int]int // позиция исходной строки (1..st.maxRow) до удаления
+	inserted int         // сколько строк вставлено
+	deleted  []int       // удалённые строки (позиции до удаления), по возрастанию
+	byTpl    map[int][]int
+	buckets  map[[2]int]map[string][]int
+}
+
+func newSheetLayout(st *sheetTemplate, rows []renderRow, placed []int, pos map[int]int, deleted []int) *sheetLayout {
+	l := &sheetLayout{st: st, rows: rows, pos: pos, inserted: len(rows), byTpl: make(map[int][]int), buckets: make(map[[2]int]map[string][]int)}
+	l.deleted = append([]int(nil), deleted...)
+	sort.Ints(l.deleted)
+	l.final = make([]int, len(placed))
+	for i, p := range placed {
+		l.final[i] = l.finalPos(p)
+		l.byTpl[rows[i].tplRow] = append(l.byTpl[rows[i].tplRow], i)
+	}
+	return l
+}
+
+// finalPos переводит позицию до удаления в итоговую. Для удалённой строки
+// возвращается позиция строки, которая заняла её место.
+func (l *sheetLayout) finalPos(p int) int {
+	return p - sort.SearchInts(l.deleted, p)
+}
+
+// staticRow возвращает итоговую позицию исходной строки листа
+func (l *sheetLayout) staticRow(r int) int {
+	if p, ok := l.pos[r]; ok {
+		return l.finalPos(p)
+	}
+	return l.finalPos(r + l.inserted)
+}
+
+// isDeleted сообщает, была ли исходная строка удалена (управляющая или шаблонная)
+func (l *sheetLayout) isDeleted(r int) bool {
+	p, ok := l.pos[r]
+	if !ok {
+		return false
+	}
+	i := sort.SearchInts(l.deleted, p)
+	return i < len(l.deleted) && l.deleted[i] == p
+}
+
+func (l *sheetLayout) isTpl(r int) bool {
+	_, ok := l.st.rowTpls[r]
+	return ok
+}
+
+// commonDepth — число общих внешних циклов у двух шаблонных строк
+func commonDepth(a, b []int) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return n
+}
+
+func scopeKey(scope []int) string {
+	parts := make([]string, len(scope))
+	for i, id := range scope {
+		parts[i] = strconv.Itoa(id)
+	}
+	return strings.Join(parts, ",")
+}
+
+// generated возвращает итоговые строки (по возрастанию), порождённые шаблонной строкой tplRow
+// в тех же итерациях первых depth циклов, что и scope
+func (l *sheetLayout) generated(tplRow, depth int, scope []int) []int {
+	key := [2]int{tplRow, depth}
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = make(map[string][]int)
+		for _, i := range l.byTpl[tplRow] {
+			sc := l.rows[i].scope
+			if len(sc) > depth {
+				sc = sc[:depth]
+			}
+			k := scopeKey(sc)
+			bucket[k] = append(bucket[k], l.final[i])
+		}
+		l.buckets[key] = bucket
+	}
+	if len(scope) > depth {
+		scope = scope[:depth]
+	}
+	return bucket[scopeKey(scope)]
+}
+
+// rowSpan возвращает первую и последнюю итоговые строки, соответствующие исходной строке r
+// в контексте строки-владельца (его цепочки циклов chain и итераций scope).
+// Для шаблонной строки без данных возвращается пустой отрезок (lo > hi) на её месте.
+func (l *sheetLayout) rowSpan(r int, chain, scope []int) (lo, hi int) {
+	if !l.isTpl(r) {
+		p := l.staticRow(r)
+		if l.isDeleted(r) {
+			// удалённая управляющая строка не занимает места
+			return p, p - 1
+		}
+		return p, p
+	}
+	gen := l.generated(r, commonDepth(chain, l.st.chains[r]), scope)
+	if len(gen) == 0 {
+		p := l.staticRow(r)
+		return p, p - 1
+	}
+	return gen[0], gen[len(gen)-1]
+}
+
+// rowRuns разбивает отсортированный список строк на непрерывные отрезки
+func rowRuns(rows []int) [][2]int {
+	var runs [][2]int
+	for _, r := range rows {
+		if n := len(runs); n > 0 && runs[n-1][1]+1 == r {
+			runs[n-1][1] = r
+			continue
+		}
+		runs = append(runs, [2]int{r, r})
+	}
+	return runs
+}
+
+// mapFormula переписывает формулу исходной строки tplRow для итоговой строки dstRow.
+// Ссылки на шаблонные строки из той же итерации указывают на строку этой итерации,
+// ссылки на строки вложенных циклов растягиваются на все порождённые строки
+// (для пустого блока — на пустую последнюю строку листа), ссылки на статические строки следуют
+// за сдвинутой ячейкой. В повторяемых строках относительные ссылки на статические
+// строки сдвигаются, как при копировании ячейки в Excel.
+func (l *sheetLayout) mapFormula(formula string, tplRow, dstRow int, scope []int) (string, error) {
+	chain := l.st.chains[tplRow]
+	repeated := len(chain) > 0
+	sheet := l.st.name
+	var err error
+	out := rewriteFormulaRefs(formula, func(ref formulaRef) string {
+		if !ref.sameSheet(sheet) || ref.from.row == 0 || ref.to.row == 0 {
+			return ref.String()
+		}
+		// Ссылка на одну строку шаблона может развернуться в несколько отрезков
+		if ref.from.row == ref.to.row && l.isTpl(ref.from.row) {
+			x := ref.from.row
+			gen := l.generated(x, commonDepth(chain, l.st.chains[x]), scope)
+			if len(gen) == 0 {
+				return ref.emptyRows()
+			}
+			runs := rowRuns(gen)
+			parts := make([]string, len(runs))
+			for i, run := range runs {
+				r := ref
+				r.from.row, r.to.row = run[0], run[1]
+				r.isRange = ref.isRange || run[0] != run[1]
+				parts[i] = r.String()
+			}
+			if len(parts) == 1 {
+				return parts[0]
+			}
+			union, uerr := unionRefs(ref, parts)
+			if uerr != nil {
+				err = uerr
+				return ref.String()
+			}
+			return union
+		}
+		// Статическая строка: в повторяемой строке относительная ссылка копируется
+		// со сдвигом, иначе следует за сдвинутой ячейкой
+		staticPart := func(p refPart) refPart {
+			if repeated && !p.absRow {
+				p.row = dstRow + p.row - tplRow
+			} else {
+				p.row = l.staticRow(p.row)
+			}
+			return p
+		}
+		if !ref.isRange {
+			ref.from = staticPart(ref.from)
+			ref.to = ref.from
+			return ref.String()
+		}
+		from, to := ref.from, ref.to
+		if l.isTpl(from.row) || (!repeated || from.absRow) {
+			from.row, _ = l.rowSpan(from.row, chain, scope)
+		} else {
+			from = staticPart(from)
+		}
+		if l.isTpl(to.row) || (!repeated || to.absRow) {
+			_, to.row = l.rowSpan(to.row, chain, scope)
+		} else {
+			to = staticPart(to)
+		}
+		if from.row <= 0 || to.row <= 0 || from.row > to.row {
+			return ref.emptyRows()
+		}
+		ref.from, ref.to = from, to
+		return ref.String()
+	})
+	return out, err
+}
+
+// mergeRanges возвращает итоговые строки (первую и последнюю) для каждого экземпляра
+// объединения m. Объединение внутри тела блока повторяется в каждой итерации самого
+// глубокого блока, целиком содержащего его строки; объединение, выходящее за границы
+// блока, растягивается на все порождённые строки и статические строки диапазона.
+func (l *sheetLayout) mergeRanges(m mergeTpl) [][2]int {
+	var prefix []int
+	for r := m.startRow; r <= m.endRow; r++ {
+		chain, ok := l.st.chains[r]
+		if !ok {
+			chain = l.st.ctrlChains[r]
+		}
+		if r == m.startRow {
+			prefix = chain
+			continue
+		}
+		prefix = prefix[:commonDepth(prefix, chain)]
+	}
+	depth := len(prefix)
+	spans := make(map[string][2]int)
+	add := func(key string, row int) {
+		sp, ok := spans[key]
+		if !ok {
+			spans[key] = [2]int{row, row}
+			return
+		}
+		if row < sp[0] {
+			sp[0] = row
+		}
+		if row > sp[1] {
+			sp[1] = row
+		}
+		spans[key] = sp
+	}
+	for i, rr := range l.rows {
+		if rr.tplRow < m.startRow || rr.tplRow > m.endRow {
+			continue
+		}
+		sc := rr.scope
+		if len(sc) > depth {
+			sc = sc[:depth]
+		}
+		add(scopeKey(sc), l.final[i])
+	}
+	if depth == 0 {
+		for r := m.startRow; r <= m.endRow; r++ {
+			if !l.isTpl(r) && !l.isDeleted(r) {
+				add("", l.staticRow(r))
+			}
+		}
+	}
+	out := make([][2]int, 0, len(spans))
+	for _, sp := range spans {
+		if sp[0] == sp[1] && m.startCol == m.endCol {
+			continue
+		}
+		out = append(out, sp)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i][0] < out[j][0] })
+	return out
+}
+
+// mapRows переводит отрезок исходных строк r1..r2 в отрезки итоговых строк:
+// шаблонные строки разворачиваются во все порождённые строки, удалённые пропускаются.
+func (l *sheetLayout) mapRows(r1, r2 int) [][2]int {
+	var rows []int
+	last := r2
+	if last > l.st.maxRow {
+		last = l.st.maxRow
+	}
+	for r := r1; r <= last; r++ {
+		if l.isTpl(r) {
+			rows = append(rows, l.generated(r, 0, nil)...)
+			continue
+		}
+		if !l.isDeleted(r) {
+			rows = append(rows, l.staticRow(r))
+		}
+	}
+	sort.Ints(rows)
+	runs := rowRuns(rows)
+	// Строки ниже области шаблона только сдвигаются — переносим их одним отрезком
+	if r2 > l.st.maxRow {
+		a := r1
+		if a <= l.st.maxRow {
+			a = l.st.maxRow + 1
+		}
+		lo, hi := l.staticRow(a), l.staticRow(r2)
+		if hi > excelize.TotalRows {
+			hi = excelize.TotalRows
+		}
+		if lo <= hi {
+			if n := len(runs); n > 0 && runs[n-1][1]+1 >= lo {
+				runs[n-1][1] = hi
+			} else {
+				runs = append(runs, [2]int{lo, hi})
+			}
+		}
+	}
+	return runs
+}
+
+// mapSqref переводит список диапазонов ("A1:C5 E7") в итоговые координаты листа.
+// Диапазон, все строки которого удалены, выпадает из списка.
+func (l *sheetLayout) mapSqref(sqref string) string {
+	var out []string
+	for _, ref := range strings.Fields(sqref) {
+		from, to := ref, ref
+		if i := strings.Index(ref, ":"); i >= 0 {
+			from, to = ref[:i], ref[i+1:]
+		}
+		c1, r1, err1 := excelize.CellNameToCoordinates(from)
+		c2, r2, err2 := excelize.CellNameToCoordinates(to)
+		if err1 != nil || err2 != nil {
+			out = append(out, ref)
+			continue
+		}
+		for _, run := range l.mapRows(r1, r2) {
+			a, _ := excelize.CoordinatesToCellName(c1, run[0])
+			if c1 == c2 && run[0] == run[1] {
+				out = append(out, a)
+				continue
+			}
+			b, _ := excelize.CoordinatesToCellName(c2, run[1])
+			out = append(out, a+":"+b)
+		}
+	}
+	return strings.Join(out, " ")
+}
+
+// sqrefTop возвращает верхнюю строку первого диапазона списка (0, если список пуст)
+func sqrefTop(sqref string) int {
+	fields := strings.Fields(sqref)
+	if len(fields) == 0 {
+		return 0
+	}
+	first, _, _ := strings.Cut(fields[0], ":")
+	_, row, err := excelize.CellNameToCoordinates(first)
+	if err != nil {
+		return 0
+	}
+	return row
+}
+
+// mapAnchoredFormula переносит формулу правила (условного форматирования, проверки данных),
+// привязанную к левой верхней ячейке диапазона: относительные ссылки сдвигаются вместе
+// с привязкой на delta строк, абсолютные ссылки на статические строки следуют за ними.
+func (l *sheetLayout) mapAnchoredFormula(formula string, delta int) string {
+	if formula == "" {
+		return formula
+	}
+	prefix := ""
+	if strings.HasPrefix(formula, "=") {
+		prefix, formula = "=", formula[1:]
+	}
+	return prefix + rewriteFormulaRefs(formula, func(ref formulaRef) string {
+		if !ref.sameSheet(l.st.name) {
+			return ref.String()
+		}
+		mp := func(p refPart) refPart {
+			switch {
+			case p.row == 0:
+			case !p.absRow:
+				if p.row += delta; p.row < 1 {
+					p.row = 1
+				}
+			case !l.isTpl(p.row):
+				p.row = l.staticRow(p.row)
+			}
+			return p
+		}
+		ref.from, ref.to = mp(ref.from), mp(ref.to)
+		return ref.String()
+	})
+}
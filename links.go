@@ -0,0 +1,79 @@
+package exceltemplar
+
+import (
+	"strings"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// -----------------------------
+// Гиперссылки: link(url, text)
+// -----------------------------
+
+// cellLink — результат link(): ячейка получает текст и гиперссылку.
+// В смешанном тексте ячейки ссылка вставляется только текстом.
+type cellLink struct {
+	url  string
+	text string
+}
+
+func (l cellLink) String() string {
+	return l.text
+}
+
+// location сообщает, ведёт ли ссылка внутрь книги ("#Лист!A1" или "Лист!A1"),
+// и возвращает адрес без ведущего #
+func (l cellLink) location() (string, bool) {
+	if strings.HasPrefix(l.url, "#") {
+		return strings.TrimPrefix(l.url, "#"), true
+	}
+	if strings.Contains(l.url, "!") && !strings.Contains(l.url, ":/") && !strings.Contains(l.url, "mailto:") {
+		return l.url, true
+	}
+	return "", false
+}
+
+// fnLink вычисляет link(url[, text]); без текста отображается сам адрес
+func fnLink(url interface{}, text ...interface{}) (interface{}, error) {
+	if len(text) > 1 {
+		return nil, argError("link: ожидается 1 или 2 аргумента (url[, text])")
+	}
+	l := cellLink{url: strings.TrimSpace(toString(url))}
+	l.text = l.url
+	if len(text) == 1 {
+		if s := toString(text[0]); s != "" {
+			l.text = s
+		}
+	}
+	return l, nil
+}
+
+// setCellLink записывает текст ссылки и гиперссылку в ячейку. Пустой адрес даёт
+// обычный текст. Ячейка без собственного стиля получает стиль гиперссылки.
+func (d *Document) setCellLink(sheet, addr string, l cellLink, styled bool) error {
+	if err := d.f.SetCellValue(sheet, addr, l.text); err != nil {
+		return err
+	}
+	if l.url == "" {
+		return nil
+	}
+	display := l.text
+	if loc, ok := l.location(); ok {
+		if err := d.f.SetCellHyperLink(sheet, addr, loc, "Location", excelize.HyperlinkOpts{Display: &display}); err != nil {
+			return err
+		}
+	} else if err := d.f.SetCellHyperLink(sheet, addr, l.url, "External", excelize.HyperlinkOpts{Display: &display}); err != nil {
+		return err
+	}
+	if styled {
+		return nil
+	}
+	if d.linkStyle == 0 {
+		sid, err := d.f.NewStyle(&excelize.Style{Font: &excelize.Font{Color: "0563C1", Underline: "single"}})
+		if err != nil {
+			return err
+		}
+		d.linkStyle = sid
+	}
+	return d.f.SetCellStyle(sheet, addr, addr, d.linkStyle)
+}
@@ -0,0 +1,264 @@
+package exceltemplar
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// -----------------------------
+// Проверка шаблона без данных (lint)
+// -----------------------------
+
+// Severity — серьёзность замечания Validate
+type Severity string
+
+const (
+	// SeverityError — шаблон не загрузится или рендер завершится ошибкой
+	SeverityError Severity = "error"
+	// SeverityWarning — шаблон работает, но часть его молча игнорируется или выводится пустой
+	SeverityWarning Severity = "warning"
+)
+
+// Коды замечаний, которые находит только Validate
+const (
+	// CodeIgnoredCell — содержимое строки с маркером блока: строка остаётся в результате
+	// невычисленной, вместе с текстом маркера
+	CodeIgnoredCell ErrorCode = "ignored_cell"
+	// CodeBlockMismatch — {{/each}} закрывает each-obj или {{/each-obj}} закрывает each
+	CodeBlockMismatch ErrorCode = "block_mismatch"
+	// CodeVarScope — переменная цикла используется вне своего цикла
+	CodeVarScope ErrorCode = "var_scope"
+	// CodeBadDirective — текст с {{, который не распознан как директива
+	CodeBadDirective ErrorCode = "bad_directive"
+)
+
+// Issue — замечание Validate с местом в шаблоне
+type Issue struct {
+	Severity Severity
+	Code     ErrorCode
+	Sheet    string
+	// Cell — адрес ячейки шаблона
+	Cell    string
+	Raw     string
+	Expr    string
+	Message string
+}
+
+func (i Issue) String() string {
+	te := TemplateError{Sheet: i.Sheet, Cell: i.Cell, Err: errors.New(i.Message)}
+	return te.Error()
+}
+
+var (
+	// rxPathCall — вызовы path("...") в выражении после transformExprPaths
+	rxPathCall = regexp.MustCompile(`path\(("(?:[^"\\]|\\.)*")\)`)
+	// rxVarRef — переменная в пути: $item, $i (но не $. и $root)
+	rxVarRef = regexp.MustCompile(`\$[\p{L}_][\p{L}\p{N}_]*`)
+)
+
+// Validate проверяет файл шаблона без данных и возвращает все замечания: ошибки
+// разбора и компиляции выражений, а также то, что движок молча пропускает —
+// содержимое строк с маркерами блоков, {{/each}} вместо {{/each-obj}}, переменные
+// вне своего цикла, текст {{...}}, не являющийся директивой. Пустой результат — шаблон
+// чист. Выражения компилируются без пользовательских функций: шаблоны с Funcs
+// дополнительно проверяет сам вызов Funcs.
+func Validate(path string) []Issue {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return []Issue{{Severity: SeverityError, Code: CodeData, Message: err.Error()}}
+	}
+	return ValidateRaw(raw)
+}
+
+// ValidateRaw — Validate для содержимого .xlsx в памяти
+func ValidateRaw(raw []byte) []Issue {
+	f, err := excelize.OpenReader(bytes.NewReader(raw))
+	if err != nil {
+		return []Issue{{Severity: SeverityError, Code: CodeData, Message: err.Error()}}
+	}
+	defer f.Close()
+	exprs := &exprSet{}
+	var issues []Issue
+	for _, sheet := range f.GetSheetList() {
+		if sheet == styleSheetName {
+			if _, err := readStyleSheet(f); err != nil {
+				issues = append(issues, errorIssue(errorAt(err, CodeSyntax, TemplateError{Sheet: sheet})))
+			}
+			continue
+		}
+		st, err := parseSheet(f, sheet)
+		if err != nil {
+			issues = append(issues, errorIssue(errorAt(err, CodeSyntax, TemplateError{Sheet: sheet})))
+			continue
+		}
+		issues = append(issues, st.notes...)
+		for _, e := range sheetExprs(st) {
+			if _, err := exprs.compile(e.expr); err != nil {
+				issues = append(issues, errorIssue(errorAt(err, CodeExpr, TemplateError{Sheet: sheet, Cell: e.cell, Raw: e.raw, Expr: e.expr})))
+			}
+		}
+		issues = append(issues, lintVars(st)...)
+	}
+	return issues
+}
+
+// errorIssue превращает ошибку разбора или компиляции в замечание
+func errorIssue(err error) Issue {
+	var te *TemplateError
+	if !errors.As(err, &te) {
+		return Issue{Severity: SeverityError, Message: err.Error()}
+	}
+	return Issue{Severity: SeverityError, Code: te.Code, Sheet: te.Sheet, Cell: te.Cell, Raw: te.Raw, Expr: te.Expr, Message: te.Err.Error()}
+}
+
+// lintVars находит переменные, которые используются вне циклов, объявляющих их
+func lintVars(st *sheetTemplate) []Issue {
+	// declared — переменные всех циклов листа: отличают «не в том месте» от опечатки
+	declared := map[string]bool{}
+	declare := func(names ...string) {
+		for _, n := range names {
+			declared[n] = true
+		}
+	}
+	var collect func([]node)
+	collect = func(nodes []node) {
+		for _, n := range nodes {
+			switch nn := n.(type) {
+			case *eachNode:
+				declare(nn.itemVar, nn.indexVar)
+				collect(nn.children)
+			case *eachObjNode:
+				declare(nn.keyVar, nn.valVar)
+				collect(nn.children)
+			case *ifNode:
+				collect(nn.thenNodes)
+				collect(nn.elseNodes)
+			}
+		}
+	}
+	collect(st.nodes)
+	for _, lp := range st.colLoops {
+		declare(lp.itemVar, lp.indexVar)
+	}
+	if st.sheetLoop != nil {
+		declare(st.sheetLoop.itemVar, st.sheetLoop.indexVar)
+	}
+
+	var issues []Issue
+	seen := map[string]bool{}
+	check := func(scope map[string]bool, at cellPos, expr string, vars []string) {
+		for _, v := range vars {
+			if scope[v] || seen[at.cell+" "+v] {
+				continue
+			}
+			seen[at.cell+" "+v] = true
+			is := Issue{Severity: SeverityWarning, Code: CodeUnknownVar, Sheet: st.name, Cell: at.cell, Raw: at.raw, Expr: expr,
+				Message: fmt.Sprintf("переменная %s не объявлена ни одним циклом", v)}
+			if declared[v] {
+				is.Code, is.Message = CodeVarScope, fmt.Sprintf("переменная %s используется вне своего цикла", v)
+			}
+			issues = append(issues, is)
+		}
+	}
+	with := func(scope map[string]bool, names ...string) map[string]bool {
+		out := make(map[string]bool, len(scope)+len(names))
+		for k := range scope {
+			out[k] = true
+		}
+		for _, n := range names {
+			if n != "" {
+				out[n] = true
+			}
+		}
+		return out
+	}
+
+	top := map[string]bool{}
+	if sl := st.sheetLoop; sl != nil {
+		a1 := cellPos{cell: "A1"}
+		check(top, a1, sl.path, pathVars(sl.path))
+		top = with(top, sl.itemVar, sl.indexVar)
+		check(top, a1, sl.nameExpr, exprVars(sl.nameExpr))
+	}
+	for _, lp := range st.colLoops {
+		check(top, cellPos{cell: cellName(lp.startCol, lp.row)}, lp.path, pathVars(lp.path))
+	}
+	var walk func([]node, map[string]bool)
+	walk = func(nodes []node, scope map[string]bool) {
+		for _, n := range nodes {
+			switch nn := n.(type) {
+			case *rowNode:
+				for _, c := range nn.cells {
+					cscope := scope
+					for _, lp := range st.colLoops {
+						if c.col >= lp.startCol && c.col <= lp.endCol {
+							cscope = with(cscope, lp.itemVar, lp.indexVar)
+						}
+					}
+					at := cellPos{cell: cellName(c.col, nn.row), raw: c.raw}
+					for _, tk := range c.tokens {
+						if tk.kind == tokenExpr {
+							check(cscope, at, tk.expr, exprVars(tk.expr))
+						}
+					}
+					for _, se := range c.styles {
+						check(cscope, at, se, exprVars(se))
+					}
+				}
+			case *eachNode:
+				check(scope, nn.at, nn.path, pathVars(nn.path))
+				walk(nn.children, with(scope, nn.itemVar, nn.indexVar))
+			case *eachObjNode:
+				check(scope, nn.at, nn.path, pathVars(nn.path))
+				walk(nn.children, with(scope, nn.keyVar, nn.valVar))
+			case *ifNode:
+				check(scope, nn.at, nn.expr, exprVars(nn.expr))
+				walk(nn.thenNodes, scope)
+				walk(nn.elseNodes, scope)
+			}
+		}
+	}
+	walk(st.nodes, top)
+	return issues
+}
+
+// exprVars возвращает переменные, на которые ссылается выражение
+func exprVars(src string) []string {
+	var vars []string
+	for _, p := range exprPaths(src) {
+		vars = append(vars, pathVars(p)...)
+	}
+	return vars
+}
+
+// exprPaths возвращает пути данных выражения в том виде, как они записаны
+func exprPaths(src string) []string {
+	piped, err := expandPipes(src)
+	if err != nil {
+		return nil
+	}
+	var paths []string
+	for _, m := range rxPathCall.FindAllStringSubmatch(transformExprPaths(piped), -1) {
+		if p, err := strconv.Unquote(m[1]); err == nil {
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
+
+// pathVars возвращает переменные пути, включая индексы: $p.tasks[$i] → $p, $i
+func pathVars(path string) []string {
+	var vars []string
+	for _, v := range rxVarRef.FindAllString(path, -1) {
+		if v != "$root" {
+			vars = append(vars, v)
+		}
+	}
+	return vars
+}
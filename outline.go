@@ -0,0 +1,204 @@
+package exceltemplar
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// -----------------------------
+// Структура шаблона: дерево блоков и пути к данным
+// -----------------------------
+
+// OutlineNode — блок шаблона или ячейка с выражениями
+type OutlineNode struct {
+	// Kind — sheet-each, each-col, each, each-obj, if, else или cell
+	Kind string
+	// Cell — адрес ячейки шаблона с директивой
+	Cell string
+	// Expr — путь цикла, условие {{#if}} или исходный текст ячейки
+	Expr string
+	// Vars — переменные цикла
+	Vars     []string
+	Children []*OutlineNode
+}
+
+// SheetOutline — структура листа шаблона
+type SheetOutline struct {
+	Name   string
+	Blocks []*OutlineNode
+	// Paths — все пути к данным, которые читает лист, от корня: переменные циклов
+	// раскрыты ($d.name в {{#each $.rows as $d}} → $.rows[].name), отсортированы
+	Paths []string
+}
+
+// rxOutlineIndex — индекс элемента в пути ([0], [$i]); в структуре заменяется на []
+var rxOutlineIndex = regexp.MustCompile(`\[(?:\d+|\$[\p{L}_][\p{L}\p{N}_]*)\]`)
+
+// Outline возвращает структуру листов шаблона в порядке книги: блоки, ячейки
+// с выражениями и пути к данным. Нужна, чтобы понять, какие данные ждёт шаблон.
+func (t *Template) Outline() []SheetOutline {
+	out := make([]SheetOutline, 0, len(t.order))
+	for _, name := range t.order {
+		out = append(out, sheetOutline(t.sheets[name]))
+	}
+	return out
+}
+
+// outlineScope — пути от корня для переменных циклов и текущего элемента
+type outlineScope struct {
+	vars    map[string]string
+	current string
+}
+
+func (sc outlineScope) with(current string, vars map[string]string) outlineScope {
+	out := outlineScope{vars: make(map[string]string, len(sc.vars)+len(vars)), current: current}
+	for k, v := range sc.vars {
+		out.vars[k] = v
+	}
+	for k, v := range vars {
+		if k != "" {
+			out.vars[k] = v
+		}
+	}
+	return out
+}
+
+// resolve переводит путь выражения в путь от корня; "" — путь не ведёт в данные
+// (индекс или ключ цикла)
+func (sc outlineScope) resolve(path string) string {
+	path = strings.TrimSpace(path)
+	switch {
+	case path == "" || path == "$" || path == "$root":
+		return ""
+	case strings.HasPrefix(path, "$root"):
+		path = "$" + path[len("$root"):]
+	case strings.HasPrefix(path, "$."):
+	case strings.HasPrefix(path, "$"):
+		end := strings.IndexAny(path[1:], ".[")
+		name, rest := path, ""
+		if end >= 0 {
+			name, rest = path[:end+1], path[end+1:]
+		}
+		base, ok := sc.vars[name]
+		if !ok {
+			// необъявленная переменная остаётся как есть (см. Validate)
+			return path
+		}
+		if base == "" {
+			return ""
+		}
+		path = base + rest
+	case strings.HasPrefix(path, "."):
+		if path == "." {
+			return sc.current
+		}
+		path = sc.current + path
+	default:
+		path = "$." + path
+	}
+	return rxOutlineIndex.ReplaceAllString(path, "[]")
+}
+
+func sheetOutline(st *sheetTemplate) SheetOutline {
+	paths := map[string]bool{}
+	use := func(sc outlineScope, p string) string {
+		abs := sc.resolve(p)
+		if abs != "" {
+			paths[abs] = true
+		}
+		return abs
+	}
+	useExpr := func(sc outlineScope, expr string) {
+		for _, p := range exprPaths(expr) {
+			use(sc, p)
+		}
+	}
+
+	top := outlineScope{}
+	var root []*OutlineNode
+	add := &root
+	if sl := st.sheetLoop; sl != nil {
+		base := use(top, sl.path)
+		top = top.with(base+"[]", map[string]string{sl.itemVar: base + "[]", sl.indexVar: ""})
+		useExpr(top, sl.nameExpr)
+		n := &OutlineNode{Kind: "sheet-each", Cell: "A1", Expr: sl.path, Vars: loopVars(sl.itemVar, sl.indexVar)}
+		root = append(root, n)
+		add = &n.Children
+	}
+	// переменные each-col действуют в колонках цикла на всех строках листа
+	colScopes := map[int]outlineScope{}
+	for _, lp := range st.colLoops {
+		base := use(top, lp.path)
+		sc := top.with(top.current, map[string]string{lp.itemVar: base + "[]", lp.indexVar: ""})
+		for c := lp.startCol; c <= lp.endCol; c++ {
+			colScopes[c] = sc
+		}
+		*add = append(*add, &OutlineNode{Kind: "each-col", Cell: cellName(lp.startCol, lp.row), Expr: lp.path, Vars: loopVars(lp.itemVar, lp.indexVar)})
+	}
+
+	var walk func([]node, outlineScope) []*OutlineNode
+	walk = func(nodes []node, sc outlineScope) []*OutlineNode {
+		var out []*OutlineNode
+		for _, n := range nodes {
+			switch nn := n.(type) {
+			case *rowNode:
+				for _, c := range nn.cells {
+					csc := sc
+					if cs, ok := colScopes[c.col]; ok {
+						csc = sc.with(sc.current, cs.vars)
+					}
+					for _, tk := range c.tokens {
+						if tk.kind == tokenExpr {
+							useExpr(csc, tk.expr)
+						}
+					}
+					for _, se := range c.styles {
+						useExpr(csc, se)
+					}
+					out = append(out, &OutlineNode{Kind: "cell", Cell: cellName(c.col, nn.row), Expr: c.raw})
+				}
+			case *eachNode:
+				base := use(sc, nn.path)
+				item := base + "[]"
+				on := &OutlineNode{Kind: "each", Cell: nn.at.cell, Expr: nn.path, Vars: loopVars(nn.itemVar, nn.indexVar)}
+				on.Children = walk(nn.children, sc.with(item, map[string]string{nn.itemVar: item, nn.indexVar: ""}))
+				out = append(out, on)
+			case *eachObjNode:
+				base := use(sc, nn.path)
+				val := base + ".*"
+				on := &OutlineNode{Kind: "each-obj", Cell: nn.at.cell, Expr: nn.path, Vars: loopVars(nn.keyVar, nn.valVar)}
+				on.Children = walk(nn.children, sc.with(val, map[string]string{nn.keyVar: "", nn.valVar: val}))
+				out = append(out, on)
+			case *ifNode:
+				useExpr(sc, nn.expr)
+				on := &OutlineNode{Kind: "if", Cell: nn.at.cell, Expr: nn.expr}
+				on.Children = walk(nn.thenNodes, sc)
+				if len(nn.elseNodes) > 0 {
+					on.Children = append(on.Children, &OutlineNode{Kind: "else", Children: walk(nn.elseNodes, sc)})
+				}
+				out = append(out, on)
+			}
+		}
+		return out
+	}
+	*add = append(*add, walk(st.nodes, top)...)
+
+	so := SheetOutline{Name: st.name, Blocks: root, Paths: make([]string, 0, len(paths))}
+	for p := range paths {
+		so.Paths = append(so.Paths, p)
+	}
+	sort.Strings(so.Paths)
+	return so
+}
+
+// loopVars — объявленные переменные цикла без пустых
+func loopVars(names ...string) []string {
+	var out []string
+	for _, n := range names {
+		if n != "" && n != "$" {
+			out = append(out, n)
+		}
+	}
+	return out
+}
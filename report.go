@@ -0,0 +1,92 @@
+package exceltemplar
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// -----------------------------
+// Сбор ошибок: рендер продолжается, ошибки попадают в отчёт
+// -----------------------------
+
+// errMarker — значение ячейки, выражение или стиль которой не удалось вычислить
+// в режиме CollectErrors
+const errMarker = "#ERR"
+
+// errCommentAuthor — автор примечаний с текстом ошибок (см. ErrorComments)
+const errCommentAuthor = "exceltemplar"
+
+// CollectErrors включает режим сбора ошибок: рендер не прерывается на первой ошибке.
+// Ячейка с ошибкой получает значение #ERR, цикл с ошибкой в пути пропускается,
+// условие {{#if}} с ошибкой считается ложным, лист, который не удалось записать,
+// остаётся как есть. Execute возвращает документ вместе с *RenderReport, если
+// ошибки были. CollectErrors вызывается до рендера и не должен выполняться
+// одновременно с Execute.
+func (t *Template) CollectErrors(collect bool) { t.collect = collect }
+
+// ErrorComments в режиме CollectErrors добавляет к каждой ячейке #ERR примечание
+// с текстом ошибки
+func (t *Template) ErrorComments(comments bool) { t.errComments = comments }
+
+// RenderReport — ошибки рендера в режиме CollectErrors в порядке обнаружения.
+// Execute возвращает его как ошибку вместе с готовым документом:
+//
+//	doc, err := tmpl.Execute(outputs)
+//	var rep *exceltemplar.RenderReport
+//	if errors.As(err, &rep) { ... doc сохранён с #ERR, rep.Errors — список проблем ... }
+type RenderReport struct {
+	Errors []*TemplateError
+}
+
+func (r *RenderReport) Error() string {
+	lines := make([]string, 0, len(r.Errors)+1)
+	lines = append(lines, "ошибок шаблона: "+strconv.Itoa(len(r.Errors)))
+	for _, te := range r.Errors {
+		lines = append(lines, te.Error())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Unwrap открывает отдельные ошибки для errors.Is и errors.As
+func (r *RenderReport) Unwrap() []error {
+	errs := make([]error, len(r.Errors))
+	for i, te := range r.Errors {
+		errs[i] = te
+	}
+	return errs
+}
+
+// add записывает ошибку в отчёт и возвращает nil, чтобы рендер продолжился.
+// Без отчёта (режим сбора выключен) ошибка возвращается как есть.
+func (r *RenderReport) add(err error) error {
+	if r == nil || err == nil {
+		return err
+	}
+	var te *TemplateError
+	if !errors.As(err, &te) {
+		te = &TemplateError{Code: CodeEval, Err: err}
+	}
+	r.Errors = append(r.Errors, te)
+	return nil
+}
+
+// Report возвращает ошибки, собранные при рендере документа в режиме CollectErrors;
+// nil, если ошибок не было
+func (d *Document) Report() *RenderReport {
+	if d.report == nil || len(d.report.Errors) == 0 {
+		return nil
+	}
+	return d.report
+}
+
+// addErrorComment добавляет к ячейке примечание с текстами ошибок
+func (d *Document) addErrorComment(sheet, addr string, errs []error) error {
+	text := make([]string, len(errs))
+	for i, err := range errs {
+		text[i] = err.Error()
+	}
+	return d.f.AddComment(sheet, excelize.Comment{Author: errCommentAuthor, Cell: addr, Text: strings.Join(text, "\n")})
+}
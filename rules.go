@@ -0,0 +1,352 @@
+package exceltemplar
+
+import (
+	"encoding/xml"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// -----------------------------
+// Правила диапазонов: условное форматирование
+// -----------------------------
+
+// condFmtTpl — условное форматирование листа в исходных координатах шаблона
+type condFmtTpl struct {
+	sqref string
+	opts  []excelize.ConditionalFormatOptions
+}
+
+// readCondFmts читает условное форматирование листа в стабильном порядке
+func readCondFmts(f *excelize.File, sheet string) ([]condFmtTpl, error) {
+	cfs, err := f.GetConditionalFormats(sheet)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]condFmtTpl, 0, len(cfs))
+	for sqref, opts := range cfs {
+		out = append(out, condFmtTpl{sqref: sqref, opts: opts})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].sqref < out[j].sqref })
+	return out, nil
+}
+
+// detachCondFmts снимает условное форматирование до вставки строк: excelize лишь сдвигает
+// диапазоны и теряет правила удалённых шаблонных строк
+func (d *Document) detachCondFmts(st *sheetTemplate) error {
+	for _, cf := range st.condFmts {
+		if err := d.f.UnsetConditionalFormat(st.name, cf.sqref); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyCondFmts восстанавливает условное форматирование по итоговой раскладке: диапазоны
+// на шаблонных строках растягиваются на порождённые строки, остальные сдвигаются
+func (d *Document) applyCondFmts(st *sheetTemplate, l *sheetLayout) error {
+	for _, cf := range st.condFmts {
+		sqref := l.mapSqref(cf.sqref)
+		if sqref == "" {
+			continue
+		}
+		delta := sqrefTop(sqref) - sqrefTop(cf.sqref)
+		opts := make([]excelize.ConditionalFormatOptions, len(cf.opts))
+		for i, o := range cf.opts {
+			if o.Type == "formula" {
+				o.Criteria = l.mapAnchoredFormula(o.Criteria, delta)
+			}
+			o.Value = l.mapAnchoredFormula(o.Value, delta)
+			o.MinValue = l.mapAnchoredFormula(o.MinValue, delta)
+			o.MidValue = l.mapAnchoredFormula(o.MidValue, delta)
+			o.MaxValue = l.mapAnchoredFormula(o.MaxValue, delta)
+			opts[i] = o
+		}
+		if err := d.f.SetConditionalFormat(st.name, sqref, opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// -----------------------------
+// Правила диапазонов: проверка данных (выпадающие списки)
+// -----------------------------
+
+// detachDataValidations снимает обычные проверки данных листа до вставки строк и возвращает
+// их в исходных координатах. Проверки из extLst (ссылки на другие листы) excelize
+// хранит отдельно — они остаются на месте и сдвигаются самим excelize.
+func (d *Document) detachDataValidations(st *sheetTemplate) ([]*excelize.DataValidation, error) {
+	all, err := d.f.GetDataValidations(st.name)
+	if err != nil || len(all) == 0 {
+		return nil, err
+	}
+	if err := d.f.DeleteDataValidation(st.name); err != nil {
+		return nil, err
+	}
+	rest, err := d.f.GetDataValidations(st.name)
+	if err != nil {
+		return nil, err
+	}
+	// GetDataValidations перечисляет обычные проверки раньше проверок из extLst
+	return all[:len(all)-len(rest)], nil
+}
+
+// applyDataValidations восстанавливает проверки данных по итоговой раскладке: диапазоны
+// на шаблонных строках растягиваются на все порождённые строки, остальные сдвигаются
+func (d *Document) applyDataValidations(st *sheetTemplate, l *sheetLayout, dvs []*excelize.DataValidation) error {
+	for _, dv := range dvs {
+		sqref := l.mapSqref(dv.Sqref)
+		if sqref == "" {
+			continue
+		}
+		delta := sqrefTop(sqref) - sqrefTop(dv.Sqref)
+		ndv := *dv
+		ndv.Sqref = sqref
+		ndv.Formula1 = escapeDataValidationFormula(l, dv.Formula1, delta)
+		ndv.Formula2 = escapeDataValidationFormula(l, dv.Formula2, delta)
+		if err := d.f.AddDataValidation(st.name, &ndv); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// escapeDataValidationFormula переносит формулу проверки и возвращает её в виде,
+// в котором AddDataValidation записывает её в XML. Список значений ("Да,Нет")
+// не содержит ссылок и только экранируется.
+func escapeDataValidationFormula(l *sheetLayout, formula string, delta int) string {
+	if formula == "" {
+		return formula
+	}
+	xml := strings.NewReplacer(`&`, `&amp;`, `<`, `&lt;`, `>`, `&gt;`)
+	if strings.HasPrefix(formula, `"`) && strings.HasSuffix(formula, `"`) && len(formula) >= 2 {
+		inner := formula[1 : len(formula)-1]
+		return `"` + strings.ReplaceAll(xml.Replace(inner), `"`, `""`) + `"`
+	}
+	return xml.Replace(l.mapAnchoredFormula(formula, delta))
+}
+
+// -----------------------------
+// Правила диапазонов: таблицы Excel (ListObjects)
+// -----------------------------
+
+// tableTpl — таблица листа (ListObject) в исходных координатах шаблона вместе с XML её части
+type tableTpl struct {
+	name   string
+	path   string // часть пакета: xl/tables/tableN.xml
+	xml    []byte
+	ref    string
+	header int // строк заголовка: headerRowCount, по умолчанию 1
+	totals int // строк итогов: totalsRowCount
+}
+
+// xmlTableAttrs — атрибуты корневого элемента части таблицы, нужные для раскладки
+type xmlTableAttrs struct {
+	Name           string `xml:"name,attr"`
+	Ref            string `xml:"ref,attr"`
+	HeaderRowCount *int   `xml:"headerRowCount,attr"`
+	TotalsRowCount int    `xml:"totalsRowCount,attr"`
+}
+
+var rxTableRef = regexp.MustCompile(`(\sref=")([^"]*)(")`)
+
+// detachTables прячет части таблиц листа от excelize до вставки строк и возвращает их
+// в исходных координатах. При сдвиге строк excelize пересобирает таблицу: сбрасывает
+// строку итогов, переписывает столбцы, а таблицу без заголовка или с одним заголовком
+// удаляет целиком. Часть, которой нет в пакете, он пропускает, поэтому XML таблиц
+// сохраняется как есть, а после рендера в нём меняются только диапазоны (applyTables).
+func (d *Document) detachTables(st *sheetTemplate) ([]tableTpl, error) {
+	list, err := d.f.GetTables(st.name)
+	if err != nil || len(list) == 0 {
+		return nil, err
+	}
+	names := make(map[string]bool, len(list))
+	for _, tbl := range list {
+		names[tbl.Name] = true
+	}
+	var tables []tableTpl
+	d.f.Pkg.Range(func(k, v interface{}) bool {
+		path := k.(string)
+		data, ok := v.([]byte)
+		if !ok || !strings.HasPrefix(path, "xl/tables/") || !strings.HasSuffix(path, ".xml") {
+			return true
+		}
+		var attrs xmlTableAttrs
+		if err = xml.Unmarshal(data, &attrs); err != nil {
+			return false
+		}
+		if !names[attrs.Name] {
+			return true
+		}
+		t := tableTpl{name: attrs.Name, path: path, xml: data, ref: attrs.Ref, header: 1, totals: attrs.TotalsRowCount}
+		if attrs.HeaderRowCount != nil {
+			t.header = *attrs.HeaderRowCount
+		}
+		tables = append(tables, t)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(tables, func(i, j int) bool { return tables[i].path < tables[j].path })
+	for _, t := range tables {
+		d.f.Pkg.Delete(t.path)
+	}
+	return tables, nil
+}
+
+// restoreTables возвращает в пакет исходные части таблиц, если рендер листа прервался
+func (d *Document) restoreTables(tables []tableTpl) {
+	for _, t := range tables {
+		if _, ok := d.f.Pkg.Load(t.path); !ok {
+			d.f.Pkg.Store(t.path, t.xml)
+		}
+	}
+}
+
+// keepTableRows оставляет на листе по одной удаляемой строке под заголовком каждой
+// таблицы, от строк данных которой после рендера ничего не осталось: строка очищается
+// и становится пустой строкой данных. Без неё Excel не считает таблицу корректной,
+// а растянуть таблицу на следующую строку листа нельзя — там итоги или подписи.
+// Позиции — до удаления строк; возвращается toDelete без оставленных строк.
+func (d *Document) keepTableRows(st *sheetTemplate, tables []tableTpl, rowPos map[int]int, toDelete []int) ([]int, error) {
+	del := make(map[int]bool, len(toDelete))
+	for _, p := range toDelete {
+		del[p] = true
+	}
+	var keep []int
+	for _, tbl := range tables {
+		_, r1, _, r2, err := rangeBounds(tbl.ref)
+		if err != nil {
+			return nil, err
+		}
+		// строки ниже области шаблона не удаляются; таблица без строк данных
+		if r2 > st.maxRow || r2-tbl.totals < r1+tbl.header {
+			continue
+		}
+		p1, p2 := rowPos[r1]+tbl.header, rowPos[r2]
+		if tbl.totals > 0 {
+			p2 = rowPos[r2-tbl.totals+1] - 1
+		}
+		empty := true
+		for p := p1; p <= p2 && empty; p++ {
+			empty = del[p]
+		}
+		if empty {
+			del[p1] = false
+			keep = append(keep, p1)
+		}
+	}
+	if len(keep) == 0 {
+		return toDelete, nil
+	}
+	rows, err := d.f.GetRows(st.name)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range keep {
+		if p > len(rows) {
+			continue
+		}
+		for c, v := range rows[p-1] {
+			if v == "" {
+				continue
+			}
+			addr, _ := excelize.CoordinatesToCellName(c+1, p)
+			if err := d.f.SetCellValue(st.name, addr, ""); err != nil {
+				return nil, err
+			}
+		}
+	}
+	out := toDelete[:0]
+	for _, p := range toDelete {
+		if del[p] {
+			out = append(out, p)
+		}
+	}
+	return out, nil
+}
+
+// applyTables возвращает части таблиц в пакет с диапазонами по итоговой раскладке.
+// Таблица, задевающая строки блоков, охватывает заголовок, все порождённые строки и
+// итоги, строки управляющих маркеров из неё выпадают; под заголовком пустого блока
+// остаётся пустая строка данных (см. keepTableRows). Остальные таблицы только
+// сдвигаются. Всё прочее в XML таблицы (итоги, вычисляемые столбцы, фильтры) не меняется.
+func (d *Document) applyTables(st *sheetTemplate, l *sheetLayout, tables []tableTpl) error {
+	for _, tbl := range tables {
+		_, r1, _, r2, err := rangeBounds(tbl.ref)
+		if err != nil {
+			return err
+		}
+		block := false
+		for r := r1; r <= r2 && r <= st.maxRow && !block; r++ {
+			block = l.isTpl(r) || l.isDeleted(r)
+		}
+		var mapRow func(r int, end bool) int
+		if block {
+			runs := l.mapRows(r1, r2)
+			if len(runs) == 0 {
+				// от таблицы не осталось ни одной строки — удаляем её как обычно
+				d.f.Pkg.Store(tbl.path, tbl.xml)
+				if err := d.f.DeleteTable(tbl.name); err != nil {
+					return err
+				}
+				continue
+			}
+			top, bottom := runs[0][0], runs[len(runs)-1][1]
+			if bottom < top+tbl.header+tbl.totals {
+				bottom = top + tbl.header + tbl.totals
+			}
+			mapRow = func(r int, end bool) int {
+				switch {
+				case r < r1+tbl.header:
+					return top + r - r1
+				case r > r2-tbl.totals:
+					return bottom - (r2 - r)
+				case end:
+					return bottom - tbl.totals
+				}
+				return top + tbl.header
+			}
+		} else {
+			delta := l.staticRow(r1) - r1
+			mapRow = func(r int, _ bool) int { return r + delta }
+		}
+		if mapRow(r1, false) == r1 && mapRow(r2, true) == r2 {
+			d.f.Pkg.Store(tbl.path, tbl.xml)
+			continue
+		}
+		out := rxTableRef.ReplaceAllFunc(tbl.xml, func(m []byte) []byte {
+			sub := rxTableRef.FindSubmatch(m)
+			ref := string(sub[2])
+			c1, ra, c2, rb, err := rangeBounds(ref)
+			if err != nil {
+				return m
+			}
+			from, _ := excelize.CoordinatesToCellName(c1, mapRow(ra, false))
+			to, _ := excelize.CoordinatesToCellName(c2, mapRow(rb, true))
+			if strings.Contains(ref, ":") {
+				from += ":" + to
+			}
+			return []byte(string(sub[1]) + from + string(sub[3]))
+		})
+		d.f.Pkg.Store(tbl.path, out)
+	}
+	return nil
+}
+
+// rangeBounds разбирает диапазон вида A1:C10 (или одну ячейку) в координаты углов
+func rangeBounds(ref string) (c1, r1, c2, r2 int, err error) {
+	from, to := ref, ref
+	if i := strings.Index(ref, ":"); i >= 0 {
+		from, to = ref[:i], ref[i+1:]
+	}
+	if c1, r1, err = excelize.CellNameToCoordinates(from); err != nil {
+		return
+	}
+	c2, r2, err = excelize.CellNameToCoordinates(to)
+	return
+}
@@ -0,0 +1,288 @@
+package exceltemplar
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// -----------------------------
+// Цикл по листам (sheet-each)
+// -----------------------------
+
+var (
+	rxCtrlSheetEach = regexp.MustCompile(`^\{\{#sheet-each\s+(.+?)\}\}$`)
+	// name= — последний параметр: выражение занимает всё до закрывающих }}
+	rxSheetEachName = regexp.MustCompile(`(?:^|\s)name=\s*(.+)$`)
+	// связь листа с частью рисунков (но не vmlDrawing примечаний)
+	rxDrawingRel = regexp.MustCompile(`<Relationship\s[^>]*relationships/drawing"[^>]*?(?:/>|></Relationship>)`)
+	// символы, запрещённые Excel в имени листа
+	rxSheetNameBad = regexp.MustCompile(`[:\\/?*\[\]]`)
+)
+
+// maxSheetName — максимальная длина имени листа в Excel
+const maxSheetName = 31
+
+// sheetLoop — директива {{#sheet-each path as $item i=$i name=expr}} в ячейке A1:
+// лист-шаблон копируется для каждого элемента массива. Выражение имени может содержать
+// пробелы и фильтры (name=$o.city + " " + $o.code), поэтому name= пишется последним.
+type sheetLoop struct {
+	path     string
+	itemVar  string
+	indexVar string
+	nameExpr string
+	optional bool
+}
+
+func parseSheetEachHeader(src string) *sheetLoop {
+	sl := &sheetLoop{}
+	if m := rxSheetEachName.FindStringSubmatch(src); len(m) == 2 {
+		sl.nameExpr = strings.TrimSpace(m[1])
+		src = strings.Replace(src, m[0], "", 1)
+	}
+	sl.path, sl.itemVar, sl.indexVar = parseEachHeader(src)
+	sl.path, sl.optional = splitOptional(sl.path)
+	return sl
+}
+
+// renderSheetEach создаёт копию листа-шаблона для каждого элемента массива, рендерит
+// каждую копию со связанной переменной элемента и удаляет сам шаблон. Копии
+// встают на место шаблона в порядке элементов.
+func (d *Document) renderSheetEach(st *sheetTemplate, ctx *evalContext) error {
+	f := d.f
+	items, err := loopItems(ctx, "sheet-each", st.sheetLoop.path, st.sheetLoop.optional)
+	if err != nil {
+		// в режиме сбора ошибок копий нет, как для пустого массива
+		if err := d.report.add(errorAt(err, CodeEval, TemplateError{Sheet: st.name, Cell: "A1", Expr: st.sheetLoop.path, Path: ctx.iter})); err != nil {
+			return err
+		}
+	}
+	base := iterPath(ctx, st.sheetLoop.path)
+	tplIdx, err := f.GetSheetIndex(st.name)
+	if err != nil {
+		return err
+	}
+	activeName := f.GetSheetName(f.GetActiveSheetIndex())
+	// MoveSheet не пересчитывает привязку имён к листам, поэтому имена уровня листа
+	// (область печати, сквозные строки) снимаем и восстанавливаем после перестановки
+	localNames, err := detachLocalNames(f)
+	if err != nil {
+		return err
+	}
+
+	used := make(map[string]bool)
+	for _, name := range f.GetSheetList() {
+		if name != st.name {
+			used[strings.ToLower(name)] = true
+		}
+	}
+	layout, err := f.GetPageLayout(st.name)
+	if err != nil {
+		return err
+	}
+	pictures, err := sheetPictures(f, st.name)
+	if err != nil {
+		return err
+	}
+	copies := make([]string, 0, len(items))
+	for i, item := range items {
+		ictx := &evalContext{current: item, parent: ctx, root: ctx.root, exprs: ctx.exprs, strict: ctx.strict, images: ctx.images, vars: map[string]interface{}{},
+			iter: base + "[" + strconv.Itoa(i) + "]", iterVar: st.sheetLoop.itemVar}
+		for k, v := range ctx.vars {
+			ictx.vars[k] = v
+		}
+		if st.sheetLoop.itemVar != "" {
+			ictx.vars[st.sheetLoop.itemVar] = item
+		}
+		if st.sheetLoop.indexVar != "" {
+			ictx.vars[st.sheetLoop.indexVar] = float64(i)
+		}
+		var title string
+		if st.sheetLoop.nameExpr != "" {
+			v, err := evalScalar(ictx, st.sheetLoop.nameExpr)
+			if err != nil {
+				// в режиме сбора ошибок лист получает имя по умолчанию
+				if err := d.report.add(errorAt(err, CodeEval, TemplateError{Sheet: st.name, Cell: "A1", Expr: st.sheetLoop.nameExpr, Path: ictx.iter})); err != nil {
+					return err
+				}
+			}
+			title = toString(v)
+		}
+		name := sanitizeSheetName(title, st.name+" "+strconv.Itoa(i+1), used)
+		used[strings.ToLower(name)] = true
+
+		idx, err := f.NewSheet(name)
+		if err != nil {
+			return err
+		}
+		if err := f.CopySheet(tplIdx, idx); err != nil {
+			return err
+		}
+		dropDrawingRels(f, name)
+		// CopySheet не переносит параметры страницы и рисунки (логотипы и т. п.)
+		if err := f.SetPageLayout(name, &layout); err != nil {
+			return err
+		}
+		for _, cp := range pictures {
+			pic := cp.pic
+			if err := f.AddPictureFromBytes(name, cp.cell, &pic); err != nil {
+				return err
+			}
+		}
+		if err := f.MoveSheet(name, st.name); err != nil {
+			return err
+		}
+		tplIdx, _ = f.GetSheetIndex(st.name)
+		copies = append(copies, name)
+
+		cst := *st
+		cst.name = name
+		if err := d.renderSheetTo(&cst, ictx); err != nil {
+			return errorAt(err, CodeEval, TemplateError{Sheet: name})
+		}
+	}
+
+	if len(copies) == 0 {
+		// Пустой массив: в книге должен остаться хотя бы один лист
+		if len(f.GetSheetList()) == 1 {
+			placeholder := sanitizeSheetName("", "Sheet", used)
+			if _, err := f.NewSheet(placeholder); err != nil {
+				return err
+			}
+			if err := f.MoveSheet(placeholder, st.name); err != nil {
+				return err
+			}
+			copies = append(copies, placeholder)
+		}
+	}
+	if err := f.DeleteSheet(st.name); err != nil {
+		return err
+	}
+	if activeName == st.name && len(copies) > 0 {
+		activeName = copies[0]
+	}
+	if idx, err := f.GetSheetIndex(activeName); err == nil && idx >= 0 {
+		f.SetActiveSheet(idx)
+	}
+
+	for _, dn := range localNames {
+		if dn.Scope != st.name {
+			if err := f.SetDefinedName(&dn); err != nil {
+				return err
+			}
+			continue
+		}
+		for _, name := range copies {
+			cp := dn
+			cp.Scope = name
+			cp.RefersTo = retargetSheetRefs(dn.RefersTo, st.name, name)
+			if err := f.SetDefinedName(&cp); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// cellPicture — рисунок листа с ячейкой привязки
+type cellPicture struct {
+	cell string
+	pic  excelize.Picture
+}
+
+// sheetPictures возвращает рисунки листа в порядке ячеек привязки
+func sheetPictures(f *excelize.File, sheet string) ([]cellPicture, error) {
+	cells, err := f.GetPictureCells(sheet)
+	if err != nil {
+		return nil, err
+	}
+	var out []cellPicture
+	for _, cell := range cells {
+		pics, err := f.GetPictures(sheet, cell)
+		if err != nil {
+			return nil, err
+		}
+		for _, pic := range pics {
+			out = append(out, cellPicture{cell: cell, pic: pic})
+		}
+	}
+	return out, nil
+}
+
+// dropDrawingRels убирает из связей копии листа ссылку на рисунки шаблона: CopySheet
+// копирует связи целиком, а сами рисунки — нет, и после удаления шаблона ссылка
+// повисла бы. Рисунки копии добавляются заново (sheetPictures).
+func dropDrawingRels(f *excelize.File, sheet string) {
+	for id, name := range f.GetSheetMap() {
+		if name != sheet {
+			continue
+		}
+		path := "xl/worksheets/_rels/sheet" + strconv.Itoa(id) + ".xml.rels"
+		if rels, ok := f.Pkg.Load(path); ok {
+			f.Pkg.Store(path, rxDrawingRel.ReplaceAll(rels.([]byte), nil))
+		}
+	}
+}
+
+// detachLocalNames удаляет из книги имена, привязанные к листам, и возвращает их
+func detachLocalNames(f *excelize.File) ([]excelize.DefinedName, error) {
+	var local []excelize.DefinedName
+	for _, dn := range f.GetDefinedName() {
+		if dn.Scope == "" || dn.Scope == "Workbook" {
+			continue
+		}
+		if err := f.DeleteDefinedName(&excelize.DefinedName{Name: dn.Name, Scope: dn.Scope}); err != nil {
+			return nil, err
+		}
+		local = append(local, dn)
+	}
+	return local, nil
+}
+
+// retargetSheetRefs заменяет в формуле ссылки на лист from ссылками на лист to
+func retargetSheetRefs(formula, from, to string) string {
+	return rewriteFormulaRefs(formula, func(ref formulaRef) string {
+		if ref.sheet != "" && ref.sameSheet(from) {
+			ref.sheet = to
+		}
+		return ref.String()
+	})
+}
+
+// sanitizeSheetName приводит имя к правилам Excel: не длиннее 31 символа, без символов
+// : \ / ? * [ ], без апострофа по краям и уникально без учёта регистра среди used.
+// Пустое имя заменяется на fallback.
+func sanitizeSheetName(name, fallback string, used map[string]bool) string {
+	clean := func(s string) string {
+		s = truncateRunes(strings.TrimSpace(rxSheetNameBad.ReplaceAllString(s, "_")), maxSheetName)
+		return strings.TrimSpace(strings.Trim(s, "'"))
+	}
+	name = clean(name)
+	if name == "" {
+		name = clean(fallback)
+	}
+	// "History" зарезервировано Excel
+	if strings.EqualFold(name, "History") {
+		name += "_"
+	}
+	if !used[strings.ToLower(name)] {
+		return name
+	}
+	for n := 2; ; n++ {
+		suffix := " (" + strconv.Itoa(n) + ")"
+		cand := strings.TrimRight(truncateRunes(name, maxSheetName-utf8.RuneCountInString(suffix)), " '") + suffix
+		if !used[strings.ToLower(cand)] {
+			return cand
+		}
+	}
+}
+
+func truncateRunes(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n])
+}
@@ -0,0 +1,108 @@
+package exceltemplar
+
+import (
+	"fmt"
+	"strings"
+)
+
+// -----------------------------
+// Строгий режим: отсутствующие данные — ошибка рендера
+// -----------------------------
+
+// Strict включает строгий режим: ненайденный путь, неизвестная переменная ($itme.name),
+// each по не-массиву и each-obj по не-объекту возвращают ошибку вместо пустого значения.
+// Значения, которых может не быть, помечаются знаком ? в конце: {{= $.note ?}},
+// {{#if $.discount ?}}, {{#each $.items? as $it}}.
+// Strict вызывается до рендера и не должен выполняться одновременно с Execute.
+func (t *Template) Strict(strict bool) { t.strict = strict }
+
+// splitOptional отделяет от выражения или пути маркер необязательного значения ?
+// в конце (?? — оператор expr-lang, маркером не считается)
+func splitOptional(s string) (string, bool) {
+	t := strings.TrimSpace(s)
+	if !strings.HasSuffix(t, "?") || strings.HasSuffix(t, "??") {
+		return s, false
+	}
+	return strings.TrimSpace(t[:len(t)-1]), true
+}
+
+// optionalCtx отключает строгий режим для значения, помеченного ?
+func optionalCtx(ctx *evalContext, optional bool) *evalContext {
+	if !optional || !ctx.strict {
+		return ctx
+	}
+	c := *ctx
+	c.strict = false
+	return &c
+}
+
+// missingPathError объясняет, почему путь не найден: необъявленная переменная или нет данных
+func missingPathError(ctx *evalContext, path string) *TemplateError {
+	path = strings.TrimSpace(path)
+	if strings.HasPrefix(path, "$") && !strings.HasPrefix(path, "$.") && path != "$" && !strings.HasPrefix(path, "$root") {
+		name, _ := splitFirst(path[1:], ".")
+		if i := strings.IndexByte(name, '['); i >= 0 {
+			name = name[:i]
+		}
+		if _, ok := ctx.vars["$"+name]; !ok {
+			return codeError(CodeUnknownVar, "неизвестная переменная $%s в пути %s", name, path)
+		}
+	}
+	return codeError(CodeMissingPath, "путь %s не найден", path)
+}
+
+// loopItems возвращает элементы массива для each, each-col и sheet-each. Без строгого
+// режима отсутствующий путь и не-массив дают пустой цикл; null считается пустым массивом.
+func loopItems(ctx *evalContext, kind, path string, optional bool) ([]interface{}, error) {
+	v, ok := resolvePath(ctx, path)
+	strict := ctx.strict && !optional
+	if !ok {
+		if strict {
+			te := missingPathError(ctx, path)
+			te.Err = fmt.Errorf("%s %s: %w", kind, path, te.Err)
+			return nil, te
+		}
+		return nil, nil
+	}
+	arr, isArr := v.([]interface{})
+	if !isArr && v != nil && strict {
+		return nil, codeError(CodeLoopType, "%s %s: ожидается массив, получено %s", kind, path, describeValue(v))
+	}
+	return arr, nil
+}
+
+// loopObject возвращает объект для each-obj по тем же правилам, что и loopItems
+func loopObject(ctx *evalContext, path string, optional bool) (map[string]interface{}, error) {
+	v, ok := resolvePath(ctx, path)
+	strict := ctx.strict && !optional
+	if !ok {
+		if strict {
+			te := missingPathError(ctx, path)
+			te.Err = fmt.Errorf("each-obj %s: %w", path, te.Err)
+			return nil, te
+		}
+		return nil, nil
+	}
+	m, isObj := v.(map[string]interface{})
+	if !isObj && v != nil && strict {
+		return nil, codeError(CodeLoopType, "each-obj %s: ожидается объект, получено %s", path, describeValue(v))
+	}
+	return m, nil
+}
+
+// describeValue называет тип значения JSON для сообщений об ошибках
+func describeValue(v interface{}) string {
+	switch v.(type) {
+	case []interface{}:
+		return "массив"
+	case map[string]interface{}:
+		return "объект"
+	case string:
+		return "строка"
+	case float64:
+		return "число"
+	case bool:
+		return "логическое значение"
+	}
+	return fmt.Sprintf("%T", v)
+}
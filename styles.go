@@ -0,0 +1,216 @@
+package exceltemplar
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// -----------------------------
+// Стили ячеек: числовой формат из выражения {{= expr :fmt "0.00%"}}
+// -----------------------------
+
+// rxNumFmt выделяет суффикс :fmt "формат" (или 'формат', или формат без кавычек) в конце выражения
+var rxNumFmt = regexp.MustCompile(`^([\s\S]*?)\s+:fmt\s+([\s\S]+?)$`)
+
+// splitNumFmt отделяет от выражения числовой формат Excel. Формат в двойных кавычках
+// понимает экранирование Go ("\"руб.\""), в одинарных записывается как есть ('#,##0" ₽"').
+func splitNumFmt(expr string) (string, string) {
+	m := rxNumFmt.FindStringSubmatch(expr)
+	if m == nil || strings.TrimSpace(m[1]) == "" {
+		return expr, ""
+	}
+	nf := strings.TrimSpace(m[2])
+	switch {
+	case len(nf) >= 2 && nf[0] == '"' && nf[len(nf)-1] == '"':
+		if s, err := strconv.Unquote(nf); err == nil {
+			nf = s
+		}
+	case len(nf) >= 2 && nf[0] == '\'' && nf[len(nf)-1] == '\'':
+		nf = nf[1 : len(nf)-1]
+	}
+	return m[1], nf
+}
+
+// -----------------------------
+// Стили ячеек: именованные стили {{style expr}}
+// -----------------------------
+
+// styleSheetName — лист с именованными стилями: текст ячейки — имя стиля, её оформление —
+// сам стиль. Лист не рендерится и удаляется из результата.
+const styleSheetName = "_styles"
+
+// rxStyle — директива {{style expr}}: выражение возвращает имя стиля, несколько имён
+// через пробел или пустую строку (стиль шаблона без изменений)
+var rxStyle = regexp.MustCompile(`\{\{style\s+([\s\S]+?)\s*\}\}`)
+
+// splitStyleDirectives убирает из текста ячейки директивы {{style expr}} и возвращает их выражения
+func splitStyleDirectives(s string) (string, []string) {
+	ms := rxStyle.FindAllStringSubmatch(s, -1)
+	if len(ms) == 0 {
+		return s, nil
+	}
+	exprs := make([]string, len(ms))
+	for i, m := range ms {
+		exprs[i] = m[1]
+	}
+	return rxStyle.ReplaceAllString(s, ""), exprs
+}
+
+// readStyleSheet читает именованные стили с листа _styles
+func readStyleSheet(f *excelize.File) (map[string]*excelize.Style, error) {
+	rows, err := f.GetRows(styleSheetName)
+	if err != nil {
+		return nil, err
+	}
+	styles := make(map[string]*excelize.Style)
+	for r, row := range rows {
+		for c, name := range row {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			if err := checkStyleName(name); err != nil {
+				return nil, err
+			}
+			addr, _ := excelize.CoordinatesToCellName(c+1, r+1)
+			sid, err := f.GetCellStyle(styleSheetName, addr)
+			if err != nil {
+				return nil, err
+			}
+			style, err := f.GetStyle(sid)
+			if err != nil {
+				return nil, err
+			}
+			styles[name] = style
+		}
+	}
+	return styles, nil
+}
+
+func checkStyleName(name string) error {
+	if name == "" || strings.ContainsAny(name, " \t\r\n") {
+		return fmt.Errorf("стиль %q: имя не должно быть пустым или содержать пробелы", name)
+	}
+	return nil
+}
+
+// Styles добавляет именованные стили для директивы {{style expr}}; одноимённые стили
+// листа _styles заменяются. Стиль накладывается на стиль шаблонной ячейки: заданные
+// в нём поля (шрифт, заливка, границы, формат) переопределяют поля шаблона.
+// Styles вызывается до рендера и не должен выполняться одновременно с Execute.
+func (t *Template) Styles(styles map[string]*excelize.Style) error {
+	merged := make(map[string]*excelize.Style, len(t.styles)+len(styles))
+	for name, st := range t.styles {
+		merged[name] = st
+	}
+	for name, st := range styles {
+		if err := checkStyleName(name); err != nil {
+			return err
+		}
+		if st == nil {
+			return fmt.Errorf("стиль %q: пустое описание", name)
+		}
+		merged[name] = st
+	}
+	t.styles = merged
+	return nil
+}
+
+// styleNames приводит результат выражения {{style}} к списку имён стилей
+func styleNames(v interface{}) []string {
+	return strings.Fields(toString(v))
+}
+
+// mergeStyle возвращает копию base с заданными (ненулевыми) полями overlay. Вложенные
+// структуры (шрифт, заливка, выравнивание) объединяются по полям, границы — по сторонам.
+func mergeStyle(base, overlay *excelize.Style) *excelize.Style {
+	out := *base
+	mergeFields(reflect.ValueOf(&out).Elem(), reflect.ValueOf(overlay).Elem())
+	if len(overlay.Border) > 0 {
+		borders := make([]excelize.Border, 0, len(base.Border)+len(overlay.Border))
+		for _, b := range base.Border {
+			replaced := false
+			for _, o := range overlay.Border {
+				replaced = replaced || o.Type == b.Type
+			}
+			if !replaced {
+				borders = append(borders, b)
+			}
+		}
+		out.Border = append(borders, overlay.Border...)
+	}
+	return &out
+}
+
+func mergeFields(dst, src reflect.Value) {
+	for i := 0; i < src.NumField(); i++ {
+		sf, df := src.Field(i), dst.Field(i)
+		if sf.IsZero() {
+			continue
+		}
+		switch {
+		case sf.Kind() == reflect.Struct:
+			mergeFields(df, sf)
+		case sf.Kind() == reflect.Ptr && sf.Elem().Kind() == reflect.Struct:
+			// указатели копируются, чтобы не изменять исходные стили
+			cp := reflect.New(sf.Elem().Type())
+			if !df.IsNil() {
+				cp.Elem().Set(df.Elem())
+			}
+			mergeFields(cp.Elem(), sf.Elem())
+			df.Set(cp)
+		default:
+			df.Set(sf)
+		}
+	}
+}
+
+// cellStyleKey — стиль шаблонной ячейки, числовой формат из :fmt и именованные стили
+type cellStyleKey struct {
+	base   int
+	numFmt string
+	names  string
+}
+
+// cellStyle возвращает стиль base с числовым форматом numFmt и наложенными именованными
+// стилями names. Стили создаются один раз на документ: все строки блока с одинаковым
+// образцом и одинаковым результатом {{style}} получают один и тот же стиль.
+func (d *Document) cellStyle(base int, numFmt string, names []string) (int, error) {
+	key := cellStyleKey{base: base, numFmt: numFmt, names: strings.Join(names, " ")}
+	if sid, ok := d.cellStyles[key]; ok {
+		return sid, nil
+	}
+	style := &excelize.Style{}
+	if base != 0 {
+		s, err := d.f.GetStyle(base)
+		if err != nil {
+			return 0, err
+		}
+		style = s
+	}
+	if numFmt != "" {
+		style.NumFmt = 0
+		style.CustomNumFmt = &numFmt
+	}
+	for _, name := range names {
+		ns, ok := d.styles[name]
+		if !ok {
+			return 0, codeError(CodeStyle, "неизвестный стиль %q", name)
+		}
+		style = mergeStyle(style, ns)
+	}
+	sid, err := d.f.NewStyle(style)
+	if err != nil {
+		return 0, err
+	}
+	if d.cellStyles == nil {
+		d.cellStyles = make(map[cellStyleKey]int)
+	}
+	d.cellStyles[key] = sid
+	return sid, nil
+}
@@ -1,15 +1,20 @@
 package exceltemplar
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/fs"
+	"os"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
-	expro "github.com/expr-lang/expr"
 	"github.com/xuri/excelize/v2"
 )
 
@@ -18,9 +23,16 @@ import (
 // - {{= expr}}
 // - {{#each path as $item i=$i}} ... {{/each}}
 // - {{#each-obj path as $k $v}} ... {{/each-obj}}
+// - {{#each-col path as $item i=$i}} ... {{/each-col}} (в строке-маркере, повтор колонок)
+// - {{#sheet-each path as $item i=$i name=expr}} (в A1, копия листа на каждый элемент)
 // - {{#if expr}} ... {{else}} ... {{/if}}
-// - функции: len(), exists(), join()
-// Внешний API сохранён: LoadTemplate, Render, Save.
+// - выражения на expr-lang (см. expr.go); функции: len(), exists(), join(), iif(), link(), image()
+// - фильтры {{= expr | name:arg}} (см. filters.go)
+// - числовой формат ячейки {{= expr :fmt "0.00%"}} (см. styles.go)
+// - именованные стили {{style expr}} с листа _styles или из Styles (см. styles.go)
+// - режим сбора ошибок: #ERR в ячейках и RenderReport вместо остановки (см. report.go)
+// - проверка шаблона без данных: Validate (см. lint.go); структура и пути: Outline (см. outline.go)
+// Внешний API: LoadTemplate/Compile → Execute → (*Document).Save; Render/Save сохранены.
 
 // -----------------------------
 // AST
@@ -39,6 +51,9 @@ type eachNode struct {
 	itemVar  string
 	indexVar string
 	children []node
+	// optional — путь помечен ? и может отсутствовать в строгом режиме
+	optional bool
+	at       cellPos
 }
 
 type eachObjNode struct {
@@ -46,12 +61,22 @@ type eachObjNode struct {
 	keyVar   string
 	valVar   string
 	children []node
+	optional bool
+	at       cellPos
 }
 
 type ifNode struct {
 	expr      string
 	thenNodes []node
 	elseNodes []node
+	optional  bool
+	at        cellPos
+}
+
+// cellPos — ячейка шаблона с директивой блока (для сообщений об ошибках)
+type cellPos struct {
+	cell string
+	raw  string
 }
 
 type cellTokenKind int
@@ -65,12 +90,18 @@ type cellToken struct {
 	kind cellTokenKind
 	text string
 	expr string
+	// numFmt — числовой формат Excel из суффикса :fmt "..."
+	numFmt string
+	// optional — значение помечено ? и может отсутствовать в строгом режиме
+	optional bool
 }
 
 type cellTpl struct {
 	col    int
 	raw    string
 	tokens []cellToken
+	// styles — выражения директив {{style expr}} ячейки
+	styles []string
 }
 
 type sheetTemplate struct {
@@ -79,27 +110,78 @@ type sheetTemplate struct {
 	minRow  int
 	maxRow  int
 	rowTpls map[int]rowTpl
+	// chains — цепочка циклов (each/each-obj), охватывающих шаблонную строку, от внешнего к внутреннему
+	chains map[int][]int
+	// ctrlChains — цепочка циклов для строк с маркерами блоков (внешний уровень блока)
+	ctrlChains map[int][]int
+	// merges — объединения, которые перестраиваются после рендера
+	merges []mergeTpl
+	// condFmts — условное форматирование листа (исходные диапазоны)
+	condFmts []condFmtTpl
+	// formulas — формулы статических ячеек (вне шаблонных строк): строка → колонка → формула
+	formulas map[int]map[int]string
+	// colLoops — циклы each-col по колонкам (упорядочены по колонкам)
+	colLoops []*colLoop
+	// colBind — переменные each-col для колонок листа после размножения колонок
+	colBind map[int]colBinding
+	// sheetLoop — директива sheet-each из A1: лист копируется для каждого элемента
+	sheetLoop *sheetLoop
+	// notes — замечания разбора для Validate (рендер их не использует)
+	notes []Issue
 }
 
+// Template — скомпилированный шаблон: разобранные листы и неизменяемый снимок книги.
+// Один Template можно рендерить сколько угодно раз, в том числе из разных горутин:
+// каждый вызов Execute открывает собственную копию книги.
 type Template struct {
-	f      *excelize.File
+	raw    []byte
 	sheets map[string]*sheetTemplate
+	// order — листы в порядке книги (рендер не зависит от порядка обхода map)
+	order []string
+	// exprs — компилятор выражений с пользовательскими функциями (см. Funcs)
+	exprs *exprSet
+	// styles — именованные стили для {{style expr}} (лист _styles и Styles)
+	styles map[string]*excelize.Style
+	// strict — строгий режим рендера (см. Strict)
+	strict bool
+	// images — файлы, доступные image() (см. ImageFS)
+	images fs.FS
+	// collect и errComments — режим сбора ошибок (см. CollectErrors, ErrorComments)
+	collect     bool
+	errComments bool
+
+	// mu и last обслуживают устаревшую пару Render/Save
+	mu   sync.Mutex
+	last *Document
 }
 
-// rowTpl описывает свойства шаблонной строки (стили, исходные значения, горизонтальные слияния)
+// rowTpl описывает свойства шаблонной строки (стили, исходные значения, формулы,
+// высоту, скрытие и уровень группировки)
 type rowTpl struct {
-	styles  map[int]int
-	rawVals map[int]string
-	merges  []struct {
-		startCol int
-		endCol   int
-	}
+	styles   map[int]int
+	rawVals  map[int]string
+	formulas map[int]string
+	height   float64 // 0 — высота по умолчанию
+	hidden   bool
+	outline  uint8
+	// numFmts — числовые форматы ячеек-выражений {{= expr :fmt "..."}}
+	numFmts map[int]string
+}
+
+// mergeTpl — объединение ячеек, затрагивающее шаблонные или управляющие строки.
+// После рендера оно заново строится по итоговой раскладке листа (см. sheetLayout.mergeRanges).
+type mergeTpl struct {
+	startCol, startRow int
+	endCol, endRow     int
 }
 
 // -----------------------------
 // Парсер листа
 // -----------------------------
 
+// maxCols — сколько колонок строки как минимум просматривается при сборе стилей, значений и формул
+const maxCols = 100
+
 var (
 	rxCtrlEach       = regexp.MustCompile(`^\{\{#each\s+(.+?)\}\}$`)
 	rxCtrlEachObj    = regexp.MustCompile(`^\{\{#each-obj\s+(.+?)\}\}$`)
@@ -112,19 +194,55 @@ var (
 	rxExpr = regexp.MustCompile(`\{\{=\s*([\s\S]+?)\s*\}\}`)
 )
 
-// LoadTemplate строит AST для каждого листа
+// LoadTemplate читает файл шаблона и компилирует его (см. Compile)
 func LoadTemplate(path string) (*Template, error) {
-	f, err := excelize.OpenFile(path)
+	raw, err := os.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
-	t := &Template{f: f, sheets: map[string]*sheetTemplate{}}
+	return Compile(raw)
+}
+
+// LoadTemplateFromReader читает шаблон из r (объектное хранилище, тело запроса и т.п.)
+func LoadTemplateFromReader(r io.Reader) (*Template, error) {
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return Compile(raw)
+}
+
+// LoadTemplateFS читает шаблон name из файловой системы fsys (например, embed.FS)
+func LoadTemplateFS(fsys fs.FS, name string) (*Template, error) {
+	raw, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	return Compile(raw)
+}
+
+// Compile строит AST для каждого листа книги raw (содержимое .xlsx).
+// Срез raw сохраняется как снимок книги и не должен изменяться после вызова.
+func Compile(raw []byte) (*Template, error) {
+	f, err := excelize.OpenReader(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	t := &Template{raw: raw, sheets: map[string]*sheetTemplate{}, exprs: &exprSet{}}
 	for _, sheet := range f.GetSheetList() {
+		if sheet == styleSheetName {
+			if t.styles, err = readStyleSheet(f); err != nil {
+				return nil, errorAt(err, CodeSyntax, TemplateError{Sheet: sheet})
+			}
+			continue
+		}
 		st, err := parseSheet(f, sheet)
 		if err != nil {
-			return nil, fmt.Errorf("парсинг листа %s: %w", sheet, err)
+			return nil, errorAt(err, CodeSyntax, TemplateError{Sheet: sheet})
 		}
 		t.sheets[sheet] = st
+		t.order = append(t.order, sheet)
 	}
 	return t, nil
 }
@@ -137,6 +255,7 @@ func parseSheet(f *excelize.File, sheet string) (*sheetTemplate, error) {
 	var nodes []node
 	type stackItem struct {
 		kind   string // each | each-obj | if
+		id     int    // номер цикла each/each-obj на листе
 		en     *eachNode
 		eo     *eachObjNode
 		in     *ifNode
@@ -144,6 +263,28 @@ func parseSheet(f *excelize.File, sheet string) (*sheetTemplate, error) {
 	}
 	var stack []stackItem
 	var minRow, maxRow int
+	var colLoops []*colLoop
+	var sl *sheetLoop
+	// chains — цепочки циклов для шаблонных строк, ctrlChains — для строк с маркерами
+	// (маркер относится к внешнему уровню своего блока)
+	chains := make(map[int][]int)
+	ctrlChains := make(map[int][]int)
+	blockID := 0
+	stackChain := func() []int {
+		var chain []int
+		for _, it := range stack {
+			if it.id > 0 {
+				chain = append(chain, it.id)
+			}
+		}
+		return chain
+	}
+
+	// notes — замечания для Validate: то, что разбор молча допускает
+	var notes []Issue
+	note := func(at cellPos, code ErrorCode, format string, args ...interface{}) {
+		notes = append(notes, Issue{Severity: SeverityWarning, Code: code, Sheet: sheet, Cell: at.cell, Raw: at.raw, Message: fmt.Sprintf(format, args...)})
+	}
 
 	appendNode := func(n node) {
 		if len(stack) == 0 {
@@ -155,71 +296,120 @@ func parseSheet(f *excelize.File, sheet string) (*sheetTemplate, error) {
 
 	for rIdx, row := range rows {
 		rowNum := rIdx + 1
+		// Директива цикла по листам — только в A1
+		if rowNum == 1 && len(row) > 0 {
+			if m := rxCtrlSheetEach.FindStringSubmatch(strings.TrimSpace(row[0])); len(m) == 2 {
+				for _, cell := range row[1:] {
+					if strings.TrimSpace(cell) != "" {
+						return nil, &TemplateError{Code: CodeSyntax, Cell: "A1", Raw: row[0], Err: errors.New("строка с sheet-each должна содержать только директиву")}
+					}
+				}
+				sl = parseSheetEachHeader(m[1])
+				minRow, maxRow = rowNum, rowNum
+				continue
+			}
+		}
+		// Маркеры циклов по колонкам занимают отдельную строку вне блоков
+		loops, err := parseColLoops(row, rowNum)
+		if err != nil {
+			return nil, err
+		}
+		if len(loops) > 0 {
+			if len(stack) > 0 {
+				return nil, &TemplateError{Code: CodeSyntax, Cell: cellName(loops[0].startCol, rowNum), Err: fmt.Errorf("each-col на строке %d должен располагаться вне блоков each/if", rowNum)}
+			}
+			colLoops = append(colLoops, loops...)
+			continue
+		}
 		// Контрольные маркеры
-		ctrl := false
-		for _, cell := range row {
+		ctrl, ctrlCol := false, -1
+		chainBefore := stackChain()
+		for cIdx, cell := range row {
 			trimmed := strings.TrimSpace(cell)
 			if trimmed == "" {
 				continue
 			}
+			at := cellPos{cell: cellName(cIdx+1, rowNum), raw: cell}
+			syntaxErr := func(format string, args ...interface{}) error {
+				return &TemplateError{Code: CodeSyntax, Cell: at.cell, Raw: at.raw, Err: fmt.Errorf(format, args...)}
+			}
 			if m := rxCtrlEach.FindStringSubmatch(trimmed); len(m) == 2 {
 				path, itemVar, indexVar := parseEachHeader(m[1])
-				en := &eachNode{path: path, itemVar: itemVar, indexVar: indexVar}
+				path, optional := splitOptional(path)
+				en := &eachNode{path: path, itemVar: itemVar, indexVar: indexVar, optional: optional, at: at}
 				en.children = []node{}
-				stack = append(stack, stackItem{kind: "each", en: en, target: &en.children})
-				ctrl = true
+				blockID++
+				stack = append(stack, stackItem{kind: "each", id: blockID, en: en, target: &en.children})
+				ctrl, ctrlCol = true, cIdx
 				break
 			}
 			if m := rxCtrlEachObj.FindStringSubmatch(trimmed); len(m) == 2 {
 				path, kVar, vVar := parseEachObjHeader(m[1])
-				eo := &eachObjNode{path: path, keyVar: kVar, valVar: vVar}
+				path, optional := splitOptional(path)
+				eo := &eachObjNode{path: path, keyVar: kVar, valVar: vVar, optional: optional, at: at}
 				eo.children = []node{}
-				stack = append(stack, stackItem{kind: "each-obj", eo: eo, target: &eo.children})
-				ctrl = true
+				blockID++
+				stack = append(stack, stackItem{kind: "each-obj", id: blockID, eo: eo, target: &eo.children})
+				ctrl, ctrlCol = true, cIdx
 				break
 			}
 			if m := rxCtrlIf.FindStringSubmatch(trimmed); len(m) == 2 {
-				in := &ifNode{expr: m[1]}
+				expr, optional := splitOptional(m[1])
+				in := &ifNode{expr: expr, optional: optional, at: at}
 				in.thenNodes = []node{}
 				stack = append(stack, stackItem{kind: "if", in: in, target: &in.thenNodes})
-				ctrl = true
+				ctrl, ctrlCol = true, cIdx
 				break
 			}
 			if rxCtrlElse.MatchString(trimmed) {
 				if len(stack) == 0 || stack[len(stack)-1].kind != "if" {
-					return nil, fmt.Errorf("некорректный else на строке %d", rowNum)
+					return nil, syntaxErr("некорректный else на строке %d", rowNum)
 				}
 				it := &stack[len(stack)-1]
 				it.target = &it.in.elseNodes
-				ctrl = true
+				ctrl, ctrlCol = true, cIdx
 				break
 			}
 			if rxCtrlEndEach.MatchString(trimmed) || rxCtrlEndEachObj.MatchString(trimmed) {
 				if len(stack) == 0 || (stack[len(stack)-1].kind != "each" && stack[len(stack)-1].kind != "each-obj") {
-					return nil, fmt.Errorf("некорректный /each на строке %d", rowNum)
+					return nil, syntaxErr("некорректный /each на строке %d", rowNum)
 				}
 				top := stack[len(stack)-1]
 				stack = stack[:len(stack)-1]
+				// /each и /each-obj закрывают любой из двух циклов; несовпадение отмечаем для Validate
+				if closer := strings.Trim(trimmed, "{}/"); closer != top.kind {
+					note(at, CodeBlockMismatch, "{{/%s}} закрывает блок %s", closer, top.kind)
+				}
 				if top.kind == "each" {
 					appendNode(top.en)
 				} else {
 					appendNode(top.eo)
 				}
-				ctrl = true
+				ctrl, ctrlCol = true, cIdx
 				break
 			}
 			if rxCtrlEndIf.MatchString(trimmed) {
 				if len(stack) == 0 || stack[len(stack)-1].kind != "if" {
-					return nil, fmt.Errorf("некорректный /if на строке %d", rowNum)
+					return nil, syntaxErr("некорректный /if на строке %d", rowNum)
 				}
 				top := stack[len(stack)-1]
 				stack = stack[:len(stack)-1]
 				appendNode(top.in)
-				ctrl = true
+				ctrl, ctrlCol = true, cIdx
 				break
 			}
 		}
 		if ctrl {
+			for cIdx, cell := range row {
+				if cIdx != ctrlCol && strings.TrimSpace(cell) != "" {
+					note(cellPos{cell: cellName(cIdx+1, rowNum), raw: cell}, CodeIgnoredCell, "строка с маркером блока остаётся в результате как есть: маркер и эта ячейка не вычисляются; вынесите содержимое на отдельную строку")
+				}
+			}
+			if chain := stackChain(); len(chain) < len(chainBefore) {
+				ctrlChains[rowNum] = chain
+			} else {
+				ctrlChains[rowNum] = chainBefore
+			}
 			if minRow == 0 || rowNum < minRow {
 				minRow = rowNum
 			}
@@ -233,10 +423,18 @@ func parseSheet(f *excelize.File, sheet string) (*sheetTemplate, error) {
 		var cells []cellTpl
 		has := false
 		for cIdx, cell := range row {
-			toks := parseCellTokens(cell)
-			if len(toks) > 0 {
+			text, styles := splitStyleDirectives(cell)
+			if strings.Contains(rxExpr.ReplaceAllString(text, ""), "{{") {
+				note(cellPos{cell: cellName(cIdx+1, rowNum), raw: cell}, CodeBadDirective, "текст {{ не распознан как директива и выводится как есть")
+			}
+			toks := parseCellTokens(text)
+			if len(toks) == 0 && len(styles) > 0 && text != "" {
+				// статический текст рядом с {{style}} выводится как есть
+				toks = []cellToken{{kind: tokenText, text: text}}
+			}
+			if len(toks) > 0 || len(styles) > 0 {
 				has = true
-				cells = append(cells, cellTpl{col: cIdx + 1, raw: cell, tokens: toks})
+				cells = append(cells, cellTpl{col: cIdx + 1, raw: cell, tokens: toks, styles: styles})
 			}
 		}
 		// Если строка внутри блока (each/if), учитываем даже статические строки,
@@ -244,6 +442,7 @@ func parseSheet(f *excelize.File, sheet string) (*sheetTemplate, error) {
 		if has || len(stack) > 0 {
 			rn := &rowNode{sheet: sheet, row: rowNum, cells: cells}
 			appendNode(rn)
+			chains[rowNum] = stackChain()
 			if minRow == 0 || rowNum < minRow {
 				minRow = rowNum
 			}
@@ -253,58 +452,129 @@ func parseSheet(f *excelize.File, sheet string) (*sheetTemplate, error) {
 		}
 	}
 	if len(stack) != 0 {
-		return nil, errors.New("несбалансированные блоки each/if")
+		// указываем самый внутренний незакрытый блок
+		top := stack[len(stack)-1]
+		at := cellPos{}
+		switch top.kind {
+		case "each":
+			at = top.en.at
+		case "each-obj":
+			at = top.eo.at
+		case "if":
+			at = top.in.at
+		}
+		return nil, &TemplateError{Code: CodeSyntax, Cell: at.cell, Raw: at.raw, Err: errors.New("несбалансированные блоки each/if")}
+	}
+	if err := checkColLoops(colLoops); err != nil {
+		return nil, err
 	}
-	// Собираем шаблонные строки (rowTpls) для устойчивого копирования стилей/значений/merge
+	// Собираем шаблонные строки (rowTpls) для устойчивого копирования стилей/значений/формул
 	rowTpls := make(map[int]rowTpl)
-	tplRowsSet := make(map[int]struct{})
-	var collectTplRows func([]node)
-	collectTplRows = func(ns []node) {
-		for _, n := range ns {
-			switch nn := n.(type) {
-			case *rowNode:
-				tplRowsSet[nn.row] = struct{}{}
-			case *eachNode:
-				collectTplRows(nn.children)
-			case *eachObjNode:
-				collectTplRows(nn.children)
-			case *ifNode:
-				collectTplRows(nn.thenNodes)
-				collectTplRows(nn.elseNodes)
-			}
+	// Для строки за пределами данных excelize возвращает высоту по умолчанию для листа
+	defaultHeight, err := f.GetRowHeight(sheet, excelize.TotalRows)
+	if err != nil {
+		return nil, err
+	}
+
+	// После размножения колонок (each-col) лист может быть шире maxCols
+	lastCol := maxCols
+	for _, row := range rows {
+		if len(row) > lastCol {
+			lastCol = len(row)
 		}
 	}
-	collectTplRows(nodes)
 
-	const maxCols = 100
-	for tplRow := range tplRowsSet {
-		rt := rowTpl{styles: make(map[int]int), rawVals: make(map[int]string)}
-		for col := 1; col <= maxCols; col++ {
+	for tplRow := range chains {
+		rt := rowTpl{styles: make(map[int]int), rawVals: make(map[int]string), formulas: make(map[int]string), numFmts: make(map[int]string)}
+		for col := 1; col <= lastCol; col++ {
 			addr, _ := excelize.CoordinatesToCellName(col, tplRow)
-			v, _ := f.GetCellValue(sheet, addr)
-			if v != "" {
+			if fm, _ := f.GetCellFormula(sheet, addr); fm != "" {
+				rt.formulas[col] = fm
+			} else if v, _ := f.GetCellValue(sheet, addr); v != "" {
 				rt.rawVals[col] = v
+				// Формат применяется к ячейке из единственного выражения: смешанный текст остаётся строкой
+				text, _ := splitStyleDirectives(v)
+				if toks := parseCellTokens(text); len(toks) == 1 && toks[0].numFmt != "" {
+					rt.numFmts[col] = toks[0].numFmt
+				}
 			}
 			if sid, err := f.GetCellStyle(sheet, addr); err == nil && sid != 0 {
 				rt.styles[col] = sid
 			}
 		}
-		merges, _ := f.GetMergeCells(sheet)
-		for _, m := range merges {
-			s := m.GetStartAxis()
-			e := m.GetEndAxis()
-			sc, sr, _ := excelize.SplitCellName(s)
-			ec, er, _ := excelize.SplitCellName(e)
-			if sr == tplRow && er == tplRow {
-				scn, _ := excelize.ColumnNameToNumber(sc)
-				ecn, _ := excelize.ColumnNameToNumber(ec)
-				rt.merges = append(rt.merges, struct{ startCol, endCol int }{startCol: scn, endCol: ecn})
-			}
+		if h, err := f.GetRowHeight(sheet, tplRow); err == nil && h != defaultHeight {
+			rt.height = h
+		}
+		if visible, err := f.GetRowVisible(sheet, tplRow); err == nil {
+			rt.hidden = !visible
+		}
+		if level, err := f.GetRowOutlineLevel(sheet, tplRow); err == nil {
+			rt.outline = level
 		}
 		rowTpls[tplRow] = rt
 	}
 
-	return &sheetTemplate{name: sheet, nodes: nodes, minRow: minRow, maxRow: maxRow, rowTpls: rowTpls}, nil
+	// Объединения, задевающие строки блоков: внутри тела блока повторяются в каждой итерации,
+	// пересекающие границу блока растягиваются на порождённые строки
+	var merges []mergeTpl
+	mcs, err := f.GetMergeCells(sheet)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range mcs {
+		sc, sr, _ := excelize.CellNameToCoordinates(m.GetStartAxis())
+		ec, er, _ := excelize.CellNameToCoordinates(m.GetEndAxis())
+		for r := sr; r <= er; r++ {
+			_, isTpl := chains[r]
+			_, isCtrl := ctrlChains[r]
+			if isTpl || isCtrl {
+				merges = append(merges, mergeTpl{startCol: sc, startRow: sr, endCol: ec, endRow: er})
+				break
+			}
+		}
+	}
+
+	condFmts, err := readCondFmts(f, sheet)
+	if err != nil {
+		return nil, err
+	}
+
+	// Формулы остальных ячеек листа: после рендера их ссылки на блоки будут растянуты
+	lastRow, err := sheetRowCount(f, sheet)
+	if err != nil {
+		return nil, err
+	}
+	formulas := make(map[int]map[int]string)
+	for r := 1; r <= lastRow; r++ {
+		if _, ok := rowTpls[r]; ok {
+			continue
+		}
+		for col := 1; col <= lastCol; col++ {
+			addr, _ := excelize.CoordinatesToCellName(col, r)
+			if fm, _ := f.GetCellFormula(sheet, addr); fm != "" {
+				if formulas[r] == nil {
+					formulas[r] = make(map[int]string)
+				}
+				formulas[r][col] = fm
+			}
+		}
+	}
+
+	return &sheetTemplate{name: sheet, nodes: nodes, minRow: minRow, maxRow: maxRow, rowTpls: rowTpls, chains: chains, ctrlChains: ctrlChains, merges: merges, condFmts: condFmts, formulas: formulas, colLoops: colLoops, sheetLoop: sl, notes: notes}, nil
+}
+
+// sheetRowCount возвращает номер последней строки листа, включая строки, где есть
+// только формулы без вычисленных значений (GetRows такие строки отбрасывает)
+func sheetRowCount(f *excelize.File, sheet string) (int, error) {
+	rows, err := f.Rows(sheet)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for rows.Next() {
+		n++
+	}
+	return n, rows.Close()
 }
 
 func parseCellTokens(s string) []cellToken {
@@ -323,7 +593,13 @@ func parseCellTokens(s string) []cellToken {
 		if start > last {
 			toks = append(toks, cellToken{kind: tokenText, text: s[last:start]})
 		}
-		toks = append(toks, cellToken{kind: tokenExpr, expr: strings.TrimSpace(s[es:ee])})
+		// маркер ? допускается и до, и после :fmt
+		expr, optional := splitOptional(s[es:ee])
+		expr, numFmt := splitNumFmt(strings.TrimSpace(expr))
+		if !optional {
+			expr, optional = splitOptional(expr)
+		}
+		toks = append(toks, cellToken{kind: tokenExpr, expr: expr, numFmt: numFmt, optional: optional})
 		last = end
 	}
 	if last < len(s) {
@@ -391,7 +667,17 @@ func parseEachObjHeader(src string) (path, keyVar, valVar string) {
 type renderRow struct {
 	sheet  string
 	tplRow int
-	values map[int]string
+	// values — значения ячеек: строка для смешанного текста либо типизированное
+	// значение (float64, bool, time.Time), если ячейка состоит из одного {{= expr}}
+	values map[int]interface{}
+	// styles — имена стилей из {{style expr}} по колонкам
+	styles map[int][]string
+	// errs — ошибки ячеек по колонкам (режим CollectErrors)
+	errs map[int][]error
+	// scope — идентификаторы итераций охватывающих циклов, от внешнего к внутреннему
+	scope []int
+	// iter — путь к элементу данных, из которого получена строка (для ошибок)
+	iter string
 }
 
 type evalContext struct {
@@ -399,6 +685,16 @@ type evalContext struct {
 	parent  *evalContext
 	root    []interface{}
 	vars    map[string]interface{}
+	// exprs — компилятор выражений шаблона (nil — без пользовательских функций)
+	exprs *exprSet
+	// strict — строгий режим: ненайденный путь — ошибка (см. Template.Strict)
+	strict bool
+	// images — файлы, доступные image() (см. Template.ImageFS)
+	images fs.FS
+	// iter — путь к текущему элементу данных ($.projects[3].tasks[1]), iterVar — переменная
+	// цикла, связанная с ним; используются в сообщениях об ошибках (см. iterPath)
+	iter    string
+	iterVar string
 }
 
 func resolvePath(ctx *evalContext, path string) (interface{}, bool) {
@@ -634,413 +930,289 @@ func toString(v interface{}) string {
 			return "true"
 		}
 		return "false"
+	case time.Time:
+		if vv.Hour() == 0 && vv.Minute() == 0 && vv.Second() == 0 && vv.Nanosecond() == 0 {
+			return vv.Format("2006-01-02")
+		}
+		return vv.Format("2006-01-02 15:04:05")
 	default:
 		return fmt.Sprintf("%v", vv)
 	}
 }
 
-func fnLen(ctx *evalContext, arg string) (float64, bool) {
-	v, ok := resolvePath(ctx, arg)
-	if !ok {
-		return 0, false
-	}
+// typedCellValue приводит результат выражения к значению, которое excelize запишет
+// нативным типом Excel: числа — числом, bool — логическим, time.Time — датой.
+// Остальные значения записываются строкой.
+func typedCellValue(v interface{}) interface{} {
 	switch vv := v.(type) {
-	case []interface{}:
-		return float64(len(vv)), true
-	case string:
-		return float64(len(vv)), true
-	case map[string]interface{}:
-		return float64(len(vv)), true
+	case nil:
+		return ""
+	case float64, bool, string, time.Time, cellLink, cellImage:
+		return vv
+	case float32:
+		return float64(vv)
+	case int:
+		return float64(vv)
+	case int64:
+		return float64(vv)
+	case int32:
+		return float64(vv)
 	default:
-		return 0, false
+		return toString(vv)
 	}
 }
 
-func fnExists(ctx *evalContext, arg string) bool {
-	_, ok := resolvePath(ctx, arg)
-	return ok
-}
+// -----------------------------
+// Рендер в память и применение к Excel
+// -----------------------------
 
-func fnJoin(ctx *evalContext, args []string) (string, error) {
-	if len(args) < 2 {
-		return "", fmt.Errorf("join: минимум 2 аргумента")
-	}
-	arrPath := strings.TrimSpace(args[0])
-	sep := strings.Trim(strings.TrimSpace(args[1]), "\"'")
-	var field string
-	if len(args) >= 3 {
-		field = strings.Trim(strings.TrimSpace(args[2]), "\"'")
-	}
-	v, ok := resolvePath(ctx, arrPath)
-	if !ok {
-		return "", nil
-	}
-	arr, ok := v.([]interface{})
-	if !ok {
-		return "", fmt.Errorf("join: не массив")
-	}
-	vals := make([]string, 0, len(arr))
-	for _, it := range arr {
-		var val interface{} = it
-		if field != "" {
-			if m, ok := it.(map[string]interface{}); ok {
-				if f, ok := drill(m, field); ok {
-					val = f
-				} else {
-					val = nil
-				}
-			} else {
-				val = nil
+// Funcs добавляет пользовательские функции, доступные в {{= }} и {{#if}}, и сразу
+// компилирует все выражения шаблона: неизвестные функции, неверное число аргументов
+// и несовместимые типы аргументов или результата возвращаются ошибкой с адресом ячейки.
+// Funcs вызывается до рендера и не должен выполняться одновременно с Execute.
+func (t *Template) Funcs(funcs FuncMap) error {
+	set, err := t.exprs.withFuncs(funcs)
+	if err != nil {
+		return err
+	}
+	for _, name := range t.order {
+		for _, e := range sheetExprs(t.sheets[name]) {
+			if _, err := set.compile(e.expr); err != nil {
+				return errorAt(err, CodeExpr, TemplateError{Sheet: name, Cell: e.cell, Raw: e.raw, Expr: e.expr})
 			}
 		}
-		vals = append(vals, toString(val))
 	}
-	return strings.Join(vals, sep), nil
+	t.exprs = set
+	return nil
 }
 
-func evalScalar(ctx *evalContext, expr string) (interface{}, error) {
-	expr = strings.TrimSpace(expr)
-	// функции
-	if strings.HasPrefix(expr, "iif(") && strings.HasSuffix(expr, ")") {
-		inner := strings.TrimSuffix(strings.TrimPrefix(expr, "iif("), ")")
-		args := splitArgs(inner)
-		// Требуем минимум 2 аргумента: cond, then [, else]
-		if len(args) < 2 {
-			return "", fmt.Errorf("iif: минимум 2 аргумента (cond, then[, else])")
-		}
-		condStr := args[0]
-		thenStr := args[1]
-		var elseStr string
-		if len(args) >= 3 {
-			elseStr = args[2]
-		}
-		cond, err := evalBool(ctx, condStr)
-		if err != nil {
-			return "", fmt.Errorf("iif: ошибка условия: %w", err)
-		}
-		if cond {
-			v, err := evalScalar(ctx, thenStr)
-			if err != nil {
-				return "", err
+// sheetExpr — выражение листа и ячейка, где оно записано
+type sheetExpr struct {
+	cell string
+	raw  string
+	expr string
+}
+
+// sheetExprs перечисляет выражения листа: вставки {{= }}, условия {{#if}} и имя sheet-each
+func sheetExprs(st *sheetTemplate) []sheetExpr {
+	var out []sheetExpr
+	if st.sheetLoop != nil && st.sheetLoop.nameExpr != "" {
+		out = append(out, sheetExpr{cell: "A1", expr: st.sheetLoop.nameExpr})
+	}
+	var walk func([]node)
+	walk = func(nodes []node) {
+		for _, n := range nodes {
+			switch nn := n.(type) {
+			case *rowNode:
+				for _, c := range nn.cells {
+					addr := cellName(c.col, nn.row)
+					for _, tk := range c.tokens {
+						if tk.kind == tokenExpr {
+							out = append(out, sheetExpr{cell: addr, raw: c.raw, expr: tk.expr})
+						}
+					}
+					for _, se := range c.styles {
+						out = append(out, sheetExpr{cell: addr, raw: c.raw, expr: se})
+					}
+				}
+			case *eachNode:
+				walk(nn.children)
+			case *eachObjNode:
+				walk(nn.children)
+			case *ifNode:
+				out = append(out, sheetExpr{cell: nn.at.cell, raw: nn.at.raw, expr: nn.expr})
+				walk(nn.thenNodes)
+				walk(nn.elseNodes)
 			}
-			return v, nil
-		}
-		v, err := evalScalar(ctx, elseStr)
-		if err != nil {
-			return "", err
 		}
-		return v, nil
-	}
-	if strings.HasPrefix(expr, "join(") && strings.HasSuffix(expr, ")") {
-		inner := strings.TrimSuffix(strings.TrimPrefix(expr, "join("), ")")
-		return fnJoin(ctx, splitArgs(inner))
-	}
-	if strings.HasPrefix(expr, "len(") && strings.Contains(expr, ")") {
-		arg := strings.TrimSuffix(strings.TrimPrefix(expr, "len("), ")")
-		l, _ := fnLen(ctx, arg)
-		return l, nil
-	}
-	if strings.HasPrefix(expr, "exists(") && strings.HasSuffix(expr, ")") {
-		arg := strings.TrimSuffix(strings.TrimPrefix(expr, "exists("), ")")
-		return fnExists(ctx, arg), nil
 	}
-	// арифметика вида $i+1
-	if strings.Contains(expr, "+") {
-		parts := strings.Split(expr, "+")
-		if len(parts) == 2 {
-			left := strings.TrimSpace(parts[0])
-			right := strings.TrimSpace(parts[1])
-			lv, _ := resolvePath(ctx, left)
-			li := toFloat(lv)
-			ri, _ := strconv.Atoi(right)
-			return li + float64(ri), nil
+	walk(st.nodes)
+	return out
+}
+
+// Execute рендерит данные outputs (JSON-строки) в новую копию книги и возвращает её.
+// Сам шаблон не изменяется, поэтому Execute безопасно вызывать конкурентно.
+func (t *Template) Execute(outputs []string) (*Document, error) {
+	// парсим outputs в корневые объекты
+	var roots []interface{}
+	for _, s := range outputs {
+		s = sanitizeJSONBlock(s)
+		if strings.TrimSpace(s) == "" {
+			continue
 		}
-	}
-	// литералы
-	if (strings.HasPrefix(expr, "\"") && strings.HasSuffix(expr, "\"")) || (strings.HasPrefix(expr, "'") && strings.HasSuffix(expr, "'")) {
-		return strings.Trim(expr, "\"'"), nil
-	}
-	if v, ok := resolvePath(ctx, expr); ok {
-		switch v.(type) {
-		case []interface{}, map[string]interface{}:
-			return nil, fmt.Errorf("скалярная вставка получила коллекцию; используйте each/join")
+		var v interface{}
+		if err := json.Unmarshal([]byte(s), &v); err == nil {
+			roots = append(roots, v)
 		}
-		return v, nil
-	}
-	if n, err := strconv.Atoi(expr); err == nil {
-		return float64(n), nil
 	}
-	return "", nil
+	return t.execute(roots)
 }
 
-func toFloat(v interface{}) float64 {
-	switch vv := v.(type) {
-	case float64:
-		return vv
-	case int:
-		return float64(vv)
-	case string:
-		n, _ := strconv.Atoi(vv)
-		return float64(n)
-	default:
-		return 0
+// ExecuteData рендерит значения Go (структуры, map, срезы, time.Time) без
+// промежуточного JSON. Имена полей берутся из тегов excel и json; даты остаются
+// датами. Каждый аргумент — отдельный корень данных, как строка в Execute.
+func (t *Template) ExecuteData(data ...interface{}) (*Document, error) {
+	roots := make([]interface{}, 0, len(data))
+	for i, v := range data {
+		root, err := goDataToRoot(v)
+		if err != nil {
+			return nil, codeError(CodeData, "данные %d: %w", i+1, err)
+		}
+		if root != nil {
+			roots = append(roots, root)
+		}
 	}
+	return t.execute(roots)
 }
 
-func evalBool(ctx *evalContext, expr string) (bool, error) {
-	// Трансформируем обращения вида $.a.b и $var.c[d] в path("...") для expr-lang
-	expr = transformBoolExprPaths(expr)
-	// Окружение с функциями, используемое как на этапе компиляции, так и выполнения
-	env := map[string]interface{}{
-		"len": func(x interface{}) float64 {
-			switch v := x.(type) {
-			case []interface{}:
-				return float64(len(v))
-			case string:
-				return float64(len(v))
-			case map[string]interface{}:
-				return float64(len(v))
-			default:
-				return 0
-			}
-		},
-		"exists": func(x interface{}) bool {
-			switch v := x.(type) {
-			case string:
-				_, ok := resolvePath(ctx, v)
-				return ok
-			default:
-				return truthy(v)
-			}
-		},
-		// Доступ к значениям по пути
-		"path": func(p string) interface{} {
-			if v, ok := resolvePath(ctx, p); ok {
-				return v
-			}
-			return nil
-		},
-		// Сокращение: $(".a.b") / $("$.x")
-		"$": func(p string) interface{} {
-			if v, ok := resolvePath(ctx, p); ok {
-				return v
-			}
-			return nil
-		},
-	}
-	// Полный парсинг булевых выражений через expr-lang с тем же env
-	program, err := expro.Compile(expr, expro.Env(env))
+func (t *Template) execute(roots []interface{}) (*Document, error) {
+	d, err := t.open()
 	if err != nil {
-		return false, err
+		return nil, err
 	}
-	out, err := expro.Run(program, env)
-	if err != nil {
-		return false, err
+	for _, name := range t.order {
+		st := t.sheets[name]
+		ctx := &evalContext{current: nil, parent: nil, root: roots, exprs: t.exprs, strict: t.strict, images: t.images, vars: map[string]interface{}{}}
+		if st.sheetLoop != nil {
+			err = d.renderSheetEach(st, ctx)
+		} else {
+			err = d.renderSheetTo(st, ctx)
+		}
+		if err = d.report.add(errorAt(err, CodeEval, TemplateError{Sheet: st.name})); err != nil {
+			_ = d.Close()
+			return nil, err
+		}
 	}
-	if b, ok := out.(bool); ok {
-		return b, nil
+	if rep := d.Report(); rep != nil {
+		return d, rep
 	}
-	return truthy(out), nil
+	return d, nil
 }
 
-// transformBoolExprPaths преобразует обращения вида $.a.b или $var.c[d] в path("...")
-// для корректной работы в expr-lang (который не знает нотацию $.). Обрабатывает только
-// участки вне кавычек и не затрагивает уже существующие вызовы path("...").
-func transformBoolExprPaths(src string) string {
-	if !strings.Contains(src, "$") {
-		return src
+// open открывает собственную копию книги из снимка шаблона
+func (t *Template) open() (*Document, error) {
+	f, err := excelize.OpenReader(bytes.NewReader(t.raw))
+	if err != nil {
+		return nil, err
 	}
-	var out strings.Builder
-	inQuote := byte(0)
-	i := 0
-	for i < len(src) {
-		ch := src[i]
-		if inQuote == 0 && (ch == '\'' || ch == '"') {
-			inQuote = ch
-			out.WriteByte(ch)
-			i++
-			continue
-		}
-		if inQuote != 0 {
-			out.WriteByte(ch)
-			if ch == inQuote {
-				inQuote = 0
-			}
-			i++
-			continue
-		}
-		if ch == '$' {
-			start := i
-			j := i + 1
-			// допускаем либо точку (для $.), либо имя переменной
-			if j < len(src) && src[j] == '.' {
-				j++
-			} else {
-				for j < len(src) && ((src[j] >= 'a' && src[j] <= 'z') || (src[j] >= 'A' && src[j] <= 'Z') || (src[j] == '_')) {
-					j++
-				}
-				if j < len(src) && src[j] == '.' {
-					j++
-				}
-			}
-			// продолжаем до первого символа, не относящегося к пути
-			k := j
-			for k < len(src) {
-				c := src[k]
-				if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '_' || c == '.' || c == '[' || c == ']' || c == '$' {
-					k++
-					continue
-				}
-				break
-			}
-			if k > start+1 {
-				path := src[start:k]
-				out.WriteString("path(\"")
-				out.WriteString(path)
-				out.WriteString("\")")
-				i = k
-				continue
-			}
+	// лист именованных стилей в результат не попадает
+	if idx, _ := f.GetSheetIndex(styleSheetName); idx >= 0 {
+		if err := f.DeleteSheet(styleSheetName); err != nil {
+			_ = f.Close()
+			return nil, err
 		}
-		out.WriteByte(ch)
-		i++
 	}
-	return out.String()
+	d := &Document{f: f, styles: t.styles, errComments: t.errComments}
+	if t.collect {
+		d.report = &RenderReport{}
+	}
+	return d, nil
 }
 
-// legacy helpers compare/toStringMaybe удалены как неиспользуемые
-
-func truthy(v interface{}) bool {
-	switch vv := v.(type) {
-	case nil:
-		return false
-	case bool:
-		return vv
-	case string:
-		return vv != ""
-	case []interface{}:
-		return len(vv) > 0
-	case map[string]interface{}:
-		return len(vv) > 0
-	case float64:
-		return vv != 0
-	default:
-		return true
+// Render рендерит данные и запоминает результат для Save.
+//
+// Deprecated: Render/Save хранят результат в самом шаблоне и не подходят для
+// конкурентного рендера; используйте Execute и (*Document).Save.
+func (t *Template) Render(outputs []string) error {
+	d, err := t.Execute(outputs)
+	if d != nil {
+		t.keep(d)
 	}
+	return err
 }
 
-func splitArgs(s string) []string {
-	var args []string
-	var b strings.Builder
-	quote := byte(0)
-	depth := 0 // глубина круглых скобок для вложенных вызовов (join(...), iif(...))
-	for i := 0; i < len(s); i++ {
-		ch := s[i]
-		if quote == 0 {
-			// Управление кавычками
-			if ch == '\'' || ch == '"' {
-				quote = ch
-				b.WriteByte(ch)
-				continue
-			}
-			// Учёт вложенных круглых скобок
-			if ch == '(' {
-				depth++
-				b.WriteByte(ch)
-				continue
-			}
-			if ch == ')' {
-				if depth > 0 {
-					depth--
-				}
-				b.WriteByte(ch)
-				continue
-			}
-			// Разделяем по запятым только на верхнем уровне
-			if ch == ',' && depth == 0 {
-				args = append(args, strings.TrimSpace(b.String()))
-				b.Reset()
-				continue
-			}
-			b.WriteByte(ch)
-			continue
-		}
-		// Внутри кавычек: копируем до закрытия
-		b.WriteByte(ch)
-		if ch == quote {
-			quote = 0
-		}
-	}
-	if b.Len() > 0 {
-		args = append(args, strings.TrimSpace(b.String()))
-	}
-	return args
+// RenderData — вариант Render для значений Go (см. ExecuteData); результат сохраняется
+// через Save/WriteTo. Для конкурентного рендера используйте ExecuteData.
+func (t *Template) RenderData(data ...interface{}) error {
+	d, err := t.ExecuteData(data...)
+	if d != nil {
+		t.keep(d)
+	}
+	return err
 }
 
-// -----------------------------
-// Рендер в память и применение к Excel
-// -----------------------------
+// keep запоминает результат рендера для Save/WriteTo
+func (t *Template) keep(d *Document) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.last != nil {
+		_ = t.last.Close()
+	}
+	t.last = d
+}
 
-func (t *Template) Render(outputs []string) error {
-	// парсим outputs в корневые объекты
-	var roots []interface{}
-	for _, s := range outputs {
-		s = sanitizeJSONBlock(s)
-		if strings.TrimSpace(s) == "" {
-			continue
-		}
-		var v interface{}
-		if err := json.Unmarshal([]byte(s), &v); err == nil {
-			roots = append(roots, v)
+// renderSheetTo рендерит лист st в контексте ctx и применяет результат к книге
+func (d *Document) renderSheetTo(st *sheetTemplate, ctx *evalContext) error {
+	if len(st.colLoops) > 0 {
+		var err error
+		if st, err = expandColumns(d.f, st, ctx, d.report); err != nil {
+			return err
 		}
 	}
-	for _, st := range t.sheets {
-		rendered, err := renderSheet(st, &evalContext{current: nil, parent: nil, root: roots, vars: map[string]interface{}{}})
-		if err != nil {
-			return fmt.Errorf("лист %s: %w", st.name, err)
-		}
-		if err := t.applyRendered(st, rendered); err != nil {
-			return fmt.Errorf("лист %s: %w", st.name, err)
-		}
+	rendered, err := renderSheet(st, ctx, d.report)
+	if err != nil {
+		return err
 	}
-	return nil
+	return d.applyRendered(st, rendered)
 }
 
-func renderSheet(st *sheetTemplate, ctx *evalContext) ([]renderRow, error) {
+// renderSheet вычисляет строки листа. С отчётом rep (режим CollectErrors) ошибки
+// записываются в него, а рендер продолжается; без отчёта первая ошибка прерывает рендер.
+func renderSheet(st *sheetTemplate, ctx *evalContext, rep *RenderReport) ([]renderRow, error) {
 	var out []renderRow
-	var walk func([]node, *evalContext) error
-	walk = func(nodes []node, ctx *evalContext) error {
+	iteration := 0
+	var walk func([]node, *evalContext, []int) error
+	walk = func(nodes []node, ctx *evalContext, scope []int) error {
 		for _, n := range nodes {
 			switch nn := n.(type) {
 			case *rowNode:
-				vals := map[int]string{}
+				vals := map[int]interface{}{}
+				var styles map[int][]string
+				var errs map[int][]error
 				for _, c := range nn.cells {
-					var sb strings.Builder
-					for _, tk := range c.tokens {
-						if tk.kind == tokenText {
-							sb.WriteString(tk.text)
-							continue
+					ctx := ctx
+					if b, ok := st.colBind[c.col]; ok {
+						ctx = b.bind(ctx)
+					}
+					at := func(expr string) TemplateError {
+						return TemplateError{Sheet: st.name, Cell: cellName(c.col, nn.row), Raw: c.raw, Expr: expr, Path: ctx.iter}
+					}
+					v, names, cerrs := evalCell(ctx, c, at)
+					if len(cerrs) > 0 {
+						for _, err := range cerrs {
+							if err := rep.add(err); err != nil {
+								return err
+							}
+						}
+						if errs == nil {
+							errs = make(map[int][]error)
 						}
-						v, err := evalScalar(ctx, tk.expr)
-						if err != nil {
-							return err
+						errs[c.col] = cerrs
+						vals[c.col] = errMarker
+						continue
+					}
+					if len(names) > 0 {
+						if styles == nil {
+							styles = make(map[int][]string)
 						}
-						sb.WriteString(toString(v))
+						styles[c.col] = names
 					}
-					vals[c.col] = sb.String()
+					vals[c.col] = v
 				}
-				out = append(out, renderRow{sheet: nn.sheet, tplRow: nn.row, values: vals})
+				out = append(out, renderRow{sheet: nn.sheet, tplRow: nn.row, values: vals, styles: styles, errs: errs, scope: scope, iter: ctx.iter})
 			case *eachNode:
-				v, ok := resolvePath(ctx, nn.path)
-				if !ok {
-					continue
-				}
-				arr, ok := v.([]interface{})
-				if !ok {
+				arr, err := loopItems(ctx, "each", nn.path, nn.optional)
+				if err != nil {
+					// в режиме сбора ошибок цикл пропускается
+					if err := rep.add(errorAt(err, CodeEval, TemplateError{Sheet: st.name, Cell: nn.at.cell, Raw: nn.at.raw, Expr: nn.path, Path: ctx.iter})); err != nil {
+						return err
+					}
 					continue
 				}
+				base := iterPath(ctx, nn.path)
 				for i, item := range arr {
-					nctx := &evalContext{current: item, parent: ctx, root: ctx.root, vars: map[string]interface{}{}}
+					nctx := &evalContext{current: item, parent: ctx, root: ctx.root, exprs: ctx.exprs, strict: ctx.strict, images: ctx.images, vars: map[string]interface{}{},
+						iter: base + "[" + strconv.Itoa(i) + "]", iterVar: nn.itemVar}
 					for k, v := range ctx.vars {
 						nctx.vars[k] = v
 					}
@@ -1050,19 +1222,20 @@ func renderSheet(st *sheetTemplate, ctx *evalContext) ([]renderRow, error) {
 					if nn.indexVar != "" {
 						nctx.vars[nn.indexVar] = float64(i)
 					}
-					if err := walk(nn.children, nctx); err != nil {
+					iteration++
+					if err := walk(nn.children, nctx, append(scope[:len(scope):len(scope)], iteration)); err != nil {
 						return err
 					}
 				}
 			case *eachObjNode:
-				v, ok := resolvePath(ctx, nn.path)
-				if !ok {
-					continue
-				}
-				m, ok := v.(map[string]interface{})
-				if !ok {
+				m, err := loopObject(ctx, nn.path, nn.optional)
+				if err != nil {
+					if err := rep.add(errorAt(err, CodeEval, TemplateError{Sheet: st.name, Cell: nn.at.cell, Raw: nn.at.raw, Expr: nn.path, Path: ctx.iter})); err != nil {
+						return err
+					}
 					continue
 				}
+				base := iterPath(ctx, nn.path)
 				keys := make([]string, 0, len(m))
 				for k := range m {
 					keys = append(keys, k)
@@ -1070,7 +1243,8 @@ func renderSheet(st *sheetTemplate, ctx *evalContext) ([]renderRow, error) {
 				sort.Strings(keys)
 				for _, k := range keys {
 					val := m[k]
-					nctx := &evalContext{current: val, parent: ctx, root: ctx.root, vars: map[string]interface{}{}}
+					nctx := &evalContext{current: val, parent: ctx, root: ctx.root, exprs: ctx.exprs, strict: ctx.strict, images: ctx.images, vars: map[string]interface{}{},
+						iter: base + keySegment(k), iterVar: nn.valVar}
 					for kk, vv := range ctx.vars {
 						nctx.vars[kk] = vv
 					}
@@ -1080,21 +1254,26 @@ func renderSheet(st *sheetTemplate, ctx *evalContext) ([]renderRow, error) {
 					if nn.valVar != "" {
 						nctx.vars[nn.valVar] = val
 					}
-					if err := walk(nn.children, nctx); err != nil {
+					iteration++
+					if err := walk(nn.children, nctx, append(scope[:len(scope):len(scope)], iteration)); err != nil {
 						return err
 					}
 				}
 			case *ifNode:
-				cond, err := evalBool(ctx, nn.expr)
+				cond, err := evalBool(optionalCtx(ctx, nn.optional), nn.expr)
 				if err != nil {
-					return err
+					// в режиме сбора ошибок условие с ошибкой считается ложным
+					if err := rep.add(errorAt(err, CodeEval, TemplateError{Sheet: st.name, Cell: nn.at.cell, Raw: nn.at.raw, Expr: nn.expr, Path: ctx.iter})); err != nil {
+						return err
+					}
+					cond = false
 				}
 				if cond {
-					if err := walk(nn.thenNodes, ctx); err != nil {
+					if err := walk(nn.thenNodes, ctx, scope); err != nil {
 						return err
 					}
 				} else {
-					if err := walk(nn.elseNodes, ctx); err != nil {
+					if err := walk(nn.elseNodes, ctx, scope); err != nil {
 						return err
 					}
 				}
@@ -1102,107 +1281,339 @@ func renderSheet(st *sheetTemplate, ctx *evalContext) ([]renderRow, error) {
 		}
 		return nil
 	}
-	if err := walk(st.nodes, ctx); err != nil {
+	if err := walk(st.nodes, ctx, nil); err != nil {
 		return nil, err
 	}
 	return out, nil
 }
 
-func (t *Template) applyRendered(st *sheetTemplate, rows []renderRow) error {
+// evalCell вычисляет директивы {{style}} и выражения ячейки c. Ячейка из единственного
+// выражения сохраняет тип значения. Возвращаются все ошибки ячейки с местом at.
+func evalCell(ctx *evalContext, c cellTpl, at func(expr string) TemplateError) (interface{}, []string, []error) {
+	var names []string
+	var errs []error
+	for _, se := range c.styles {
+		v, err := evalScalar(ctx, se)
+		if err != nil {
+			errs = append(errs, errorAt(err, CodeEval, at(se)))
+			continue
+		}
+		names = append(names, styleNames(v)...)
+	}
+	if len(c.tokens) == 1 && c.tokens[0].kind == tokenExpr {
+		v, err := evalScalar(optionalCtx(ctx, c.tokens[0].optional), c.tokens[0].expr)
+		if err != nil {
+			return nil, names, append(errs, errorAt(err, CodeEval, at(c.tokens[0].expr)))
+		}
+		return typedCellValue(v), names, errs
+	}
+	var sb strings.Builder
+	for _, tk := range c.tokens {
+		if tk.kind == tokenText {
+			sb.WriteString(tk.text)
+			continue
+		}
+		v, err := evalScalar(optionalCtx(ctx, tk.optional), tk.expr)
+		if err != nil {
+			errs = append(errs, errorAt(err, CodeEval, at(tk.expr)))
+			continue
+		}
+		sb.WriteString(toString(v))
+	}
+	return sb.String(), names, errs
+}
+
+func (d *Document) applyRendered(st *sheetTemplate, rows []renderRow) (err error) {
 	sheet := st.name
+	defer func() {
+		err = errorAt(err, CodeWrite, TemplateError{Sheet: sheet})
+	}()
 	if st.minRow == 0 && st.maxRow == 0 {
 		return nil
 	}
-	// Поддерживаем актуальные позиции исходных шаблонных строк
-	tplPos := make(map[int]int)
-	for tplRow := range st.rowTpls {
-		tplPos[tplRow] = tplRow
+	// Объединения строк блоков снимаем до вставок и строим заново по итоговой раскладке
+	for _, mt := range st.merges {
+		c1, _ := excelize.CoordinatesToCellName(mt.startCol, mt.startRow)
+		c2, _ := excelize.CoordinatesToCellName(mt.endCol, mt.endRow)
+		if err := d.f.UnmergeCell(sheet, c1, c2); err != nil {
+			return err
+		}
 	}
+	if err := d.detachCondFmts(st); err != nil {
+		return err
+	}
+	dataVals, err := d.detachDataValidations(st)
+	if err != nil {
+		return err
+	}
+	tables, err := d.detachTables(st)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			d.restoreTables(tables)
+		}
+	}()
+	// Поддерживаем актуальные позиции исходных строк области шаблона
+	// (ниже неё строки просто сдвигаются на число вставленных)
+	rowPos := make(map[int]int)
+	for r := 1; r <= st.maxRow; r++ {
+		rowPos[r] = r
+	}
+	// Изображения привязываются к итоговым ячейкам после восстановления объединений
+	type pendingImage struct {
+		row, col int
+		img      cellImage
+	}
+	var images []pendingImage
+	// Примечания с ошибками (ErrorComments) тоже ставятся по итоговой раскладке
+	type pendingComment struct {
+		row, col int
+		errs     []error
+	}
+	var errCells []pendingComment
+
 	// Глобальный барьер: запрещает вставку выше уже вставленных данных, чтобы сохранять порядок rows
 	barrier := st.minRow
+	// Позиции вставленных строк до удаления шаблонных и управляющих строк
+	placed := make([]int, len(rows))
 
 	// Вставляем строки в порядке rows, вычисляя позицию как max(barrier, текущая позиция шаблонной строки)
-	for _, rr := range rows {
+	for i, rr := range rows {
 		rt := st.rowTpls[rr.tplRow]
-		curTpl := tplPos[rr.tplRow]
+		curTpl := rowPos[rr.tplRow]
 		insertAt := curTpl
 		if barrier > insertAt {
 			insertAt = barrier
 		}
-		if err := t.f.InsertRows(sheet, insertAt, 1); err != nil {
+		if err := d.f.InsertRows(sheet, insertAt, 1); err != nil {
 			return err
 		}
 		// Заполняем вставленную строку
 		dstRow := insertAt
+		placed[i] = dstRow
+		// Высота, скрытие и группировка строки из образца
+		if rt.height > 0 {
+			if err := d.f.SetRowHeight(sheet, dstRow, rt.height); err != nil {
+				return err
+			}
+		}
+		if rt.hidden {
+			if err := d.f.SetRowVisible(sheet, dstRow, false); err != nil {
+				return err
+			}
+		}
+		if rt.outline > 0 {
+			if err := d.f.SetRowOutlineLevel(sheet, dstRow, rt.outline); err != nil {
+				return err
+			}
+		}
 		// Стили из образца
 		for col, sid := range rt.styles {
 			addr, _ := excelize.CoordinatesToCellName(col, dstRow)
-			if err := t.f.SetCellStyle(sheet, addr, addr, sid); err != nil {
+			if err := d.f.SetCellStyle(sheet, addr, addr, sid); err != nil {
 				return err
 			}
 		}
 		// Статические значения (без выражений) из образца
 		for col, rawv := range rt.rawVals {
 			addr, _ := excelize.CoordinatesToCellName(col, dstRow)
-			if rxExpr.MatchString(rawv) {
-				if err := t.f.SetCellValue(sheet, addr, ""); err != nil {
+			if rxExpr.MatchString(rawv) || rxStyle.MatchString(rawv) {
+				if err := d.f.SetCellValue(sheet, addr, ""); err != nil {
 					return err
 				}
 			} else {
-				if err := t.f.SetCellValue(sheet, addr, rawv); err != nil {
+				if err := d.f.SetCellValue(sheet, addr, rawv); err != nil {
 					return err
 				}
 			}
 		}
+		for col, errs := range rr.errs {
+			errCells = append(errCells, pendingComment{row: i, col: col, errs: errs})
+		}
 		// Рендеренные значения поверх
 		for col, val := range rr.values {
 			addr, _ := excelize.CoordinatesToCellName(col, dstRow)
-			if err := t.f.SetCellValue(sheet, addr, val); err != nil {
+			if img, ok := val.(cellImage); ok {
+				images = append(images, pendingImage{row: i, col: col, img: img})
+				continue
+			}
+			base, styled := rt.styles[col]
+			_, isTime := val.(time.Time)
+			_, isLink := val.(cellLink)
+			if isLink {
+				if err := d.setCellLink(sheet, addr, val.(cellLink), styled); err != nil {
+					return err
+				}
+			} else if err := d.f.SetCellValue(sheet, addr, val); err != nil {
 				return err
 			}
+			// Формат из :fmt и именованные стили {{style}} накладываются на стиль шаблонной ячейки
+			if nf, names := rt.numFmts[col], rr.styles[col]; nf != "" || len(names) > 0 {
+				// у ссылки и у даты без формата в шаблоне основой служит стиль, выставленный при записи
+				if isLink || (isTime && nf == "" && !hasNumFmt(d.f, base)) {
+					if base, err = d.f.GetCellStyle(sheet, addr); err != nil {
+						return err
+					}
+				}
+				sid, err := d.cellStyle(base, nf, names)
+				if err != nil {
+					err = errorAt(err, CodeWrite, TemplateError{Sheet: sheet, Cell: cellName(col, rr.tplRow), Raw: rt.rawVals[col], Path: rr.iter})
+					if err := d.report.add(err); err != nil {
+						return err
+					}
+					if err := d.f.SetCellValue(sheet, addr, errMarker); err != nil {
+						return err
+					}
+					errCells = append(errCells, pendingComment{row: i, col: col, errs: []error{err}})
+					continue
+				}
+				if err := d.f.SetCellStyle(sheet, addr, addr, sid); err != nil {
+					return err
+				}
+				continue
+			}
+			// excelize подставляет для дат формат по умолчанию — возвращаем формат шаблона
+			if isTime && styled && hasNumFmt(d.f, base) {
+				if err := d.f.SetCellStyle(sheet, addr, addr, base); err != nil {
+					return err
+				}
+			}
 		}
-		// Горизонтальные слияния
-		for _, mg := range rt.merges {
-			c1, _ := excelize.CoordinatesToCellName(mg.startCol, dstRow)
-			c2, _ := excelize.CoordinatesToCellName(mg.endCol, dstRow)
-			_ = t.f.MergeCell(sheet, c1, c2)
-		}
-
-		// Обновляем барьер и позиции всех шаблонных строк на листе (всё ниже insertAt сдвигается на +1)
+		// Обновляем барьер и позиции исходных строк на листе (всё ниже insertAt сдвигается на +1)
 		barrier = insertAt + 1
-		for tr, pos := range tplPos {
+		for r, pos := range rowPos {
 			if pos >= insertAt {
-				tplPos[tr] = pos + 1
+				rowPos[r] = pos + 1
 			}
 		}
 	}
 
-	// Удаляем исходные шаблонные строки (которые теперь смещены согласно tplPos)
-	// Удаляем снизу вверх
-	var toDelete []int
-	for _, pos := range tplPos {
-		toDelete = append(toDelete, pos)
+	// Удаляем исходные шаблонные строки (которые теперь смещены согласно rowPos)
+	// и строки, содержащие только управляющие маркеры ({{#each}}, {{/each}}, {{#if}}, {{/if}}, {{else}})
+	toDelete, err := controlMarkerRows(d.f, sheet)
+	if err != nil {
+		return err
 	}
+	for tplRow := range st.rowTpls {
+		toDelete = append(toDelete, rowPos[tplRow])
+	}
+	if toDelete, err = d.keepTableRows(st, tables, rowPos, toDelete); err != nil {
+		return err
+	}
+	// Удаляем снизу вверх
 	sort.Sort(sort.Reverse(sort.IntSlice(toDelete)))
 	for _, r := range toDelete {
-		if err := t.f.RemoveRow(sheet, r); err != nil {
+		if err := d.f.RemoveRow(sheet, r); err != nil {
 			return err
 		}
 	}
 
-	// Удаляем строки, содержащие только управляющие маркеры ({{#each}}, {{/each}}, {{#if}}, {{/if}}, {{else}})
-	if err := removeControlMarkerRows(t.f, sheet); err != nil {
+	// Формулы переносим после всех вставок и удалений: ссылки пересчитываются
+	// по итоговой раскладке листа (см. sheetLayout.mapFormula)
+	l := newSheetLayout(st, rows, placed, rowPos, toDelete)
+	hasFormulas := false
+	// setFormula записывает перенесённую формулу ячейки шаблона (col, tplRow); ошибка
+	// переноса в режиме сбора ошибок оставляет в ячейке #ERR
+	setFormula := func(addr string, col, tplRow int, fm, mapped string, err error) error {
+		if err != nil {
+			err = errorAt(err, CodeFormula, TemplateError{Sheet: sheet, Cell: cellName(col, tplRow), Raw: "=" + fm})
+			if err := d.report.add(err); err != nil {
+				return err
+			}
+			if err := d.f.SetCellValue(sheet, addr, errMarker); err != nil {
+				return err
+			}
+			if d.errComments {
+				return d.addErrorComment(sheet, addr, []error{err})
+			}
+			return nil
+		}
+		hasFormulas = true
+		return d.f.SetCellFormula(sheet, addr, mapped)
+	}
+	for i, rr := range rows {
+		rt := st.rowTpls[rr.tplRow]
+		for col, fm := range rt.formulas {
+			addr, _ := excelize.CoordinatesToCellName(col, l.final[i])
+			mapped, err := l.mapFormula(fm, rr.tplRow, l.final[i], rr.scope)
+			if err := setFormula(addr, col, rr.tplRow, fm, mapped, err); err != nil {
+				return err
+			}
+		}
+	}
+	// Формулы статических ячеек (итоги под таблицей и т.п.) растягиваются на строки блоков
+	for r, cols := range st.formulas {
+		if l.isDeleted(r) {
+			continue
+		}
+		dst := l.staticRow(r)
+		for col, fm := range cols {
+			addr, _ := excelize.CoordinatesToCellName(col, dst)
+			mapped, err := l.mapFormula(fm, r, dst, nil)
+			if err := setFormula(addr, col, r, fm, mapped, err); err != nil {
+				return err
+			}
+		}
+	}
+	for _, mt := range st.merges {
+		for _, rg := range l.mergeRanges(mt) {
+			c1, _ := excelize.CoordinatesToCellName(mt.startCol, rg[0])
+			c2, _ := excelize.CoordinatesToCellName(mt.endCol, rg[1])
+			if err := d.f.MergeCell(sheet, c1, c2); err != nil {
+				return err
+			}
+		}
+	}
+	for _, pi := range images {
+		addr, _ := excelize.CoordinatesToCellName(pi.col, l.final[pi.row])
+		if err := d.addCellImage(sheet, addr, pi.img); err != nil {
+			return err
+		}
+	}
+	if d.errComments {
+		for _, pc := range errCells {
+			addr, _ := excelize.CoordinatesToCellName(pc.col, l.final[pc.row])
+			if err := d.addErrorComment(sheet, addr, pc.errs); err != nil {
+				return err
+			}
+		}
+	}
+	if err := d.applyCondFmts(st, l); err != nil {
 		return err
 	}
+	if err := d.applyDataValidations(st, l, dataVals); err != nil {
+		return err
+	}
+	if err := d.applyTables(st, l, tables); err != nil {
+		return err
+	}
+	if hasFormulas {
+		// Значения формул не вычисляются при записи — просим Excel пересчитать книгу при открытии
+		fullCalc := true
+		if err := d.f.SetCalcProps(&excelize.CalcPropsOptions{FullCalcOnLoad: &fullCalc}); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-// removeControlMarkerRows удаляет строки, которые содержат только управляющие маркеры шаблона
+// hasNumFmt сообщает, задан ли в стиле собственный числовой формат
+func hasNumFmt(f *excelize.File, sid int) bool {
+	st, err := f.GetStyle(sid)
+	if err != nil || st == nil {
+		return false
+	}
+	return st.NumFmt != 0 || (st.CustomNumFmt != nil && *st.CustomNumFmt != "")
+}
+
+// controlMarkerRows возвращает строки, которые содержат только управляющие маркеры шаблона
 // (каждая непустая ячейка строки полностью совпадает с одним из маркеров).
-func removeControlMarkerRows(f *excelize.File, sheet string) error {
+func controlMarkerRows(f *excelize.File, sheet string) ([]int, error) {
 	rows, err := f.GetRows(sheet)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	var toDelete []int
 	isCtrl := func(s string) bool {
@@ -1210,7 +1621,9 @@ func removeControlMarkerRows(f *excelize.File, sheet string) error {
 		if s == "" {
 			return false
 		}
-		return rxCtrlEach.MatchString(s) || rxCtrlEndEach.MatchString(s) || rxCtrlEachObj.MatchString(s) || rxCtrlEndEachObj.MatchString(s) || rxCtrlIf.MatchString(s) || rxCtrlEndIf.MatchString(s) || rxCtrlElse.MatchString(s)
+		return rxCtrlEach.MatchString(s) || rxCtrlEndEach.MatchString(s) || rxCtrlEachObj.MatchString(s) || rxCtrlEndEachObj.MatchString(s) || rxCtrlIf.MatchString(s) || rxCtrlEndIf.MatchString(s) || rxCtrlElse.MatchString(s) ||
+			rxCtrlEachCol.MatchString(s) || rxCtrlEndEachCol.MatchString(s) || rxCtrlEachColCell.MatchString(s) ||
+			rxCtrlSheetEach.MatchString(s)
 	}
 	for i, row := range rows {
 		hasCtrl := false
@@ -1232,12 +1645,30 @@ func removeControlMarkerRows(f *excelize.File, sheet string) error {
 			toDelete = append(toDelete, i+1) // 1-based
 		}
 	}
-	// удаляем снизу вверх
-	for i := len(toDelete) - 1; i >= 0; i-- {
-		_ = f.RemoveRow(sheet, toDelete[i])
-	}
-	return nil
+	return toDelete, nil
 }
 
-// Save сохраняет файл
-func (t *Template) Save(destPath string) error { return t.f.SaveAs(destPath) }
+// Save сохраняет результат последнего Render (до рендера — исходный шаблон).
+//
+// Deprecated: используйте Execute и (*Document).Save.
+func (t *Template) Save(destPath string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.last == nil {
+		return os.WriteFile(destPath, t.raw, 0o644)
+	}
+	return t.last.Save(destPath)
+}
+
+// WriteTo записывает результат последнего Render (до рендера — исходный шаблон) в w.
+//
+// Deprecated: используйте Execute и (*Document).WriteTo.
+func (t *Template) WriteTo(w io.Writer) (int64, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.last == nil {
+		n, err := w.Write(t.raw)
+		return int64(n), err
+	}
+	return t.last.WriteTo(w)
+}
@@ -1,10 +1,21 @@
 package exceltemplar_test
 
 import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"image"
+	"image/png"
+	"io/fs"
+	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
+	"testing/fstest"
+	"time"
 
 	"github.com/stretchr/testify/suite"
 	"github.com/xuri/excelize/v2"
@@ -1392,3 +1403,1775 @@ func (s *TemplateSuite) TestSafetyRequirementsPlaceholders_Table() {
 		})
 	}
 }
+
+// TestTypedCellValues — проверяет, что одиночное выражение записывается нативным типом Excel
+func (s *TemplateSuite) TestTypedCellValues() {
+	tmpDir := s.T().TempDir()
+	tmpTemplate := filepath.Join(tmpDir, "typed_values_template.xlsx")
+
+	f := excelize.NewFile()
+	sheet := "Sheet1"
+
+	_ = f.SetCellValue(sheet, "A1", "{{= $.qty}}")
+	_ = f.SetCellValue(sheet, "B1", "{{= $.done}}")
+	_ = f.SetCellValue(sheet, "C1", "{{= $.code}}")
+	_ = f.SetCellValue(sheet, "D1", "Qty: {{= $.qty}}")
+	_ = f.SetCellValue(sheet, "E1", "{{= $.missing}}")
+
+	s.Require().NoError(f.SaveAs(tmpTemplate), "save template")
+
+	json := `{"qty": 12.5, "done": true, "code": "007"}`
+	tmpOutput := filepath.Join(tmpDir, "typed_values_output.xlsx")
+	s.Require().NoError(exceltemplar.WriteResultsWithTemplate(tmpTemplate, tmpOutput, []string{json}), "render")
+
+	res, err := excelize.OpenFile(tmpOutput)
+	s.Require().NoError(err, "open result")
+
+	// Числа пишутся без атрибута типа, строки — как shared string
+	typ, _ := res.GetCellType(sheet, "A1")
+	s.Assert().Equal(excelize.CellTypeUnset, typ, "A1 should be a number")
+	v, _ := res.GetCellValue(sheet, "A1")
+	s.Assert().Equal("12.5", v, "A1")
+
+	typ, _ = res.GetCellType(sheet, "B1")
+	s.Assert().Equal(excelize.CellTypeBool, typ, "B1 should be a boolean")
+	v, _ = res.GetCellValue(sheet, "B1")
+	s.Assert().Equal("TRUE", v, "B1")
+
+	v, _ = res.GetCellValue(sheet, "C1")
+	s.Assert().Equal("007", v, "C1 string stays string")
+	typ, _ = res.GetCellType(sheet, "D1")
+	s.Assert().Equal(excelize.CellTypeSharedString, typ, "D1 mixed text stays a string")
+	v, _ = res.GetCellValue(sheet, "D1")
+	s.Assert().Equal("Qty: 12.5", v, "D1")
+	v, _ = res.GetCellValue(sheet, "E1")
+	s.Assert().Equal("", v, "E1")
+}
+
+// TestFormulasCopiedToRenderedRows — проверяет перенос формул шаблонной строки со сдвигом относительных ссылок
+func (s *TemplateSuite) TestFormulasCopiedToRenderedRows() {
+	tmpDir := s.T().TempDir()
+	tmpTemplate := filepath.Join(tmpDir, "formulas_template.xlsx")
+
+	f := excelize.NewFile()
+	sheet := "Sheet1"
+
+	_ = f.SetCellValue(sheet, "A1", "VAT")
+	_ = f.SetCellValue(sheet, "B1", 0.2)
+	_ = f.SetCellValue(sheet, "A2", "{{#each $.items as $it}}")
+	_ = f.SetCellValue(sheet, "A3", "{{= $it.name}}")
+	_ = f.SetCellValue(sheet, "B3", "{{= $it.qty}}")
+	_ = f.SetCellValue(sheet, "C3", "{{= $it.price}}")
+	_ = f.SetCellFormula(sheet, "D3", "B3*C3")
+	_ = f.SetCellFormula(sheet, "E3", "D3*$B$1")
+	_ = f.SetCellValue(sheet, "A4", "{{/each}}")
+
+	s.Require().NoError(f.SaveAs(tmpTemplate), "save template")
+
+	json := `{"items": [{"name": "A", "qty": 2, "price": 10}, {"name": "B", "qty": 3, "price": 5}, {"name": "C", "qty": 1, "price": 7}]}`
+	tmpOutput := filepath.Join(tmpDir, "formulas_output.xlsx")
+	s.Require().NoError(exceltemplar.WriteResultsWithTemplate(tmpTemplate, tmpOutput, []string{json}), "render")
+
+	res, err := excelize.OpenFile(tmpOutput)
+	s.Require().NoError(err, "open result")
+
+	for i, row := range []int{2, 3, 4} {
+		fm, _ := res.GetCellFormula(sheet, fmt.Sprintf("D%d", row))
+		s.Assert().Equal(fmt.Sprintf("B%d*C%d", row, row), fm, "D%d formula (item %d)", row, i)
+		fm, _ = res.GetCellFormula(sheet, fmt.Sprintf("E%d", row))
+		s.Assert().Equal(fmt.Sprintf("D%d*$B$1", row), fm, "E%d formula keeps absolute reference", row)
+	}
+	v, err := res.CalcCellValue(sheet, "D3")
+	s.Require().NoError(err, "calc D3")
+	s.Assert().Equal("15", v, "D3 = 3*5")
+}
+
+func (s *TemplateSuite) TestAggregateFormulasCoverBlocks() {
+	tmpDir := s.T().TempDir()
+	tmpTemplate := filepath.Join(tmpDir, "aggregate_template.xlsx")
+
+	f := excelize.NewFile()
+	sheet := "Sheet1"
+
+	_ = f.SetCellValue(sheet, "A1", "Отчёт")
+	_ = f.SetCellValue(sheet, "A2", "{{#each $.groups as $g}}")
+	_ = f.SetCellValue(sheet, "A3", "{{= $g.name}}")
+	_ = f.SetCellValue(sheet, "A4", "{{#each $g.items as $it}}")
+	_ = f.SetCellValue(sheet, "A5", "{{= $it.name}}")
+	_ = f.SetCellValue(sheet, "B5", "{{= $it.qty}}")
+	_ = f.SetCellValue(sheet, "A6", "{{/each}}")
+	_ = f.SetCellValue(sheet, "A7", "Подытог")
+	_ = f.SetCellFormula(sheet, "B7", "SUM(B5:B5)")
+	_ = f.SetCellFormula(sheet, "C7", "COUNT(B5:B5)")
+	_ = f.SetCellFormula(sheet, "D7", "AVERAGE(B5:B5)")
+	_ = f.SetCellValue(sheet, "A8", "{{/each}}")
+	_ = f.SetCellValue(sheet, "A9", "Итого")
+	_ = f.SetCellFormula(sheet, "B9", "SUM(B5)")
+	_ = f.SetCellFormula(sheet, "B10", "SUM(B7)")
+
+	s.Require().NoError(f.SaveAs(tmpTemplate), "save template")
+
+	json := `{"groups": [
+		{"name": "G1", "items": [{"name": "a", "qty": 2}, {"name": "b", "qty": 3}]},
+		{"name": "G2", "items": []},
+		{"name": "G3", "items": [{"name": "c", "qty": 5}]}
+	]}`
+	tmpOutput := filepath.Join(tmpDir, "aggregate_output.xlsx")
+	s.Require().NoError(exceltemplar.WriteResultsWithTemplate(tmpTemplate, tmpOutput, []string{json}), "render")
+
+	res, err := excelize.OpenFile(tmpOutput)
+	s.Require().NoError(err, "open result")
+
+	// 1 Отчёт, 2 G1, 3-4 позиции, 5 подытог, 6 G2, 7 подытог, 8 G3, 9 позиция, 10 подытог, 11-12 итоги
+	expect := map[string]string{
+		"B5":  "SUM(B3:B4)",
+		"B7":  "SUM(B1048576:B1048576)",
+		"C7":  "COUNT(B1048576:B1048576)",
+		"D7":  "AVERAGE(B1048576:B1048576)",
+		"B10": "SUM(B9:B9)",
+		"B11": "SUM((B3:B4,B9))",
+		"B12": "SUM((B5,B7,B10))",
+	}
+	for addr, want := range expect {
+		fm, _ := res.GetCellFormula(sheet, addr)
+		s.Assert().Equal(want, fm, "formula %s", addr)
+	}
+	for addr, want := range map[string]string{"B5": "5", "C5": "2", "B7": "0", "C7": "0", "B10": "5", "D10": "5"} {
+		v, err := res.CalcCellValue(sheet, addr)
+		s.Require().NoError(err, "calc %s", addr)
+		s.Assert().Equal(want, v, "value %s", addr)
+	}
+	// пустой блок — пустой диапазон, а не число: AVERAGE без значений даёт #DIV/0!
+	v, _ := res.CalcCellValue(sheet, "D7")
+	s.Assert().Equal("#DIV/0!", v, "average over empty block")
+	v, _ = res.GetCellValue(sheet, "A11")
+	s.Assert().Equal("Итого", v, "static row shifted below blocks")
+}
+
+func (s *TemplateSuite) TestAggregateUnionOnlyInUnionFunctions() {
+	f := excelize.NewFile()
+	sheet := "Sheet1"
+	_ = f.SetCellValue(sheet, "A1", "{{#each $.groups as $g}}")
+	_ = f.SetCellValue(sheet, "A2", "{{= $g.name}}")
+	_ = f.SetCellValue(sheet, "A3", "{{#each $g.items as $it}}")
+	_ = f.SetCellValue(sheet, "B4", "{{= $it}}")
+	_ = f.SetCellValue(sheet, "A5", "{{/each}}")
+	_ = f.SetCellValue(sheet, "A6", "{{/each}}")
+	_ = f.SetCellValue(sheet, "A7", "Итого")
+	_ = f.SetCellFormula(sheet, "B7", "SUM(B4)")
+	_ = f.SetCellFormula(sheet, "C7", `SUMIF(B4,">2")`)
+	var buf bytes.Buffer
+	s.Require().NoError(f.Write(&buf), "write template")
+	tmpl, err := exceltemplar.Compile(buf.Bytes())
+	s.Require().NoError(err, "compile")
+
+	formulas := func(doc *exceltemplar.Document, cells ...string) []string {
+		out := make([]string, len(cells))
+		for i, c := range cells {
+			out[i], _ = doc.File().GetCellFormula(sheet, c)
+		}
+		return out
+	}
+
+	// Смежные строки — обычный диапазон, годится и для SUMIF
+	doc, err := tmpl.Execute([]string{`{"groups": [{"name": "G1", "items": [1, 3]}]}`})
+	s.Require().NoError(err, "contiguous rows")
+	s.Assert().Equal([]string{"SUM(B2:B3)", `SUMIF(B2:B3,">2")`}, formulas(doc, "B4", "C4"))
+	s.Require().NoError(doc.Close())
+
+	// Несмежные строки: объединение принимает SUM, а SUMIF получил бы #VALUE!
+	data := []string{`{"groups": [{"name": "G1", "items": [1, 3]}, {"name": "G2", "items": [5]}]}`}
+	_, err = tmpl.Execute(data)
+	var te *exceltemplar.TemplateError
+	s.Require().ErrorAs(err, &te, "union in SUMIF")
+	s.Assert().Equal(exceltemplar.CodeFormula, te.Code)
+	s.Assert().Equal("C7", te.Cell)
+	s.Assert().ErrorContains(err, "SUMIF")
+
+	tmpl.CollectErrors(true)
+	doc, err = tmpl.Execute(data)
+	s.Require().NotNil(doc)
+	s.Require().ErrorAs(err, new(*exceltemplar.RenderReport))
+	defer doc.Close()
+	s.Assert().Equal([]string{"SUM((B2:B3,B5))", ""}, formulas(doc, "B6", "C6"))
+	v, _ := doc.File().GetCellValue(sheet, "C6")
+	s.Assert().Equal("#ERR", v)
+}
+
+func (s *TemplateSuite) TestEachColMatrix() {
+	tmpDir := s.T().TempDir()
+	tmpTemplate := filepath.Join(tmpDir, "each_col_template.xlsx")
+
+	f := excelize.NewFile()
+	sheet := "Sheet1"
+
+	_ = f.SetCellValue(sheet, "B1", "{{#each-col $.months as $m i=$mi}}{{/each-col}}")
+	_ = f.SetCellValue(sheet, "A2", "Регион")
+	_ = f.SetCellValue(sheet, "B2", "{{= $m}}")
+	_ = f.SetCellValue(sheet, "C2", "Итого")
+	_ = f.SetCellValue(sheet, "A3", "{{#each $.regions as $r}}")
+	_ = f.SetCellValue(sheet, "A4", "{{= $r.name}}")
+	_ = f.SetCellValue(sheet, "B4", "{{= $r.sales[$mi]}}")
+	_ = f.SetCellFormula(sheet, "C4", "SUM(B4)")
+	_ = f.SetCellValue(sheet, "A5", "{{/each}}")
+	_ = f.SetCellValue(sheet, "A6", "Всего")
+	_ = f.SetCellFormula(sheet, "B6", "SUM(B4)")
+	_ = f.SetCellFormula(sheet, "C6", "SUM(C4)")
+	_ = f.SetColWidth(sheet, "B", "B", 15)
+	bold, _ := f.NewStyle(&excelize.Style{Font: &excelize.Font{Bold: true}})
+	_ = f.SetCellStyle(sheet, "B2", "B2", bold)
+
+	s.Require().NoError(f.SaveAs(tmpTemplate), "save template")
+
+	json := `{"months": ["Янв", "Фев", "Мар"], "regions": [{"name": "Север", "sales": [1, 2, 3]}, {"name": "Юг", "sales": [4, 5, 6]}]}`
+	tmpOutput := filepath.Join(tmpDir, "each_col_output.xlsx")
+	s.Require().NoError(exceltemplar.WriteResultsWithTemplate(tmpTemplate, tmpOutput, []string{json}), "render")
+
+	res, err := excelize.OpenFile(tmpOutput)
+	s.Require().NoError(err, "open result")
+
+	rows, err := res.GetRows(sheet)
+	s.Require().NoError(err, "get rows")
+	s.Require().GreaterOrEqual(len(rows), 3, "rows count")
+	s.Assert().Equal([]string{"Регион", "Янв", "Фев", "Мар", "Итого"}, rows[0], "header")
+	s.Assert().Equal([]string{"Север", "1", "2", "3"}, rows[1][:4], "row 1")
+	s.Assert().Equal([]string{"Юг", "4", "5", "6"}, rows[2][:4], "row 2")
+
+	expect := map[string]string{
+		"E2": "SUM(B2:D2)",
+		"E3": "SUM(B3:D3)",
+		"B4": "SUM(B2:B3)",
+		"D4": "SUM(D2:D3)",
+		"E4": "SUM(E2:E3)",
+	}
+	for addr, want := range expect {
+		fm, _ := res.GetCellFormula(sheet, addr)
+		s.Assert().Equal(want, fm, "formula %s", addr)
+	}
+	v, err := res.CalcCellValue(sheet, "E3")
+	s.Require().NoError(err, "calc E3")
+	s.Assert().Equal("15", v, "E3 = 4+5+6")
+
+	for _, col := range []string{"C", "D"} {
+		w, _ := res.GetColWidth(sheet, col)
+		s.Assert().Equal(15.0, w, "column %s width copied", col)
+		sid, _ := res.GetCellStyle(sheet, col+"1")
+		s.Assert().Equal(bold, sid, "header style copied to %s1", col)
+	}
+	w, _ := res.GetColWidth(sheet, "E")
+	s.Assert().NotEqual(15.0, w, "column after the loop keeps its width")
+}
+
+func (s *TemplateSuite) TestSheetEachClonesSheets() {
+	tmpDir := s.T().TempDir()
+	tmpTemplate := filepath.Join(tmpDir, "sheet_each_template.xlsx")
+
+	f := excelize.NewFile()
+	_ = f.SetSheetName("Sheet1", "Сводка")
+	_ = f.SetCellValue("Сводка", "A1", "{{= $.title}}")
+	sheet := "Офис"
+	_, _ = f.NewSheet(sheet)
+	_ = f.SetCellValue(sheet, "A1", "{{#sheet-each $.offices as $o i=$i name=$o.title}}")
+	_ = f.SetCellValue(sheet, "A2", "Офис {{= $i+1}}: {{= $o.title}}")
+	_ = f.MergeCell(sheet, "A2", "C2")
+	_ = f.SetCellValue(sheet, "A3", "{{#each $o.staff as $p}}")
+	_ = f.SetCellValue(sheet, "A4", "{{= $p}}")
+	_ = f.SetCellValue(sheet, "A5", "{{/each}}")
+	_ = f.SetColWidth(sheet, "A", "A", 30)
+	landscape := "landscape"
+	_ = f.SetPageLayout(sheet, &excelize.PageLayoutOptions{Orientation: &landscape})
+	_ = f.SetDefinedName(&excelize.DefinedName{Name: "_xlnm.Print_Area", RefersTo: "'Офис'!$A$1:$C$10", Scope: sheet})
+
+	s.Require().NoError(f.SaveAs(tmpTemplate), "save template")
+
+	json := `{"title": "Филиалы", "offices": [
+		{"title": "Москва/Центр", "staff": ["Иванов", "Петров"]},
+		{"title": "Москва_Центр", "staff": []},
+		{"title": "Очень длинное название филиала компании", "staff": ["Сидоров"]}
+	]}`
+	tmpOutput := filepath.Join(tmpDir, "sheet_each_output.xlsx")
+	s.Require().NoError(exceltemplar.WriteResultsWithTemplate(tmpTemplate, tmpOutput, []string{json}), "render")
+
+	res, err := excelize.OpenFile(tmpOutput)
+	s.Require().NoError(err, "open result")
+
+	// 31 символ, хвостовой пробел обрезается
+	long := "Очень длинное название филиала"
+	s.Assert().Equal([]string{"Сводка", "Москва_Центр", "Москва_Центр (2)", long}, res.GetSheetList(), "sheet names sanitized and ordered")
+
+	v, _ := res.GetCellValue("Сводка", "A1")
+	s.Assert().Equal("Филиалы", v, "other sheets render as usual")
+
+	rows, err := res.GetRows("Москва_Центр")
+	s.Require().NoError(err, "rows of first copy")
+	s.Assert().Equal([][]string{{"Офис 1: Москва/Центр"}, {"Иванов"}, {"Петров"}}, rows, "first copy rendered with its element")
+	rows, _ = res.GetRows(long)
+	s.Assert().Equal([][]string{{"Офис 3: Очень длинное название филиала компании"}, {"Сидоров"}}, rows, "third copy")
+
+	for _, name := range res.GetSheetList()[1:] {
+		merges, _ := res.GetMergeCells(name)
+		s.Require().Len(merges, 1, "merge copied to %s", name)
+		s.Assert().Equal("A1:C1", merges[0].GetStartAxis()+":"+merges[0].GetEndAxis(), "merge of %s", name)
+		w, _ := res.GetColWidth(name, "A")
+		s.Assert().Equal(30.0, w, "column width of %s", name)
+		pl, _ := res.GetPageLayout(name)
+		s.Require().NotNil(pl.Orientation, "page layout of %s", name)
+		s.Assert().Equal("landscape", *pl.Orientation, "orientation of %s", name)
+	}
+	var printAreas []string
+	for _, dn := range res.GetDefinedName() {
+		if dn.Name == "_xlnm.Print_Area" {
+			printAreas = append(printAreas, dn.Scope+"="+dn.RefersTo)
+		}
+	}
+	s.Assert().ElementsMatch([]string{
+		"Москва_Центр='Москва_Центр'!$A$1:$C$10",
+		"Москва_Центр (2)='Москва_Центр (2)'!$A$1:$C$10",
+		long + "='" + long + "'!$A$1:$C$10",
+	}, printAreas, "print area copied to every sheet")
+}
+
+func (s *TemplateSuite) TestSheetEachNameExpression() {
+	f := excelize.NewFile()
+	_ = f.SetSheetName("Sheet1", "Город")
+	_ = f.SetCellValue("Город", "A1", `{{#sheet-each $.offices as $o name=$o.city + " " + $o.code}}`)
+	_ = f.SetCellValue("Город", "A2", "{{= $o.code}}")
+	_, _ = f.NewSheet("Склад")
+	_ = f.SetCellValue("Склад", "A1", "{{#sheet-each $.offices as $o i=$i name=$o.title | upper}}")
+	_ = f.SetCellValue("Склад", "A2", "{{= $i}}")
+	var buf bytes.Buffer
+	s.Require().NoError(f.Write(&buf), "write template")
+
+	tmpl, err := exceltemplar.Compile(buf.Bytes())
+	s.Require().NoError(err, "compile")
+	doc, err := tmpl.Execute([]string{`{"offices": [{"city": "Казань", "code": "K1", "title": "склад север"}]}`})
+	s.Require().NoError(err, "execute")
+	defer doc.Close()
+	s.Assert().Equal([]string{"Казань K1", "СКЛАД СЕВЕР"}, doc.File().GetSheetList(), "name= takes the whole expression")
+}
+
+// TestSheetEachCopiesPictures — рисунки листа-шаблона (логотип) есть на каждой копии
+func (s *TemplateSuite) TestSheetEachCopiesPictures() {
+	var logo bytes.Buffer
+	s.Require().NoError(png.Encode(&logo, image.NewRGBA(image.Rect(0, 0, 40, 20))))
+	f := excelize.NewFile()
+	_ = f.SetCellValue("Sheet1", "A1", "{{#sheet-each $.offices as $o name=$o.city}}")
+	_ = f.SetCellValue("Sheet1", "A2", "{{= $o.city}}")
+	s.Require().NoError(f.AddPictureFromBytes("Sheet1", "D5", &excelize.Picture{Extension: ".png", File: logo.Bytes()}))
+	var buf bytes.Buffer
+	s.Require().NoError(f.Write(&buf), "write template")
+
+	tmpl, err := exceltemplar.Compile(buf.Bytes())
+	s.Require().NoError(err, "compile")
+	doc, err := tmpl.Execute([]string{`{"offices": [{"city": "Казань"}, {"city": "Омск"}]}`})
+	s.Require().NoError(err, "execute")
+	defer doc.Close()
+	var out bytes.Buffer
+	s.Require().NoError(doc.File().Write(&out), "write result")
+	res, err := excelize.OpenReader(&out)
+	s.Require().NoError(err, "open result")
+	s.Assert().Equal([]string{"Казань", "Омск"}, res.GetSheetList(), "copies")
+	// строка маркера sheet-each удаляется — логотип поднимается вместе с ячейками
+	for _, sheet := range res.GetSheetList() {
+		pics, err := res.GetPictures(sheet, "D4")
+		s.Require().NoError(err, sheet)
+		s.Require().Len(pics, 1, sheet)
+		s.Assert().Equal(logo.Bytes(), pics[0].File, sheet)
+	}
+}
+
+func (s *TemplateSuite) TestMultiRowMergesInBlocks() {
+	tmpDir := s.T().TempDir()
+	tmpTemplate := filepath.Join(tmpDir, "merges_template.xlsx")
+
+	f := excelize.NewFile()
+	sheet := "Sheet1"
+
+	_ = f.SetCellValue(sheet, "A1", "Список")
+	_ = f.SetCellValue(sheet, "G1", "Боковая подпись")
+	_ = f.SetCellValue(sheet, "A2", "{{#each $.items as $it}}")
+	_ = f.SetCellValue(sheet, "A3", "{{= $it.name}}")
+	_ = f.SetCellValue(sheet, "B3", "Кол-во")
+	_ = f.SetCellValue(sheet, "C3", "{{= $it.qty}}")
+	_ = f.SetCellValue(sheet, "D3", "{{= $it.note}}")
+	_ = f.SetCellValue(sheet, "B4", "Цена")
+	_ = f.SetCellValue(sheet, "C4", "{{= $it.price}}")
+	_ = f.SetCellValue(sheet, "B5", "—")
+	_ = f.SetCellValue(sheet, "A6", "{{/each}}")
+	_ = f.SetCellValue(sheet, "A7", "Итого")
+	_ = f.MergeCell(sheet, "A3", "A5")
+	_ = f.MergeCell(sheet, "D3", "E3")
+	_ = f.MergeCell(sheet, "G1", "G7")
+
+	s.Require().NoError(f.SaveAs(tmpTemplate), "save template")
+
+	json := `{"items": [{"name": "A", "qty": 1, "price": 10, "note": "x"}, {"name": "B", "qty": 2, "price": 20, "note": "y"}]}`
+	tmpOutput := filepath.Join(tmpDir, "merges_output.xlsx")
+	s.Require().NoError(exceltemplar.WriteResultsWithTemplate(tmpTemplate, tmpOutput, []string{json}), "render")
+
+	res, err := excelize.OpenFile(tmpOutput)
+	s.Require().NoError(err, "open result")
+
+	merges, err := res.GetMergeCells(sheet)
+	s.Require().NoError(err, "get merges")
+	var got []string
+	for _, m := range merges {
+		got = append(got, m.GetStartAxis()+":"+m.GetEndAxis())
+	}
+	// 1 Список, 2-4 запись A, 5-7 запись B, 8 Итого
+	s.Assert().ElementsMatch([]string{"A2:A4", "A5:A7", "D2:E2", "D5:E5", "G1:G8"}, got, "merges per iteration and stretched over block")
+
+	v, _ := res.GetCellValue(sheet, "A5")
+	s.Assert().Equal("B", v, "second record label")
+	v, _ = res.GetCellValue(sheet, "A8")
+	s.Assert().Equal("Итого", v, "total row")
+	v, _ = res.GetCellValue(sheet, "G1")
+	s.Assert().Equal("Боковая подпись", v, "side label kept")
+}
+
+func (s *TemplateSuite) TestRowHeightVisibilityOutline() {
+	tmpDir := s.T().TempDir()
+	tmpTemplate := filepath.Join(tmpDir, "row_props_template.xlsx")
+
+	f := excelize.NewFile()
+	sheet := "Sheet1"
+
+	_ = f.SetCellValue(sheet, "A1", "{{#each $.items as $it}}")
+	_ = f.SetCellValue(sheet, "A2", "{{= $it.text}}")
+	_ = f.SetCellValue(sheet, "A3", "{{= $it.detail}}")
+	_ = f.SetCellValue(sheet, "A4", "{{= $it.secret}}")
+	_ = f.SetCellValue(sheet, "A5", "{{/each}}")
+	_ = f.SetRowHeight(sheet, 2, 42)
+	_ = f.SetRowOutlineLevel(sheet, 3, 1)
+	_ = f.SetRowVisible(sheet, 4, false)
+
+	s.Require().NoError(f.SaveAs(tmpTemplate), "save template")
+
+	json := `{"items": [{"text": "a", "detail": "a1", "secret": "s1"}, {"text": "b", "detail": "b1", "secret": "s2"}]}`
+	tmpOutput := filepath.Join(tmpDir, "row_props_output.xlsx")
+	s.Require().NoError(exceltemplar.WriteResultsWithTemplate(tmpTemplate, tmpOutput, []string{json}), "render")
+
+	res, err := excelize.OpenFile(tmpOutput)
+	s.Require().NoError(err, "open result")
+
+	defaultHeight, _ := res.GetRowHeight(sheet, 100)
+	for _, base := range []int{1, 4} {
+		h, _ := res.GetRowHeight(sheet, base)
+		s.Assert().Equal(42.0, h, "row %d height", base)
+		h, _ = res.GetRowHeight(sheet, base+1)
+		s.Assert().Equal(defaultHeight, h, "row %d keeps default height", base+1)
+		lvl, _ := res.GetRowOutlineLevel(sheet, base+1)
+		s.Assert().Equal(uint8(1), lvl, "row %d outline level", base+1)
+		visible, _ := res.GetRowVisible(sheet, base+2)
+		s.Assert().False(visible, "row %d hidden", base+2)
+		visible, _ = res.GetRowVisible(sheet, base)
+		s.Assert().True(visible, "row %d visible", base)
+	}
+	v, _ := res.GetCellValue(sheet, "A6")
+	s.Assert().Equal("s2", v, "hidden row still has data")
+}
+
+func (s *TemplateSuite) TestConditionalFormatsExpanded() {
+	tmpDir := s.T().TempDir()
+	tmpTemplate := filepath.Join(tmpDir, "cond_fmt_template.xlsx")
+
+	f := excelize.NewFile()
+	sheet := "Sheet1"
+
+	_ = f.SetCellValue(sheet, "A1", "Имя")
+	_ = f.SetCellValue(sheet, "C1", "Сумма")
+	_ = f.SetCellValue(sheet, "A2", "{{#each $.items as $it}}")
+	_ = f.SetCellValue(sheet, "A3", "{{= $it.name}}")
+	_ = f.SetCellValue(sheet, "C3", "{{= $it.amount}}")
+	_ = f.SetCellValue(sheet, "A4", "{{/each}}")
+	_ = f.SetCellValue(sheet, "A5", "Итого")
+	_ = f.SetCellFormula(sheet, "C5", "SUM(C3)")
+
+	red, _ := f.NewConditionalStyle(&excelize.Style{Fill: excelize.Fill{Type: "pattern", Color: []string{"FFC7CE"}, Pattern: 1}})
+	bold, _ := f.NewConditionalStyle(&excelize.Style{Font: &excelize.Font{Bold: true}})
+	s.Require().NoError(f.SetConditionalFormat(sheet, "C3", []excelize.ConditionalFormatOptions{{Type: "cell", Criteria: "<", Format: &red, Value: "0"}}))
+	s.Require().NoError(f.SetConditionalFormat(sheet, "A3:C3", []excelize.ConditionalFormatOptions{{Type: "formula", Criteria: "$C3<0", Format: &bold}}))
+	s.Require().NoError(f.SetConditionalFormat(sheet, "C5", []excelize.ConditionalFormatOptions{{Type: "cell", Criteria: ">", Format: &bold, Value: "100"}}))
+
+	s.Require().NoError(f.SaveAs(tmpTemplate), "save template")
+
+	json := `{"items": [{"name": "a", "amount": 5}, {"name": "b", "amount": -3}, {"name": "c", "amount": 200}]}`
+	tmpOutput := filepath.Join(tmpDir, "cond_fmt_output.xlsx")
+	s.Require().NoError(exceltemplar.WriteResultsWithTemplate(tmpTemplate, tmpOutput, []string{json}), "render")
+
+	res, err := excelize.OpenFile(tmpOutput)
+	s.Require().NoError(err, "open result")
+
+	cfs, err := res.GetConditionalFormats(sheet)
+	s.Require().NoError(err, "get conditional formats")
+	var refs []string
+	for ref := range cfs {
+		refs = append(refs, ref)
+	}
+	// 1 заголовок, 2-4 строки данных, 5 итог
+	s.Assert().ElementsMatch([]string{"C2:C4", "A2:C4", "C5"}, refs, "ranges expanded and shifted")
+	if opts := cfs["C2:C4"]; s.Assert().Len(opts, 1) {
+		s.Assert().Equal("less than", opts[0].Criteria, "cell rule criteria")
+		s.Assert().Equal("0", opts[0].Value, "cell rule value")
+		s.Assert().Equal(red, *opts[0].Format, "cell rule format")
+	}
+	if opts := cfs["A2:C4"]; s.Assert().Len(opts, 1) {
+		s.Assert().Equal("$C2<0", opts[0].Criteria, "formula rule follows the new top row")
+	}
+	if opts := cfs["C5"]; s.Assert().Len(opts, 1) {
+		s.Assert().Equal("100", opts[0].Value, "static rule kept")
+	}
+}
+
+func (s *TemplateSuite) TestDataValidationsExpanded() {
+	tmpDir := s.T().TempDir()
+	tmpTemplate := filepath.Join(tmpDir, "data_validation_template.xlsx")
+
+	f := excelize.NewFile()
+	sheet := "Sheet1"
+
+	_ = f.SetCellValue(sheet, "A1", "Документ")
+	_ = f.SetCellValue(sheet, "B1", "Статус")
+	_ = f.SetCellValue(sheet, "A2", "{{#each $.docs as $d}}")
+	_ = f.SetCellValue(sheet, "A3", "{{= $d.name}}")
+	_ = f.SetCellValue(sheet, "B3", "{{= $d.status}}")
+	_ = f.SetCellValue(sheet, "A4", "{{/each}}")
+	_ = f.SetCellValue(sheet, "A5", "Подписей")
+	_ = f.SetCellValue(sheet, "H10", "Да")
+	_ = f.SetCellValue(sheet, "H11", "Нет")
+
+	status := excelize.NewDataValidation(true)
+	status.Sqref = "B3"
+	s.Require().NoError(status.SetDropList([]string{"Approved", "Rejected"}))
+	s.Require().NoError(f.AddDataValidation(sheet, status))
+	signed := excelize.NewDataValidation(true)
+	signed.Sqref = "C3"
+	signed.SetSqrefDropList("$H$10:$H$11")
+	s.Require().NoError(f.AddDataValidation(sheet, signed))
+	count := excelize.NewDataValidation(true)
+	count.Sqref = "B5"
+	s.Require().NoError(count.SetRange(0, 10, excelize.DataValidationTypeWhole, excelize.DataValidationOperatorBetween))
+	s.Require().NoError(f.AddDataValidation(sheet, count))
+
+	s.Require().NoError(f.SaveAs(tmpTemplate), "save template")
+
+	json := `{"docs": [{"name": "d1", "status": "Approved"}, {"name": "d2", "status": "Rejected"}, {"name": "d3", "status": "Approved"}, {"name": "d4", "status": "Rejected"}]}`
+	tmpOutput := filepath.Join(tmpDir, "data_validation_output.xlsx")
+	s.Require().NoError(exceltemplar.WriteResultsWithTemplate(tmpTemplate, tmpOutput, []string{json}), "render")
+
+	res, err := excelize.OpenFile(tmpOutput)
+	s.Require().NoError(err, "open result")
+
+	dvs, err := res.GetDataValidations(sheet)
+	s.Require().NoError(err, "get data validations")
+	got := make(map[string]string)
+	for _, dv := range dvs {
+		got[dv.Sqref] = dv.Type + " " + dv.Formula1
+	}
+	// 1 заголовок, 2-5 документы, 6 подписи; список-источник сдвинулся на строку вниз
+	s.Assert().Equal(map[string]string{
+		"B2:B5": `list "Approved,Rejected"`,
+		"C2:C5": "list $H$11:$H$12",
+		"B6":    "whole 0",
+	}, got, "validations cover every rendered row")
+}
+
+func (s *TemplateSuite) TestTablesResizedAroundBlocks() {
+	tmpDir := s.T().TempDir()
+	tmpTemplate := filepath.Join(tmpDir, "tables_template.xlsx")
+
+	f := excelize.NewFile()
+	sheet := "Sheet1"
+
+	_ = f.SetCellValue(sheet, "A1", "Отчёт")
+	_ = f.SetCellValue(sheet, "A2", "Имя")
+	_ = f.SetCellValue(sheet, "B2", "Сумма")
+	_ = f.SetCellValue(sheet, "A3", "{{#each $.items as $i}}")
+	_ = f.SetCellValue(sheet, "A4", "{{= $i.name}}")
+	_ = f.SetCellValue(sheet, "B4", "{{= $i.sum}}")
+	_ = f.SetCellValue(sheet, "A5", "{{/each}}")
+	_ = f.SetCellValue(sheet, "A6", "Итого")
+	// Справочник ниже блока только сдвигается
+	_ = f.SetCellValue(sheet, "C8", "Код")
+	_ = f.SetCellValue(sheet, "D8", "Значение")
+	_ = f.SetCellValue(sheet, "C9", "x")
+	_ = f.SetCellValue(sheet, "D9", "1")
+	s.Require().NoError(f.AddTable(sheet, &excelize.Table{Range: "A2:B5", Name: "Items", StyleName: "TableStyleMedium2"}))
+	s.Require().NoError(f.AddTable(sheet, &excelize.Table{Range: "C8:D9", Name: "Lookup"}))
+	s.Require().NoError(f.SaveAs(tmpTemplate), "save template")
+
+	render := func(json string) map[string]string {
+		tmpOutput := filepath.Join(tmpDir, "tables_output.xlsx")
+		s.Require().NoError(exceltemplar.WriteResultsWithTemplate(tmpTemplate, tmpOutput, []string{json}), "render")
+		res, err := excelize.OpenFile(tmpOutput)
+		s.Require().NoError(err, "open result")
+		tables, err := res.GetTables(sheet)
+		s.Require().NoError(err, "get tables")
+		got := make(map[string]string)
+		for _, tbl := range tables {
+			got[tbl.Name] = tbl.Range + " " + tbl.StyleName
+		}
+		return got
+	}
+
+	// 2 заголовок, 3-5 элементы; строки маркеров из таблицы выпали
+	s.Assert().Equal(map[string]string{
+		"Items":  "A2:B5 TableStyleMedium2",
+		"Lookup": "C8:D9 ",
+	}, render(`{"items": [{"name": "a", "sum": 1}, {"name": "b", "sum": 2}, {"name": "c", "sum": 3}]}`), "tables follow rendered rows")
+
+	// Пустой массив: заголовок и одна пустая строка данных; строка итогов под таблицей
+	// в неё не попадает
+	s.Assert().Equal(map[string]string{
+		"Items":  "A2:B3 TableStyleMedium2",
+		"Lookup": "C6:D7 ",
+	}, render(`{"items": []}`), "empty block keeps table valid")
+	res, err := excelize.OpenFile(filepath.Join(tmpDir, "tables_output.xlsx"))
+	s.Require().NoError(err, "open result")
+	rows, err := res.GetRows(sheet)
+	s.Require().NoError(err, "get rows")
+	s.Assert().Equal([][]string{{"Отчёт"}, {"Имя", "Сумма"}, nil, {"Итого"}}, rows[:4], "blank data row, totals below the table")
+}
+
+// TestTablesOutsideBlocksKeepXML — таблицы вне блоков только сдвигаются: строка итогов,
+// отсутствие заголовка и прочая разметка таблицы сохраняются
+func (s *TemplateSuite) TestTablesOutsideBlocksKeepXML() {
+	tmpDir := s.T().TempDir()
+	tmpTemplate := filepath.Join(tmpDir, "tables_xml_template.xlsx")
+	tmpOutput := filepath.Join(tmpDir, "tables_xml_output.xlsx")
+
+	f := excelize.NewFile()
+	sheet := "Sheet1"
+
+	_ = f.SetCellValue(sheet, "A1", "Отчёт")
+	_ = f.SetCellValue(sheet, "A2", "{{#each $.items as $i}}")
+	_ = f.SetCellValue(sheet, "A3", "{{= $i}}")
+	_ = f.SetCellValue(sheet, "A4", "{{/each}}")
+	// Таблица со строкой итогов
+	_ = f.SetCellValue(sheet, "A6", "Код")
+	_ = f.SetCellValue(sheet, "B6", "Сумма")
+	_ = f.SetCellValue(sheet, "A7", "x")
+	_ = f.SetCellValue(sheet, "B7", 1)
+	_ = f.SetCellValue(sheet, "A8", "y")
+	_ = f.SetCellValue(sheet, "B8", 2)
+	_ = f.SetCellValue(sheet, "A9", "Итого")
+	_ = f.SetCellFormula(sheet, "B9", "SUBTOTAL(109,Totals[Сумма])")
+	s.Require().NoError(f.AddTable(sheet, &excelize.Table{Range: "A6:B9", Name: "Totals"}))
+	// Таблица без заголовка из одной строки
+	_ = f.SetCellValue(sheet, "D11", "a")
+	_ = f.SetCellValue(sheet, "E11", 1)
+	noHeader := false
+	s.Require().NoError(f.AddTable(sheet, &excelize.Table{Range: "D10:E11", Name: "Raw", ShowHeaderRow: &noHeader}))
+	// excelize не умеет задавать строку итогов — дописываем её в XML таблицы
+	raw, ok := f.Pkg.Load("xl/tables/table1.xml")
+	s.Require().True(ok, "totals table part")
+	xmlTotals := strings.Replace(string(raw.([]byte)), `ref="A6:B9"`, `ref="A6:B9" totalsRowCount="1"`, 1)
+	xmlTotals = strings.Replace(xmlTotals, `<autoFilter ref="A6:B9">`, `<autoFilter ref="A6:B8">`, 1)
+	xmlTotals = strings.Replace(xmlTotals, `name="Сумма"`, `name="Сумма" totalsRowFunction="sum"`, 1)
+	f.Pkg.Store("xl/tables/table1.xml", []byte(xmlTotals))
+	s.Require().NoError(f.SaveAs(tmpTemplate), "save template")
+
+	s.Require().NoError(exceltemplar.WriteResultsWithTemplate(tmpTemplate, tmpOutput, []string{`{"items": ["a", "b", "c", "d", "e"]}`}), "render")
+	res, err := excelize.OpenFile(tmpOutput)
+	s.Require().NoError(err, "open result")
+
+	tables, err := res.GetTables(sheet)
+	s.Require().NoError(err, "get tables")
+	got := make(map[string]string)
+	for _, tbl := range tables {
+		got[tbl.Name] = tbl.Range
+	}
+	// пять элементов вместо строки-шаблона и двух маркеров — всё ниже сдвигается на 2
+	s.Assert().Equal(map[string]string{"Totals": "A8:B11", "Raw": "D13:E13"}, got, "tables shifted")
+
+	part := func(name string) string {
+		for _, p := range []string{"xl/tables/table1.xml", "xl/tables/table2.xml"} {
+			v, ok := res.Pkg.Load(p)
+			s.Require().True(ok, p)
+			if strings.Contains(string(v.([]byte)), `name="`+name+`"`) {
+				return string(v.([]byte))
+			}
+		}
+		s.FailNow("no table part", name)
+		return ""
+	}
+	totals := part("Totals")
+	s.Assert().Contains(totals, `totalsRowCount="1"`, "totals row kept")
+	s.Assert().Contains(totals, `<autoFilter ref="A8:B10">`, "autofilter excludes totals row")
+	s.Assert().Contains(totals, `totalsRowFunction="sum"`, "totals function kept")
+	rawTbl := part("Raw")
+	s.Assert().Contains(rawTbl, `headerRowCount="0"`, "header-less table stays header-less")
+	s.Assert().NotContains(rawTbl, "autoFilter", "no autofilter added")
+
+	for addr, want := range map[string]string{"A8": "Код", "A11": "Итого", "D12": "", "D13": "a", "E13": "1"} {
+		v, err := res.GetCellValue(sheet, addr)
+		s.Require().NoError(err, addr)
+		s.Assert().Equal(want, v, addr)
+	}
+	fm, err := res.GetCellFormula(sheet, "B11")
+	s.Require().NoError(err, "totals formula")
+	s.Assert().Equal("SUBTOTAL(109,Totals[Сумма])", fm, "structured reference kept")
+}
+
+func (s *TemplateSuite) TestHyperlinks() {
+	tmpDir := s.T().TempDir()
+	tmpTemplate := filepath.Join(tmpDir, "links_template.xlsx")
+
+	f := excelize.NewFile()
+	sheet := "Sheet1"
+
+	_ = f.SetCellValue(sheet, "A1", "Задача")
+	_ = f.SetCellValue(sheet, "A2", "{{#each $.tickets as $t}}")
+	_ = f.SetCellValue(sheet, "A3", "{{= link($t.url, $t.key)}}")
+	_ = f.SetCellValue(sheet, "B3", "{{= link($t.url)}}")
+	_ = f.SetCellValue(sheet, "C3", "см. {{= link($t.url, $t.key)}}")
+	_ = f.SetCellValue(sheet, "A4", "{{/each}}")
+	_ = f.SetCellValue(sheet, "A5", "{{= link('#Sheet1!A1', 'Наверх')}}")
+	bold, err := f.NewStyle(&excelize.Style{Font: &excelize.Font{Bold: true}})
+	s.Require().NoError(err)
+	s.Require().NoError(f.SetCellStyle(sheet, "B3", "B3", bold))
+	s.Require().NoError(f.SaveAs(tmpTemplate), "save template")
+
+	json := `{"tickets": [{"key": "OPS-1", "url": "https://tracker.example/OPS-1"}, {"key": "OPS-2", "url": "https://tracker.example/OPS-2"}]}`
+	tmpOutput := filepath.Join(tmpDir, "links_output.xlsx")
+	s.Require().NoError(exceltemplar.WriteResultsWithTemplate(tmpTemplate, tmpOutput, []string{json}), "render")
+
+	res, err := excelize.OpenFile(tmpOutput)
+	s.Require().NoError(err, "open result")
+
+	for i, key := range []string{"OPS-1", "OPS-2"} {
+		row := fmt.Sprint(i + 2)
+		v, _ := res.GetCellValue(sheet, "A"+row)
+		s.Assert().Equal(key, v, "link text")
+		ok, target, err := res.GetCellHyperLink(sheet, "A"+row)
+		s.Require().NoError(err)
+		s.Assert().True(ok, "A%s has a hyperlink", row)
+		s.Assert().Equal("https://tracker.example/"+key, target)
+
+		v, _ = res.GetCellValue(sheet, "B"+row)
+		s.Assert().Equal("https://tracker.example/"+key, v, "url is the text when none given")
+
+		v, _ = res.GetCellValue(sheet, "C"+row)
+		s.Assert().Equal("см. "+key, v, "mixed text gets only the link text")
+		ok, _, _ = res.GetCellHyperLink(sheet, "C"+row)
+		s.Assert().False(ok, "mixed text has no hyperlink")
+	}
+
+	ok, target, err := res.GetCellHyperLink(sheet, "A4")
+	s.Require().NoError(err)
+	s.Assert().True(ok, "internal link")
+	s.Assert().Equal("Sheet1!A1", target)
+
+	// Ячейка без стиля получает стиль гиперссылки, стиль шаблона сохраняется
+	sid, _ := res.GetCellStyle(sheet, "A2")
+	st, err := res.GetStyle(sid)
+	s.Require().NoError(err)
+	s.Require().NotNil(st.Font)
+	s.Assert().Equal("single", st.Font.Underline)
+	sid, _ = res.GetCellStyle(sheet, "B2")
+	st, err = res.GetStyle(sid)
+	s.Require().NoError(err)
+	s.Require().NotNil(st.Font)
+	s.Assert().True(st.Font.Bold, "template style kept")
+	s.Assert().Empty(st.Font.Underline)
+}
+
+func (s *TemplateSuite) TestImagesInEachRows() {
+	tmpDir := s.T().TempDir()
+	tmpTemplate := filepath.Join(tmpDir, "images_template.xlsx")
+
+	// Маленькая PNG-картинка 40x20
+	var buf bytes.Buffer
+	s.Require().NoError(png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 40, 20))))
+	photoPath := filepath.Join(tmpDir, "photo.png")
+	s.Require().NoError(os.WriteFile(photoPath, buf.Bytes(), 0o644))
+	b64 := base64.StdEncoding.EncodeToString(buf.Bytes())
+
+	f := excelize.NewFile()
+	sheet := "Sheet1"
+
+	_ = f.SetCellValue(sheet, "A1", "Осмотр")
+	_ = f.SetCellValue(sheet, "A2", "{{#each $.checks as $c}}")
+	_ = f.SetCellValue(sheet, "A3", "{{= $c.name}}")
+	_ = f.SetCellValue(sheet, "B3", "{{= image($c.photo, fit='cell')}}")
+	_ = f.SetCellValue(sheet, "A4", "{{/each}}")
+	s.Require().NoError(f.MergeCell(sheet, "B3", "C3"))
+	s.Require().NoError(f.SaveAs(tmpTemplate), "save template")
+
+	render := func(tmpl *exceltemplar.Template, photo string) error {
+		doc, err := tmpl.Execute([]string{fmt.Sprintf(`{"checks": [{"name": "x", "photo": %q}]}`, photo)})
+		if doc != nil {
+			_ = doc.Close()
+		}
+		return err
+	}
+
+	// Без ImageFS файлы не читаются: путь из данных не открывает файлы сервера
+	tmpl, err := exceltemplar.LoadTemplate(tmpTemplate)
+	s.Require().NoError(err, "load template")
+	for _, photo := range []string{photoPath, "photo.png"} {
+		s.Assert().ErrorContains(render(tmpl, photo), "image:", "file %s without ImageFS", photo)
+	}
+
+	// С ImageFS пути отсчитываются от его корня, выйти за корень нельзя
+	tmpl.ImageFS(os.DirFS(tmpDir))
+	s.Require().NoError(os.Mkdir(filepath.Join(tmpDir, "assets"), 0o755))
+	for _, photo := range []string{photoPath, "../" + filepath.Base(tmpDir) + "/photo.png", "assets/../../photo.png"} {
+		s.Assert().ErrorContains(render(tmpl, photo), "image:", "path %s outside ImageFS", photo)
+	}
+
+	json := fmt.Sprintf(`{"checks": [
+		{"name": "файл", "photo": %q},
+		{"name": "base64", "photo": %q},
+		{"name": "data uri", "photo": %q},
+		{"name": "без фото"}
+	]}`, "assets/../photo.png", b64, "data:image/png;base64,"+b64)
+	doc, err := tmpl.Execute([]string{json})
+	s.Require().NoError(err, "render")
+	tmpOutput := filepath.Join(tmpDir, "images_output.xlsx")
+	s.Require().NoError(doc.Save(tmpOutput))
+	s.Require().NoError(doc.Close())
+
+	res, err := excelize.OpenFile(tmpOutput)
+	s.Require().NoError(err, "open result")
+
+	for _, cell := range []string{"B2", "B3", "B4"} {
+		pics, err := res.GetPictures(sheet, cell)
+		s.Require().NoError(err)
+		s.Require().Len(pics, 1, "picture anchored at %s", cell)
+		s.Assert().Equal(".png", pics[0].Extension)
+		s.Assert().Equal(buf.Bytes(), pics[0].File)
+	}
+	pics, err := res.GetPictures(sheet, "B5")
+	s.Require().NoError(err)
+	s.Assert().Empty(pics, "row without photo has no picture")
+	v, _ := res.GetCellValue(sheet, "B3")
+	s.Assert().Empty(v, "image cell has no text")
+
+	// Неизвестный источник — ошибка рендера
+	s.Assert().ErrorContains(render(tmpl, "not an image"), "image:")
+}
+
+func (s *TemplateSuite) TestCompileOnceRenderConcurrently() {
+	tmpDir := s.T().TempDir()
+	tmpTemplate := filepath.Join(tmpDir, "shared_template.xlsx")
+
+	f := excelize.NewFile()
+	sheet := "Sheet1"
+
+	_ = f.SetCellValue(sheet, "A1", "{{= $.title}}")
+	_ = f.SetCellValue(sheet, "A2", "{{#each $.items as $it}}")
+	_ = f.SetCellValue(sheet, "A3", "{{= $it}}")
+	_ = f.SetCellValue(sheet, "A4", "{{/each}}")
+	_ = f.SetCellValue(sheet, "A5", "Итого")
+	_ = f.SetCellFormula(sheet, "B5", "SUM(A3)")
+	s.Require().NoError(f.SaveAs(tmpTemplate), "save template")
+
+	tmpl, err := exceltemplar.LoadTemplate(tmpTemplate)
+	s.Require().NoError(err, "load template")
+
+	const workers = 16
+	var wg sync.WaitGroup
+	errs := make([]error, workers)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			items := make([]string, w+1)
+			for i := range items {
+				items[i] = fmt.Sprint(i + 1)
+			}
+			json := fmt.Sprintf(`{"title": "Отчёт %d", "items": [%s]}`, w, strings.Join(items, ","))
+			doc, err := tmpl.Execute([]string{json})
+			if err != nil {
+				errs[w] = err
+				return
+			}
+			defer doc.Close()
+			errs[w] = doc.Save(filepath.Join(tmpDir, fmt.Sprintf("shared_%d.xlsx", w)))
+		}(w)
+	}
+	wg.Wait()
+	for w, err := range errs {
+		s.Require().NoError(err, "render %d", w)
+	}
+
+	for w := 0; w < workers; w++ {
+		res, err := excelize.OpenFile(filepath.Join(tmpDir, fmt.Sprintf("shared_%d.xlsx", w)))
+		s.Require().NoError(err, "open result %d", w)
+		title, _ := res.GetCellValue(sheet, "A1")
+		s.Assert().Equal(fmt.Sprintf("Отчёт %d", w), title)
+		total, _ := res.GetCellFormula(sheet, fmt.Sprintf("B%d", w+3))
+		want := fmt.Sprintf("SUM(A2:A%d)", w+2)
+		if w == 0 {
+			want = "SUM(A2)"
+		}
+		s.Assert().Equal(want, total, "render %d has its own rows", w)
+		_ = res.Close()
+	}
+
+	// Устаревшая пара Render/Save продолжает работать поверх Execute
+	s.Require().NoError(tmpl.Render([]string{`{"title": "legacy", "items": [1]}`}))
+	legacy := filepath.Join(tmpDir, "legacy.xlsx")
+	s.Require().NoError(tmpl.Save(legacy))
+	res, err := excelize.OpenFile(legacy)
+	s.Require().NoError(err)
+	title, _ := res.GetCellValue(sheet, "A1")
+	s.Assert().Equal("legacy", title)
+}
+
+func (s *TemplateSuite) TestReaderFSAndWriterAPIs() {
+	f := excelize.NewFile()
+	sheet := "Sheet1"
+	_ = f.SetCellValue(sheet, "A1", "{{= $.title}}")
+	tplBuf, err := f.WriteToBuffer()
+	s.Require().NoError(err, "template bytes")
+	raw := tplBuf.Bytes()
+
+	cellA1 := func(data []byte) string {
+		res, err := excelize.OpenReader(bytes.NewReader(data))
+		s.Require().NoError(err, "open result")
+		defer res.Close()
+		v, _ := res.GetCellValue(sheet, "A1")
+		return v
+	}
+
+	// fs.FS (embed.FS и т.п.) → Bytes
+	tmpl, err := exceltemplar.LoadTemplateFS(fstest.MapFS{"tpl/report.xlsx": {Data: raw}}, "tpl/report.xlsx")
+	s.Require().NoError(err, "load from fs")
+	doc, err := tmpl.Execute([]string{`{"title": "из fs"}`})
+	s.Require().NoError(err, "execute")
+	out, err := doc.Bytes()
+	s.Require().NoError(err, "bytes")
+	s.Assert().Equal("из fs", cellA1(out))
+
+	// io.Reader → io.Writer
+	tmpl, err = exceltemplar.LoadTemplateFromReader(bytes.NewReader(raw))
+	s.Require().NoError(err, "load from reader")
+	doc, err = tmpl.Execute([]string{`{"title": "из reader"}`})
+	s.Require().NoError(err, "execute")
+	var w bytes.Buffer
+	n, err := doc.WriteTo(&w)
+	s.Require().NoError(err, "write to")
+	s.Assert().Equal(int64(w.Len()), n)
+	s.Assert().Equal("из reader", cellA1(w.Bytes()))
+
+	// Потоковый вариант WriteResultsWithTemplate
+	w.Reset()
+	s.Require().NoError(exceltemplar.WriteResultsWithTemplateIO(bytes.NewReader(raw), &w, []string{`{"title": "поток"}`}))
+	s.Assert().Equal("поток", cellA1(w.Bytes()))
+
+	_, err = exceltemplar.LoadTemplateFS(fstest.MapFS{}, "missing.xlsx")
+	s.Assert().ErrorIs(err, fs.ErrNotExist)
+}
+
+func (s *TemplateSuite) TestRenderGoData() {
+	tmpDir := s.T().TempDir()
+	tmpTemplate := filepath.Join(tmpDir, "go_data_template.xlsx")
+
+	f := excelize.NewFile()
+	sheet := "Sheet1"
+
+	_ = f.SetCellValue(sheet, "A1", "{{= $.Customer.Name}}")
+	_ = f.SetCellValue(sheet, "B1", "{{= $.Customer.vat}}")
+	_ = f.SetCellValue(sheet, "C1", "{{= $.created}}")
+	_ = f.SetCellValue(sheet, "D1", "{{= len($.lines)}}")
+	_ = f.SetCellValue(sheet, "E1", "{{= $.Secret}}")
+	_ = f.SetCellValue(sheet, "F1", "{{= $.Region}}")
+	_ = f.SetCellValue(sheet, "A2", "{{#each $.lines as $l}}")
+	_ = f.SetCellValue(sheet, "A3", "{{= $l.sku}}")
+	_ = f.SetCellValue(sheet, "B3", "{{= $l.qty}}")
+	_ = f.SetCellValue(sheet, "C3", "{{= $l.attrs.color}}")
+	_ = f.SetCellValue(sheet, "A4", "{{/each}}")
+	dateStyle, err := f.NewStyle(&excelize.Style{NumFmt: 14})
+	s.Require().NoError(err)
+	s.Require().NoError(f.SetCellStyle(sheet, "C1", "C1", dateStyle))
+	s.Require().NoError(f.SaveAs(tmpTemplate), "save template")
+
+	type Line struct {
+		SKU   string            `json:"sku"`
+		Qty   int               `json:"qty"`
+		Attrs map[string]string `json:"attrs,omitempty"`
+	}
+	type Customer struct {
+		Name string
+		VAT  string `json:"vat" excel:"vat"`
+	}
+	type Meta struct {
+		Region string
+	}
+	type Order struct {
+		Meta
+		Customer *Customer
+		Created  time.Time `excel:"created" json:"createdAt"`
+		Lines    []Line    `json:"lines"`
+		Secret   string    `json:"-"`
+	}
+	order := Order{
+		Meta:     Meta{Region: "Север"},
+		Customer: &Customer{Name: "ООО Ромашка", VAT: "7701"},
+		Created:  time.Date(2025, 3, 14, 0, 0, 0, 0, time.UTC),
+		Lines:    []Line{{SKU: "A-1", Qty: 2, Attrs: map[string]string{"color": "red"}}, {SKU: "B-2", Qty: 5}},
+		Secret:   "не выводить",
+	}
+
+	tmpl, err := exceltemplar.LoadTemplate(tmpTemplate)
+	s.Require().NoError(err, "load template")
+	doc, err := tmpl.ExecuteData(order)
+	s.Require().NoError(err, "execute data")
+	tmpOutput := filepath.Join(tmpDir, "go_data_output.xlsx")
+	s.Require().NoError(doc.Save(tmpOutput))
+	s.Require().NoError(doc.Close())
+
+	res, err := excelize.OpenFile(tmpOutput)
+	s.Require().NoError(err, "open result")
+
+	get := func(cell string) string {
+		v, _ := res.GetCellValue(sheet, cell)
+		return v
+	}
+	s.Assert().Equal("ООО Ромашка", get("A1"), "untagged field uses its Go name")
+	s.Assert().Equal("7701", get("B1"), "json/excel tag name")
+	s.Assert().Equal("2", get("D1"))
+	s.Assert().Empty(get("E1"), `json:"-" hides the field`)
+	s.Assert().Equal("Север", get("F1"), "embedded struct fields are promoted")
+	s.Assert().Equal([]string{"A-1", "2", "red"}, []string{get("A2"), get("B2"), get("C2")})
+	s.Assert().Equal([]string{"B-2", "5", ""}, []string{get("A3"), get("B3"), get("C3")})
+
+	// Дата записана числом Excel с форматом шаблона, а не строкой
+	raw, _ := res.GetCellValue(sheet, "C1", excelize.Options{RawCellValue: true})
+	s.Assert().Equal("45730", raw, "time.Time stays a date")
+	typ, _ := res.GetCellType(sheet, "B2")
+	s.Assert().NotEqual(excelize.CellTypeSharedString, typ, "ints stay numbers")
+
+	// Значения интерфейсного типа json.Marshaler разбираются по динамическому типу
+	doc, err = tmpl.ExecuteData(map[string]json.Marshaler{
+		"Customer": json.RawMessage(`{"Name": "ИП Иванов", "vat": "5001"}`),
+		"created":  order.Created,
+		"Region":   (*json.RawMessage)(nil),
+		"Secret":   nil,
+	})
+	s.Require().NoError(err, "execute data with json.Marshaler values")
+	out, err := doc.Bytes()
+	s.Require().NoError(err, "bytes")
+	s.Require().NoError(doc.Close())
+	res, err = excelize.OpenReader(bytes.NewReader(out))
+	s.Require().NoError(err, "open result")
+	s.Assert().Equal("ИП Иванов", get("A1"))
+	s.Assert().Equal("5001", get("B1"))
+	raw, _ = res.GetCellValue(sheet, "C1", excelize.Options{RawCellValue: true})
+	s.Assert().Equal("45730", raw, "time.Time behind json.Marshaler stays a date")
+	s.Assert().Empty(get("F1"), "nil pointer behind json.Marshaler")
+}
+
+func (s *TemplateSuite) TestUserFuncs() {
+	tmpDir := s.T().TempDir()
+
+	build := func(name string, cells map[string]string) string {
+		f := excelize.NewFile()
+		for addr, v := range cells {
+			_ = f.SetCellValue("Sheet1", addr, v)
+		}
+		path := filepath.Join(tmpDir, name)
+		s.Require().NoError(f.SaveAs(path), "save template")
+		return path
+	}
+	funcs := exceltemplar.FuncMap{
+		"vatRate": func(code string) float64 {
+			if code == "reduced" {
+				return 0.1
+			}
+			return 0.2
+		},
+		"statusLabel": func(st string) (string, error) {
+			switch st {
+			case "new":
+				return "Новая", nil
+			case "done":
+				return "Готово", nil
+			}
+			return "", fmt.Errorf("неизвестный статус %q", st)
+		},
+		"isVip": func(c map[string]interface{}) bool { return c["orders"].(float64) > 10 },
+	}
+
+	tpl := build("funcs_template.xlsx", map[string]string{
+		"A1": "{{#each $.orders as $o}}",
+		"A2": "{{= statusLabel($o.status)}}",
+		"B2": "{{= $o.sum * (1 + vatRate($o.vat))}}",
+		"A3": "{{#if isVip($o.customer)}}",
+		"A4": "VIP",
+		"A5": "{{/if}}",
+		"A6": "{{/each}}",
+	})
+	tmpl, err := exceltemplar.LoadTemplate(tpl)
+	s.Require().NoError(err, "load template")
+	s.Require().NoError(tmpl.Funcs(funcs), "register funcs")
+
+	doc, err := tmpl.Execute([]string{`{"orders": [
+		{"status": "new", "sum": 100, "vat": "reduced", "customer": {"orders": 12}},
+		{"status": "done", "sum": 50, "vat": "standard", "customer": {"orders": 1}}
+	]}`})
+	s.Require().NoError(err, "render")
+	rows, err := doc.File().GetRows("Sheet1")
+	s.Require().NoError(err)
+	s.Assert().Equal([][]string{{"Новая", "110"}, {"VIP"}, {"Готово", "60"}}, rows)
+	s.Require().NoError(doc.Close())
+
+	// Ошибка, возвращённая функцией, прерывает рендер
+	_, err = tmpl.Execute([]string{`{"orders": [{"status": "lost", "sum": 1, "vat": "x", "customer": {"orders": 0}}]}`})
+	s.Assert().ErrorContains(err, "неизвестный статус")
+
+	// Типы проверяются при регистрации функций, с адресом ячейки
+	bad := build("funcs_bad.xlsx", map[string]string{"C3": "Итого: {{= statusLabel($.s) * 2}}"})
+	tmpl, err = exceltemplar.LoadTemplate(bad)
+	s.Require().NoError(err, "load template")
+	err = tmpl.Funcs(funcs)
+	s.Require().Error(err, "string * int must not compile")
+	s.Assert().Contains(err.Error(), "C3")
+
+	bad = build("funcs_args.xlsx", map[string]string{"A1": "{{= vatRate($.a, $.b)}}"})
+	tmpl, err = exceltemplar.LoadTemplate(bad)
+	s.Require().NoError(err, "load template")
+	s.Assert().Error(tmpl.Funcs(funcs), "too many arguments")
+
+	s.Assert().ErrorContains(tmpl.Funcs(exceltemplar.FuncMap{"len": func(string) int { return 0 }}), "зарезервировано")
+	s.Assert().ErrorContains(tmpl.Funcs(exceltemplar.FuncMap{"rate": 0.2}), "ожидается функция")
+}
+
+func (s *TemplateSuite) TestPipeFilters() {
+	f := excelize.NewFile()
+	cells := map[string]string{
+		"A1": "{{#each $.rows as $r}}",
+		"A2": "{{= $r.name | trim | upper}}",
+		"B2": `{{= $r.amount | number:"# ##0,00"}}`,
+		"C2": `{{= $r.date | date:"02.01.2006"}}`,
+		"D2": `{{= $r.note | default:"—" | truncate:6}}`,
+		"E2": `Статус: {{= $r.status | label:"ru"}}`,
+		"F2": "{{= $r.amount | round:1}}",
+		"A3": "{{/each}}",
+	}
+	for addr, v := range cells {
+		_ = f.SetCellValue("Sheet1", addr, v)
+	}
+	path := filepath.Join(s.T().TempDir(), "filters_template.xlsx")
+	s.Require().NoError(f.SaveAs(path), "save template")
+
+	tmpl, err := exceltemplar.LoadTemplate(path)
+	s.Require().NoError(err, "load template")
+	// Пользовательский фильтр — обычная функция: значение приходит первым аргументом
+	s.Require().NoError(tmpl.Funcs(exceltemplar.FuncMap{
+		"label": func(st, lang string) string {
+			if st == "done" && lang == "ru" {
+				return "готово"
+			}
+			return st
+		},
+		// пользовательская функция переопределяет стандартный фильтр
+		"upper": func(v interface{}) string { return "<" + strings.ToUpper(fmt.Sprint(v)) + ">" },
+	}), "register filters")
+
+	doc, err := tmpl.Execute([]string{`{"rows": [
+		{"name": " иван ", "amount": 12345.678, "date": "2025-03-07", "note": "длинное примечание", "status": "done"},
+		{"name": "ольга", "amount": 5, "date": "2025-12-31T10:00:00Z", "status": "new"}
+	]}`})
+	s.Require().NoError(err, "render")
+	defer doc.Close()
+
+	rows, err := doc.File().GetRows("Sheet1")
+	s.Require().NoError(err)
+	s.Assert().Equal([][]string{
+		{"<ИВАН>", "12 345,68", "07.03.2025", "длинно…", "Статус: готово", "12345.7"},
+		{"<ОЛЬГА>", "5,00", "31.12.2025", "—", "Статус: new", "5"},
+	}, rows)
+	// round оставляет число числом
+	typ, err := doc.File().GetCellType("Sheet1", "F1")
+	s.Require().NoError(err)
+	s.Assert().NotEqual(excelize.CellTypeSharedString, typ)
+}
+
+func (s *TemplateSuite) TestNumFmtFromExpression() {
+	f := excelize.NewFile()
+	bold, err := f.NewStyle(&excelize.Style{Font: &excelize.Font{Bold: true}})
+	s.Require().NoError(err)
+	cells := map[string]string{
+		"A1": "{{#each $.rows as $r}}",
+		"A2": `{{= $r.rate :fmt "0.00%"}}`,
+		"B2": `{{= $r.due | parseDate :fmt "dd.mm.yyyy"}}`,
+		"C2": `{{= $r.sum :fmt '#,##0.00" ₽"'}}`,
+		"D2": `Ставка {{= $r.rate :fmt "0%"}}`,
+		"A3": "{{/each}}",
+	}
+	for addr, v := range cells {
+		_ = f.SetCellValue("Sheet1", addr, v)
+	}
+	s.Require().NoError(f.SetCellStyle("Sheet1", "A2", "A2", bold))
+	path := filepath.Join(s.T().TempDir(), "numfmt_template.xlsx")
+	s.Require().NoError(f.SaveAs(path), "save template")
+
+	tmpl, err := exceltemplar.LoadTemplate(path)
+	s.Require().NoError(err, "load template")
+	doc, err := tmpl.Execute([]string{`{"rows": [
+		{"rate": 0.125, "due": "2025-03-07", "sum": 1234.5},
+		{"rate": 0.2, "due": "2025-12-31", "sum": 10},
+		{"rate": 1, "due": "2026-01-01", "sum": 0}
+	]}`})
+	s.Require().NoError(err, "render")
+	defer doc.Close()
+	out := doc.File()
+
+	for addr, want := range map[string]string{
+		"A1": "12.50%", "B1": "07.03.2025", "C1": "1,234.50 ₽", "D1": "Ставка 0.125",
+		"A2": "20.00%", "B2": "31.12.2025", "C2": "10.00 ₽",
+	} {
+		got, err := out.GetCellValue("Sheet1", addr)
+		s.Require().NoError(err)
+		s.Assert().Equal(want, got, addr)
+	}
+
+	// Стиль шаблонной ячейки сохраняется, формат добавляется поверх
+	sid, err := out.GetCellStyle("Sheet1", "A1")
+	s.Require().NoError(err)
+	st, err := out.GetStyle(sid)
+	s.Require().NoError(err)
+	s.Assert().True(st.Font != nil && st.Font.Bold, "bold from the template cell")
+	s.Require().NotNil(st.CustomNumFmt)
+	s.Assert().Equal("0.00%", *st.CustomNumFmt)
+
+	// Все строки блока получают один и тот же стиль
+	for _, col := range []string{"A", "B", "C"} {
+		first, err := out.GetCellStyle("Sheet1", col+"1")
+		s.Require().NoError(err)
+		for row := 2; row <= 3; row++ {
+			sid, err := out.GetCellStyle("Sheet1", fmt.Sprintf("%s%d", col, row))
+			s.Require().NoError(err)
+			s.Assert().Equal(first, sid, "%s%d reuses the cached style", col, row)
+		}
+	}
+}
+
+func (s *TemplateSuite) TestStyleDirectives() {
+	f := excelize.NewFile()
+	_, err := f.NewSheet("_styles")
+	s.Require().NoError(err)
+	red, err := f.NewStyle(&excelize.Style{Fill: excelize.Fill{Type: "pattern", Pattern: 1, Color: []string{"FFC7CE"}}})
+	s.Require().NoError(err)
+	bold, err := f.NewStyle(&excelize.Style{Font: &excelize.Font{Bold: true}})
+	s.Require().NoError(err)
+	_ = f.SetCellValue("_styles", "A1", "danger")
+	_ = f.SetCellValue("_styles", "A2", "bold")
+	s.Require().NoError(f.SetCellStyle("_styles", "A1", "A1", red))
+	s.Require().NoError(f.SetCellStyle("_styles", "A2", "A2", bold))
+	s.Require().NoError(f.SetSheetVisible("_styles", false))
+
+	italic, err := f.NewStyle(&excelize.Style{
+		Font:   &excelize.Font{Italic: true},
+		Border: []excelize.Border{{Type: "left", Style: 1}, {Type: "bottom", Style: 1}},
+	})
+	s.Require().NoError(err)
+	cells := map[string]string{
+		"A1": "{{#each $.rows as $r}}",
+		"A2": `{{= $r.title}}{{style iif($r.overdue, 'danger', $r.done ? 'done' : '')}}`,
+		"B2": `{{style $r.overdue ? 'danger' : ''}}{{= $r.sum :fmt "0.00"}}`,
+		"C2": `Статус{{style $r.vip ? 'bold danger' : ''}}`,
+		"A3": "{{/each}}",
+	}
+	for addr, v := range cells {
+		_ = f.SetCellValue("Sheet1", addr, v)
+	}
+	s.Require().NoError(f.SetCellStyle("Sheet1", "A2", "A2", italic))
+	path := filepath.Join(s.T().TempDir(), "style_template.xlsx")
+	s.Require().NoError(f.SaveAs(path), "save template")
+
+	tmpl, err := exceltemplar.LoadTemplate(path)
+	s.Require().NoError(err, "load template")
+	s.Require().NoError(tmpl.Styles(map[string]*excelize.Style{
+		"done": {Fill: excelize.Fill{Type: "pattern", Pattern: 1, Color: []string{"C6EFCE"}}, Border: []excelize.Border{{Type: "bottom", Style: 2}}},
+	}), "register styles")
+
+	doc, err := tmpl.Execute([]string{`{"rows": [
+		{"title": "Просрочено", "overdue": true, "done": false, "sum": 10, "vip": true},
+		{"title": "Готово", "overdue": false, "done": true, "sum": 2.5, "vip": false},
+		{"title": "В работе", "overdue": false, "done": false, "sum": 1, "vip": false},
+		{"title": "Ещё просрочено", "overdue": true, "done": false, "sum": 3, "vip": false}
+	]}`})
+	s.Require().NoError(err, "render")
+	defer doc.Close()
+	out := doc.File()
+
+	s.Assert().NotContains(out.GetSheetList(), "_styles", "style sheet is removed from the result")
+	rows, err := out.GetRows("Sheet1")
+	s.Require().NoError(err)
+	s.Assert().Equal([][]string{
+		{"Просрочено", "10.00", "Статус"},
+		{"Готово", "2.50", "Статус"},
+		{"В работе", "1.00", "Статус"},
+		{"Ещё просрочено", "3.00", "Статус"},
+	}, rows)
+
+	style := func(addr string) (int, *excelize.Style) {
+		sid, err := out.GetCellStyle("Sheet1", addr)
+		s.Require().NoError(err)
+		st, err := out.GetStyle(sid)
+		s.Require().NoError(err)
+		return sid, st
+	}
+	// Именованный стиль накладывается на стиль шаблона: курсив и левая граница остаются
+	sidA1, a1 := style("A1")
+	s.Assert().Equal([]string{"FFC7CE"}, a1.Fill.Color)
+	s.Require().NotNil(a1.Font)
+	s.Assert().True(a1.Font.Italic)
+	_, a2 := style("A2")
+	s.Assert().Equal([]string{"C6EFCE"}, a2.Fill.Color)
+	s.Assert().True(a2.Font.Italic)
+	borders := map[string]int{}
+	for _, b := range a2.Border {
+		borders[b.Type] = b.Style
+	}
+	s.Assert().Equal(map[string]int{"left": 1, "bottom": 2}, borders)
+	_, a3 := style("A3")
+	s.Assert().Empty(a3.Fill.Color, "empty style name keeps the template style")
+	sidA4, _ := style("A4")
+	s.Assert().Equal(sidA1, sidA4, "same template cell and style names reuse one style")
+
+	// :fmt и {{style}} в одной ячейке
+	_, b1 := style("B1")
+	s.Assert().Equal([]string{"FFC7CE"}, b1.Fill.Color)
+	s.Require().NotNil(b1.CustomNumFmt)
+	s.Assert().Equal("0.00", *b1.CustomNumFmt)
+	// несколько имён через пробел
+	_, c1 := style("C1")
+	s.Assert().True(c1.Font != nil && c1.Font.Bold)
+	s.Assert().Equal([]string{"FFC7CE"}, c1.Fill.Color)
+
+	// Неизвестное имя стиля — ошибка рендера с адресом ячейки
+	_, err = tmpl.Execute([]string{`{"rows": [{"title": "x", "overdue": false, "done": false, "sum": 1, "vip": false}]}`})
+	s.Require().NoError(err)
+	s.Assert().ErrorContains(tmpl.Styles(map[string]*excelize.Style{"bad name": {}}), "пробелы")
+	bad, err := exceltemplar.LoadTemplate(path)
+	s.Require().NoError(err)
+	_, err = bad.Execute([]string{`{"rows": [{"title": "x", "overdue": false, "done": true, "sum": 1, "vip": false}]}`})
+	s.Assert().ErrorContains(err, `неизвестный стиль "done"`)
+}
+
+func (s *TemplateSuite) TestStrictMode() {
+	tmpDir := s.T().TempDir()
+	build := func(name string, cells map[string]string) *exceltemplar.Template {
+		f := excelize.NewFile()
+		for addr, v := range cells {
+			_ = f.SetCellValue("Sheet1", addr, v)
+		}
+		path := filepath.Join(tmpDir, name)
+		s.Require().NoError(f.SaveAs(path), "save template")
+		tmpl, err := exceltemplar.LoadTemplate(path)
+		s.Require().NoError(err, "load template")
+		return tmpl
+	}
+	render := func(tmpl *exceltemplar.Template, data string) ([][]string, error) {
+		doc, err := tmpl.Execute([]string{data})
+		if err != nil {
+			return nil, err
+		}
+		defer doc.Close()
+		return doc.File().GetRows("Sheet1")
+	}
+
+	tmpl := build("strict.xlsx", map[string]string{
+		"A1":  "{{= $.title}}",
+		"B1":  "{{= $.note ?}}",
+		"C1":  `{{= $.sum ? :fmt "0.00"}}`,
+		"A2":  "{{#each $.items as $it}}",
+		"A3":  "{{= $it.name}}",
+		"B3":  "{{= $it.qty?}}",
+		"A4":  "{{/each}}",
+		"A5":  "{{#each $.extra? as $e}}",
+		"A6":  "{{= $e}}",
+		"A7":  "{{/each}}",
+		"A8":  "{{#if $.flag ?}}",
+		"A9":  "флаг",
+		"A10": "{{/if}}",
+	})
+	data := `{"title": "Отчёт", "items": [{"name": "a", "qty": 1}, {"name": "b"}]}`
+
+	// Без строгого режима отсутствующие значения по-прежнему пустые
+	rows, err := render(tmpl, `{"items": [{"name": "a"}]}`)
+	s.Require().NoError(err)
+	s.Assert().Equal([][]string{nil, {"a"}}, rows)
+
+	tmpl.Strict(true)
+	rows, err = render(tmpl, data)
+	s.Require().NoError(err, "values marked with ? may be missing")
+	s.Assert().Equal([][]string{{"Отчёт"}, {"a", "1"}, {"b"}}, rows)
+
+	_, err = render(tmpl, `{"items": []}`)
+	s.Assert().ErrorContains(err, "путь $.title не найден")
+	_, err = render(tmpl, `{"title": "x", "items": [{"qty": 1}]}`)
+	s.Assert().ErrorContains(err, "путь $it.name не найден")
+	_, err = render(tmpl, `{"title": "x"}`)
+	s.Assert().ErrorContains(err, "each $.items")
+	_, err = render(tmpl, `{"title": "x", "items": {"name": "a"}}`)
+	s.Assert().ErrorContains(err, "ожидается массив, получено объект")
+	rows, err = render(tmpl, `{"title": "x", "items": null}`)
+	s.Require().NoError(err, "null is an empty array")
+	s.Assert().Equal([][]string{{"x"}}, rows)
+
+	// Опечатка в имени переменной цикла
+	typo := build("strict_typo.xlsx", map[string]string{
+		"A1": "{{#each $.items as $item}}",
+		"A2": "{{= $itme.name}}",
+		"A3": "{{/each}}",
+	})
+	typo.Strict(true)
+	_, err = render(typo, data)
+	s.Assert().ErrorContains(err, "неизвестная переменная $itme")
+
+	obj := build("strict_obj.xlsx", map[string]string{
+		"A1": "{{#each-obj $.totals as $k $v}}",
+		"A2": "{{= $k}}",
+		"A3": "{{/each-obj}}",
+	})
+	obj.Strict(true)
+	_, err = render(obj, `{"totals": [1, 2]}`)
+	s.Assert().ErrorContains(err, "each-obj $.totals: ожидается объект, получено массив")
+	rows, err = render(obj, `{"totals": {"a": 1}}`)
+	s.Require().NoError(err)
+	s.Assert().Equal([][]string{{"a"}}, rows)
+}
+
+func (s *TemplateSuite) TestTemplateErrors() {
+	tmpDir := s.T().TempDir()
+	save := func(name string, cells map[string]string) string {
+		f := excelize.NewFile()
+		for addr, v := range cells {
+			_ = f.SetCellValue("Sheet1", addr, v)
+		}
+		path := filepath.Join(tmpDir, name)
+		s.Require().NoError(f.SaveAs(path), "save template")
+		return path
+	}
+	asTemplateError := func(err error) *exceltemplar.TemplateError {
+		var te *exceltemplar.TemplateError
+		s.Require().True(errors.As(err, &te), "expected TemplateError, got %v", err)
+		return te
+	}
+
+	tmpl, err := exceltemplar.LoadTemplate(save("errors.xlsx", map[string]string{
+		"A1": "{{#each $.projects as $p}}",
+		"A2": "{{#each $p.tasks as $t}}",
+		"A3": "{{= $t.name}}",
+		"B3": "Теги: {{= $t.tags}}",
+		"A4": "{{/each}}",
+		"A5": "{{/each}}",
+		"A6": `{{#if len($.total) > 0}}`,
+		"A7": "{{= join($.total, ',')}}",
+		"A8": "{{/if}}",
+	}))
+	s.Require().NoError(err, "load template")
+
+	// Ошибка вычисления указывает на ячейку шаблона и элемент данных
+	_, err = tmpl.Execute([]string{`{"projects": [
+		{"tasks": [{"name": "a", "tags": "x"}]},
+		{"tasks": [{"name": "b", "tags": ["x", "y"]}]}
+	]}`})
+	te := asTemplateError(err)
+	s.Assert().Equal(exceltemplar.CodeCollection, te.Code)
+	s.Assert().Equal("Sheet1", te.Sheet)
+	s.Assert().Equal("B3", te.Cell)
+	s.Assert().Equal("Теги: {{= $t.tags}}", te.Raw)
+	s.Assert().Equal("$t.tags", te.Expr)
+	s.Assert().Equal("$.projects[1].tasks[0]", te.Path)
+	s.Assert().True(strings.HasPrefix(err.Error(), "лист Sheet1, ячейка B3, элемент $.projects[1].tasks[0]: "), err.Error())
+
+	// Ошибка аргумента встроенной функции
+	_, err = tmpl.Execute([]string{`{"projects": [], "total": "12"}`})
+	te = asTemplateError(err)
+	s.Assert().Equal(exceltemplar.CodeArgument, te.Code)
+	s.Assert().Equal("A7", te.Cell)
+	s.Assert().ErrorContains(err, "join: не массив")
+
+	// Строгий режим: код отсутствующего пути и условие {{#if}}
+	tmpl.Strict(true)
+	_, err = tmpl.Execute([]string{`{"projects": []}`})
+	te = asTemplateError(err)
+	s.Assert().Equal(exceltemplar.CodeMissingPath, te.Code)
+	s.Assert().Equal("A6", te.Cell)
+	s.Assert().Equal("len($.total) > 0", te.Expr)
+
+	// Ошибка разбора: незакрытый блок указывает на свой маркер
+	_, err = exceltemplar.LoadTemplate(save("unbalanced.xlsx", map[string]string{
+		"A1": "Заголовок",
+		"B2": "{{#each $.items}}",
+		"B3": "{{= .name}}",
+	}))
+	te = asTemplateError(err)
+	s.Assert().Equal(exceltemplar.CodeSyntax, te.Code)
+	s.Assert().Equal("Sheet1", te.Sheet)
+	s.Assert().Equal("B2", te.Cell)
+	s.Assert().Equal("{{#each $.items}}", te.Raw)
+
+	// Ошибка компиляции выражения
+	bad, err := exceltemplar.LoadTemplate(save("bad_expr.xlsx", map[string]string{"C4": "{{= $.a +* 2}}"}))
+	s.Require().NoError(err)
+	_, err = bad.Execute([]string{`{"a": 1}`})
+	te = asTemplateError(err)
+	s.Assert().Equal(exceltemplar.CodeExpr, te.Code)
+	s.Assert().Equal("C4", te.Cell)
+	te = asTemplateError(bad.Funcs(exceltemplar.FuncMap{}))
+	s.Assert().Equal(exceltemplar.CodeExpr, te.Code)
+	s.Assert().Equal("C4", te.Cell)
+}
+
+func (s *TemplateSuite) TestCollectErrors() {
+	f := excelize.NewFile()
+	for addr, v := range map[string]string{
+		"A1": "Отчёт",
+		"A2": "{{#each $.items as $it}}",
+		"A3": "{{= $it.name}}",
+		"B3": "{{= join($it.tags, ',')}}",
+		"C3": "Кол-во: {{= $it.qty}}",
+		"A4": "{{/each}}",
+		"A5": "{{#each $.missing as $m}}",
+		"A6": "{{= $m}}",
+		"A7": "{{/each}}",
+		"A8": "{{= $.title}}",
+	} {
+		_ = f.SetCellValue("Sheet1", addr, v)
+	}
+	path := filepath.Join(s.T().TempDir(), "collect.xlsx")
+	s.Require().NoError(f.SaveAs(path), "save template")
+	tmpl, err := exceltemplar.LoadTemplate(path)
+	s.Require().NoError(err, "load template")
+	tmpl.Strict(true)
+	data := `{"title": "Итог", "items": [{"name": "a", "tags": ["x", "y"]}, {"name": "b", "tags": "z"}]}`
+
+	// Без режима сбора рендер прерывается на первой ошибке
+	_, err = tmpl.Execute([]string{data})
+	s.Require().Error(err)
+	var rep *exceltemplar.RenderReport
+	s.Assert().False(errors.As(err, &rep))
+
+	// В режиме сбора документ дорендеривается, ячейки с ошибками получают #ERR
+	tmpl.CollectErrors(true)
+	tmpl.ErrorComments(true)
+	doc, renderErr := tmpl.Execute([]string{data})
+	s.Require().NotNil(doc)
+	defer doc.Close()
+	s.Require().True(errors.As(renderErr, &rep), "expected RenderReport, got %v", renderErr)
+	s.Assert().Same(rep, doc.Report())
+
+	rows, err := doc.File().GetRows("Sheet1")
+	s.Require().NoError(err)
+	s.Assert().Equal([][]string{
+		{"Отчёт"},
+		{"a", "x,y", "#ERR"},
+		{"b", "#ERR", "#ERR"},
+		{"Итог"},
+	}, rows)
+
+	// Отчёт перечисляет все проблемы с местом
+	type loc struct {
+		code       exceltemplar.ErrorCode
+		cell, path string
+	}
+	var got []loc
+	for _, te := range rep.Errors {
+		got = append(got, loc{te.Code, te.Cell, te.Path})
+	}
+	s.Assert().Equal([]loc{
+		{exceltemplar.CodeMissingPath, "C3", "$.items[0]"},
+		{exceltemplar.CodeArgument, "B3", "$.items[1]"},
+		{exceltemplar.CodeMissingPath, "C3", "$.items[1]"},
+		{exceltemplar.CodeMissingPath, "A5", ""},
+	}, got)
+	var te *exceltemplar.TemplateError
+	s.Assert().True(errors.As(renderErr, &te), "RenderReport unwraps to TemplateError")
+	s.Assert().True(strings.HasPrefix(renderErr.Error(), "ошибок шаблона: 4\n"), renderErr.Error())
+
+	// Примечания с текстом ошибки стоят в итоговых ячейках
+	comments, err := doc.File().GetComments("Sheet1")
+	s.Require().NoError(err)
+	text := map[string]string{}
+	for _, c := range comments {
+		text[c.Cell] = c.Text
+		for _, p := range c.Paragraph {
+			text[c.Cell] += p.Text
+		}
+	}
+	s.Assert().Len(text, 3)
+	s.Assert().Contains(text["B3"], "join: не массив")
+	s.Assert().Contains(text["C2"], "ячейка C3")
+}
+
+func (s *TemplateSuite) TestValidate() {
+	tmpDir := s.T().TempDir()
+	save := func(name string, cells map[string]string) string {
+		f := excelize.NewFile()
+		for addr, v := range cells {
+			_ = f.SetCellValue("Sheet1", addr, v)
+		}
+		path := filepath.Join(tmpDir, name)
+		s.Require().NoError(f.SaveAs(path), "save template")
+		return path
+	}
+	type found struct {
+		severity exceltemplar.Severity
+		code     exceltemplar.ErrorCode
+		cell     string
+	}
+	lint := func(path string) []found {
+		var out []found
+		for _, is := range exceltemplar.Validate(path) {
+			s.Assert().Equal("Sheet1", is.Sheet, is.String())
+			out = append(out, found{is.Severity, is.Code, is.Cell})
+		}
+		return out
+	}
+
+	// Чистый шаблон замечаний не даёт
+	s.Assert().Empty(lint(save("clean.xlsx", map[string]string{
+		"A1": "{{#each $.groups as $g i=$i}}",
+		"A2": "{{= $i + 1}}. {{= $g.name | upper}}",
+		"A3": "{{#each-obj $g.props as $k $v}}",
+		"A4": `{{= $k}}: {{= $v :fmt "0.00"}}{{style iif($v > 10, "warn", "")}}`,
+		"A5": "{{/each-obj}}",
+		"A6": "{{/each}}",
+		"A7": "Итого: {{= len($.groups)}}",
+	})))
+
+	s.Assert().ElementsMatch([]found{
+		// содержимое строки с маркером остаётся невычисленным
+		{exceltemplar.SeverityWarning, exceltemplar.CodeIgnoredCell, "B1"},
+		// выражение не компилируется
+		{exceltemplar.SeverityError, exceltemplar.CodeExpr, "A2"},
+		// {{/each}} закрывает each-obj
+		{exceltemplar.SeverityWarning, exceltemplar.CodeBlockMismatch, "A5"},
+		// переменная вне своего цикла и необъявленная переменная
+		{exceltemplar.SeverityWarning, exceltemplar.CodeVarScope, "A7"},
+		{exceltemplar.SeverityWarning, exceltemplar.CodeUnknownVar, "B7"},
+		// похоже на директиву, но ею не является
+		{exceltemplar.SeverityWarning, exceltemplar.CodeBadDirective, "A8"},
+		{exceltemplar.SeverityWarning, exceltemplar.CodeBadDirective, "B8"},
+	}, lint(save("issues.xlsx", map[string]string{
+		"A1": "{{#each $.items as $it}}",
+		"B1": "Заголовок",
+		"A2": "{{= $it.qty +* 2}}",
+		"A3": "{{#each-obj $it.props as $k $v}}",
+		"A4": "{{= $k}}",
+		"A5": "{{/each}}",
+		"A6": "{{/each}}",
+		"A7": "{{= $it.name}}",
+		"B7": "{{= $itme.name}}",
+		"A8": "{{#each}}",
+		"B8": "{{ $.title }}",
+	})))
+
+	// Строка с маркером и другим содержимым не удаляется: она выводится один раз как есть
+	marked := save("marked.xlsx", map[string]string{
+		"A1": "{{#each $.items as $it}}",
+		"B1": "Заголовок {{= len($.items)}}",
+		"A2": "{{= $it}}",
+		"A3": "{{/each}}",
+	})
+	issues := exceltemplar.Validate(marked)
+	s.Require().Len(issues, 1)
+	s.Assert().Equal(exceltemplar.CodeIgnoredCell, issues[0].Code)
+	s.Assert().Contains(issues[0].Message, "остаётся в результате как есть")
+	tmpl, err := exceltemplar.LoadTemplate(marked)
+	s.Require().NoError(err, "load")
+	doc, err := tmpl.Execute([]string{`{"items": ["a", "b"]}`})
+	s.Require().NoError(err, "execute")
+	defer doc.Close()
+	rows, err := doc.File().GetRows("Sheet1")
+	s.Require().NoError(err, "get rows")
+	s.Assert().Equal([][]string{{"{{#each $.items as $it}}", "Заголовок {{= len($.items)}}"}, {"a"}, {"b"}}, rows, "marker row kept raw")
+
+	// Ошибка разбора — замечание с уровнем error
+	s.Assert().Equal([]found{{exceltemplar.SeverityError, exceltemplar.CodeSyntax, "A1"}},
+		lint(save("unbalanced.xlsx", map[string]string{"A1": "{{#if $.x}}", "A2": "текст"})))
+
+	issues = exceltemplar.Validate(filepath.Join(tmpDir, "missing.xlsx"))
+	s.Require().Len(issues, 1)
+	s.Assert().Equal(exceltemplar.SeverityError, issues[0].Severity)
+}
+
+func (s *TemplateSuite) TestOutline() {
+	f := excelize.NewFile()
+	for addr, v := range map[string]string{
+		"A1":  "{{#each $.groups as $g i=$i}}",
+		"A2":  "{{= $i + 1}}. {{= $g.name | upper}}",
+		"A3":  "{{#each-obj $g.props as $k $v}}",
+		"A4":  "{{= $k}}: {{= $v.value}}",
+		"A5":  "{{/each-obj}}",
+		"A6":  "{{/each}}",
+		"A7":  "{{#if len($.notes) > 0}}",
+		"A8":  "{{= join($.notes, ', ')}}",
+		"A9":  "{{else}}",
+		"A10": "{{= company.name}}",
+		"A11": "{{/if}}",
+	} {
+		_ = f.SetCellValue("Sheet1", addr, v)
+	}
+	path := filepath.Join(s.T().TempDir(), "outline.xlsx")
+	s.Require().NoError(f.SaveAs(path), "save template")
+	tmpl, err := exceltemplar.LoadTemplate(path)
+	s.Require().NoError(err, "load template")
+
+	outline := tmpl.Outline()
+	s.Require().Len(outline, 1)
+	so := outline[0]
+	s.Assert().Equal("Sheet1", so.Name)
+	s.Assert().Equal([]string{
+		"$.company.name",
+		"$.groups",
+		"$.groups[].name",
+		"$.groups[].props",
+		"$.groups[].props.*.value",
+		"$.notes",
+	}, so.Paths)
+
+	var tree func(nodes []*exceltemplar.OutlineNode) []string
+	tree = func(nodes []*exceltemplar.OutlineNode) []string {
+		var out []string
+		for _, n := range nodes {
+			out = append(out, n.Kind+" "+n.Cell)
+			for _, c := range tree(n.Children) {
+				out = append(out, "  "+c)
+			}
+		}
+		return out
+	}
+	s.Assert().Equal([]string{
+		"each A1",
+		"  cell A2",
+		"  each-obj A3",
+		"    cell A4",
+		"if A7",
+		"  cell A8",
+		"  else ",
+		"    cell A10",
+	}, tree(so.Blocks))
+	s.Assert().Equal([]string{"$g", "$i"}, so.Blocks[0].Vars)
+}
+
+func (s *TemplateSuite) TestExpressionDataRegressions() {
+	f := excelize.NewFile()
+	for addr, v := range map[string]string{
+		"A1": "{{= $.first-name}}",
+		"B1": "{{= $.missing + 1}}",
+		"C1": "{{= $.n % 2}}",
+		"D1": "{{= $.n - 1}}",
+	} {
+		_ = f.SetCellValue("Sheet1", addr, v)
+	}
+	path := filepath.Join(s.T().TempDir(), "regress.xlsx")
+	s.Require().NoError(f.SaveAs(path), "save template")
+	tmpl, err := exceltemplar.LoadTemplate(path)
+	s.Require().NoError(err, "load template")
+
+	doc, err := tmpl.Execute([]string{`{"first-name": "Анна", "n": 7}`})
+	s.Require().NoError(err)
+	defer doc.Close()
+	rows, err := doc.File().GetRows("Sheet1")
+	s.Require().NoError(err)
+	s.Assert().Equal([][]string{{"Анна", "1", "1", "6"}}, rows)
+}